@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/mariomac/msxmml/pkg/psg"
+)
+
+// dumpCmd prints the instructions of a PSG binary, as generated by the export:
+// m4l dump song.bin
+// Without file, it reads the standard input.
+func dumpCmd(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s dump [song.bin]\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Prints the offset, start frame, bytes and mnemonic of each instruction of a PSG binary\n")
+	}
+	_ = flags.Parse(args)
+
+	input := "-"
+	if flags.NArg() > 0 {
+		input = flags.Arg(0)
+	}
+	var data []byte
+	var err error
+	if input == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(input)
+	}
+	if err != nil {
+		fmt.Printf("ERROR reading file %q: %v\n", input, err)
+		os.Exit(-1)
+	}
+	prog, decodeErr := psg.Decode(data)
+	// on error, the instructions that could be decoded are also printed
+	if len(data) >= 2 {
+		printProgram(os.Stdout, data, prog)
+	}
+	if decodeErr != nil {
+		fmt.Printf("ERROR decoding file %q: %v\n", input, decodeErr)
+		os.Exit(-1)
+	}
+}
+
+// printProgram prints one instruction per line, preceded by the offset of the instruction, the
+// frame where it is executed and its encoded bytes
+func printProgram(out io.Writer, data []byte, prog psg.Program) {
+	fmt.Fprintf(out, "%-6s %6s  %-8s  %s\n", "offset", "frame", "bytes", "instruction")
+	if prog.LoopOffset == 0 {
+		fmt.Fprintf(out, "%04x   %6s  %-8s  ; no loop\n", 0, "", hexBytes(data[:2]))
+	} else {
+		fmt.Fprintf(out, "%04x   %6s  %-8s  ; loop at %04x\n", 0, "", hexBytes(data[:2]), prog.LoopOffset)
+	}
+	offset, frame := 2, 0
+	for _, ins := range prog.Instructions {
+		if offset == prog.LoopOffset {
+			fmt.Fprintln(out, "loop:")
+		}
+		fmt.Fprintf(out, "%04x   %6d  %-8s  %v\n", offset, frame, hexBytes(data[offset:offset+ins.Size()]), ins)
+		offset += ins.Size()
+		if ins.Type == psg.Wait {
+			frame += int(ins.Data)
+		}
+	}
+}
+
+func hexBytes(data []byte) string {
+	hb := make([]string, 0, len(data))
+	for _, b := range data {
+		hb = append(hb, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(hb, " ")
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+// formatCmd rewrites the song files in the canonical layout:
+// m4l fmt [-w] file...
+// Without files, it formats the standard input.
+func formatCmd(args []string) {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	var write bool
+	flags.BoolVar(&write, "w", false, "write the result to the source file instead of the standard output")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s fmt [-w] file...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if err := lang.Format(os.Stdout, os.Stdin); err != nil {
+			exitParseError("-", err)
+		}
+		return
+	}
+	for _, file := range flags.Args() {
+		src, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("ERROR reading file %q: %v\n", file, err)
+			os.Exit(-1)
+		}
+		out := bytes.Buffer{}
+		if err := lang.Format(&out, bytes.NewReader(src)); err != nil {
+			exitParseError(file, err)
+		}
+		if !write {
+			os.Stdout.Write(out.Bytes())
+			continue
+		}
+		if bytes.Equal(src, out.Bytes()) {
+			continue
+		}
+		if err := os.WriteFile(file, out.Bytes(), 0644); err != nil {
+			fmt.Printf("ERROR writing file %q: %v\n", file, err)
+			os.Exit(-1)
+		}
+	}
+}
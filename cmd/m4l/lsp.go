@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mariomac/msxmml/pkg/lsp"
+)
+
+// lspCmd runs a Language Server Protocol server through the standard input and output:
+// m4l lsp
+func lspCmd(args []string) {
+	flags := flag.NewFlagSet("lsp", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s lsp\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Runs a Language Server Protocol server through the standard input and output\n")
+	}
+	_ = flags.Parse(args)
+	// the standard output is used by the protocol, so the logs are sent to the error output
+	log.SetOutput(os.Stderr)
+	if err := lsp.NewServer(os.Stdin, os.Stdout).Serve(); err != nil {
+		log.Printf("ERROR: %v", err)
+		os.Exit(-1)
+	}
+}
@@ -3,41 +3,104 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+
 	"github.com/mariomac/msxmml/pkg/lang"
 	"github.com/mariomac/msxmml/pkg/psg"
-	"os"
+	"github.com/mariomac/msxmml/pkg/song"
 )
 
+// subcommands receive the command-line arguments after the subcommand name
+var subcommands = map[string]func(args []string){
+	"dump":   dumpCmd,
+	"fmt":    formatCmd,
+	"lsp":    lspCmd,
+	"midi":   midiCmd,
+	"render": renderCmd,
+	"vgm":    vgmCmd,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
 	var input, output string
-	var help bool
-	flag.StringVar(&input, "in", "", "input file")
+	var help, checkBars bool
+	flag.StringVar(&input, "in", "", "input file (- for standard input)")
 	flag.StringVar(&output, "out", "", "output binary file for PSG")
+	flag.BoolVar(&checkBars, "checkbars", false,
+		"warn about the bars that don't last a measure of the timesig header property")
 	flag.BoolVar(&help, "h", false, "show help")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s [-checkbars] -in song.m4l -out song.bin\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s fmt [-w] file...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s lsp\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s dump [song.bin]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s render [-rate 44100] [-hz 60] [-loops 1] [-fade 0s] -in song.m4l -out song.wav\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s vgm -in song.m4l -out song.vgm\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  %s midi [-cc7] [-channel name=channel:program]... -in song.m4l -out song.mid\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 	if input == "" || output == "" || help {
-		flag.PrintDefaults()
+		flag.Usage()
 		os.Exit(0)
 	}
 
-	in, err := os.Open(input)
-	if err != nil {
-		fmt.Printf("ERROR opening input file %q: %v\n", input, err)
-		os.Exit(-1)
+	var opts []lang.Option
+	if checkBars {
+		opts = append(opts, lang.WithBarCheck())
 	}
-	defer in.Close()
-	song, err := lang.Parse(in)
+	song, err := parseInput(input, opts...)
 	if err != nil {
-		fmt.Printf("ERROR parsing file %q: %v\n", input, err)
-		os.Exit(-1)
+		if song == nil {
+			exitParseError(input, err)
+		}
+		printWarnings(input, err)
 	}
 	songBytes, err := psg.Export(song)
 	if err != nil {
 		fmt.Printf("ERROR exporting song: %v\n", err)
 		os.Exit(-1)
 	}
-	if err :=os.WriteFile(output, songBytes, 0644); err != nil {
+	if err := os.WriteFile(output, songBytes, 0644); err != nil {
 		fmt.Printf("ERROR writing file %q: %v\n", output, err)
 		os.Exit(-1)
 	}
 }
+
+// parseInput parses the song from the standard input if the input is "-", or from the
+// input file otherwise
+func parseInput(input string, opts ...lang.Option) (*song.Song, error) {
+	if input == "-" {
+		return lang.Parse(os.Stdin, opts...)
+	}
+	// included files are looked up relatively to the input file
+	fsys, name := lang.FileFS(input)
+	return lang.ParseFile(fsys, name, opts...)
+}
+
+// exitParseError prints all the errors that were found when parsing a file, and exits
+func exitParseError(input string, err error) {
+	if errs, ok := err.(lang.ErrorList); ok {
+		fmt.Printf("ERROR parsing file %q:\n", input)
+		for _, e := range errs {
+			fmt.Printf("  %v\n", e)
+		}
+	} else {
+		fmt.Printf("ERROR parsing file %q: %v\n", input, err)
+	}
+	os.Exit(-1)
+}
+
+// printWarnings prints the warnings that were found when parsing a file
+func printWarnings(input string, err error) {
+	fmt.Printf("WARNING parsing file %q:\n", input)
+	for _, e := range err.(lang.ErrorList) {
+		fmt.Printf("  %v\n", e)
+	}
+}
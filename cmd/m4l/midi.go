@@ -0,0 +1,75 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mariomac/msxmml/pkg/midi"
+)
+
+// channelFlags accumulates the -channel arguments as export options
+type channelFlags []midi.Option
+
+func (c *channelFlags) String() string {
+	return ""
+}
+
+// Set parses a channel assignment with the format name=channel:program (e.g. ch1=2:81)
+func (c *channelFlags) Set(value string) error {
+	var channel, program int
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected name=channel:program. Got %q", value)
+	}
+	if _, err := fmt.Sscanf(parts[1], "%d:%d", &channel, &program); err != nil {
+		return fmt.Errorf("expected name=channel:program. Got %q", value)
+	}
+	*c = append(*c, midi.WithChannel(strings.TrimPrefix(parts[0], "@"), channel, program))
+	return nil
+}
+
+// midiCmd compiles a song and exports it as a Standard MIDI File:
+// m4l midi [-cc7] [-channel name=channel:program]... -in song.m4l -out song.mid
+func midiCmd(args []string) {
+	flags := flag.NewFlagSet("midi", flag.ExitOnError)
+	var input, output string
+	var volumeCC bool
+	var channels channelFlags
+	flags.StringVar(&input, "in", "", "input file (- for standard input)")
+	flags.StringVar(&output, "out", "", "output MIDI file")
+	flags.BoolVar(&volumeCC, "cc7", false, "send the volumes as Volume (CC7) control changes instead of note velocities")
+	flags.Var(&channels, "channel", fmt.Sprintf(
+		"MIDI channel (1-16) and General MIDI program (1-128) of a song channel, as name=channel:program. "+
+			"Can be repeated. By default, the channels use the free MIDI channels with the program %d",
+		midi.DefaultProgram))
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s midi [-cc7] [-channel name=channel:program]... -in song.m4l -out song.mid\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if input == "" || output == "" {
+		flags.Usage()
+		os.Exit(0)
+	}
+
+	song, err := parseInput(input)
+	if err != nil {
+		exitParseError(input, err)
+	}
+	opts := []midi.Option(channels)
+	if volumeCC {
+		opts = append(opts, midi.WithVolumeCC())
+	}
+	midiBytes, err := midi.Export(song, opts...)
+	if err != nil {
+		fmt.Printf("ERROR exporting song: %v\n", err)
+		os.Exit(-1)
+	}
+	if err := os.WriteFile(output, midiBytes, 0644); err != nil {
+		fmt.Printf("ERROR writing file %q: %v\n", output, err)
+		os.Exit(-1)
+	}
+}
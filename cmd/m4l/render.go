@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mariomac/msxmml/pkg/psg"
+)
+
+// renderCmd compiles a song and renders it into a WAV file through an emulation of the PSG:
+// m4l render [-rate 44100] [-hz 60] [-loops 1] [-fade 0s] -in song.m4l -out song.wav
+func renderCmd(args []string) {
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	var input, output string
+	var rate, hz, loops int
+	var fade time.Duration
+	flags.StringVar(&input, "in", "", "input file (- for standard input)")
+	flags.StringVar(&output, "out", "", "output WAV file")
+	flags.IntVar(&rate, "rate", 44100, "sample rate, in Hz")
+	flags.IntVar(&hz, "hz", 0, "frame rate: 50 (PAL) or 60 (NTSC). Defaults to the psg.hz property of the song")
+	flags.IntVar(&loops, "loops", 1, "times that the loop of the song is played")
+	flags.DurationVar(&fade, "fade", 0, "duration of the fade out after the last loop (e.g. 5s)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(),
+			"Usage: %s render [-rate 44100] [-hz 60] [-loops 1] [-fade 0s] -in song.m4l -out song.wav\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if input == "" || output == "" {
+		flags.Usage()
+		os.Exit(0)
+	}
+	if err := checkRenderFlags(rate, hz, loops, fade); err != nil {
+		fmt.Printf("ERROR: %v\n", err)
+		flags.Usage()
+		os.Exit(-1)
+	}
+
+	song, err := parseInput(input)
+	if err != nil {
+		exitParseError(input, err)
+	}
+	if hz == 0 {
+		if hz, err = psg.FrameRate(song); err != nil {
+			fmt.Printf("ERROR exporting song: %v\n", err)
+			os.Exit(-1)
+		}
+	}
+	songBytes, err := psg.Export(song)
+	if err != nil {
+		fmt.Printf("ERROR exporting song: %v\n", err)
+		os.Exit(-1)
+	}
+	out, err := os.Create(output)
+	if err != nil {
+		fmt.Printf("ERROR writing file %q: %v\n", output, err)
+		os.Exit(-1)
+	}
+	defer out.Close()
+	bw := bufio.NewWriter(out)
+	err = psg.Render(bw, songBytes,
+		psg.WithSampleRate(rate), psg.WithFrameRate(hz), psg.WithLoops(loops), psg.WithFadeOut(fade))
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		fmt.Printf("ERROR writing file %q: %v\n", output, err)
+		os.Exit(-1)
+	}
+}
+
+func checkRenderFlags(rate, hz, loops int, fade time.Duration) error {
+	switch {
+	case rate <= 0:
+		return fmt.Errorf("-rate must be positive. Got %d", rate)
+	case hz < 0:
+		return fmt.Errorf("-hz can't be negative. Got %d", hz)
+	case loops < 1:
+		return fmt.Errorf("-loops must be at least 1. Got %d", loops)
+	case fade < 0:
+		return fmt.Errorf("-fade can't be negative. Got %v", fade)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/mariomac/msxmml/pkg/vgm"
+)
+
+// vgmCmd compiles a song and exports it as a VGM file, with the register writes of the PSG:
+// m4l vgm -in song.m4l -out song.vgm
+func vgmCmd(args []string) {
+	flags := flag.NewFlagSet("vgm", flag.ExitOnError)
+	var input, output string
+	flags.StringVar(&input, "in", "", "input file (- for standard input)")
+	flags.StringVar(&output, "out", "", "output VGM file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s vgm -in song.m4l -out song.vgm\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if input == "" || output == "" {
+		flags.Usage()
+		os.Exit(0)
+	}
+
+	song, err := parseInput(input)
+	if err != nil {
+		exitParseError(input, err)
+	}
+	vgmBytes, err := vgm.Export(song)
+	if err != nil {
+		fmt.Printf("ERROR exporting song: %v\n", err)
+		os.Exit(-1)
+	}
+	if err := os.WriteFile(output, vgmBytes, 0644); err != nil {
+		fmt.Printf("ERROR writing file %q: %v\n", output, err)
+		os.Exit(-1)
+	}
+}
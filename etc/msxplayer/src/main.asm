@@ -60,7 +60,19 @@ b000xxxxx:
         ; we set the envelope (a == 0) or wait some minutes
         cp 0
         jp nz, wait 
-set_envelope_cycle:   ; assuming a == 0
+set_envelope_cycle:   ; assuming a == 0. 00000000 hhhhhhhh llllllll
+        ld      hl, [music_ip]               ; read high byte of the cycle in e
+        ld      e, (hl)
+        inc     hl
+        ld      [music_ip], hl
+        ld      a, REG12_ENV_CYCLE_H
+        call    BIOS_WRTPSG
+        ld      hl, [music_ip]               ; read low byte of the cycle in e
+        ld      e, (hl)
+        inc     hl
+        ld      [music_ip], hl
+        ld      a, REG11_ENV_CYCLE_L
+        call    BIOS_WRTPSG
         jp parse_instruction
 b001xxxxx:
         bit 4, a
@@ -80,11 +92,19 @@ b01xxxxxx:
         bit 5, a
         jp nz, b011xxxxx
 set_noise_div_rate: ; 010xxxxx
+        and     0b00011111                   ; keep the noise period
+        ld      e, a
+        ld      a, REG6_NOISE_FREQ
+        call    BIOS_WRTPSG
         jp parse_instruction
 b011xxxxx:
         bit 4, a
         jp nz, set_tone_c
-envelope_wave_shape: ; 0110xxxx        
+envelope_wave_shape: ; 0110xxxx
+        and     0b00001111                   ; keep the wave shape
+        ld      e, a
+        ld      a, REG13_ENV_SHAPE
+        call    BIOS_WRTPSG
         jp parse_instruction
 b1xxxxxxx:
         bit 6, a
@@ -101,11 +121,19 @@ b110xxxxx:
         bit 4, a
         jp nz, set_volume_b      
 set_volume_a: ; 1100xxxx
-        jp parse_instruction          
+        and     0b00001111                   ; keep the volume, disabling the envelope
+        ld      e, a
+        ld      a, REG8_A_VOLUME
+        call    BIOS_WRTPSG
+        jp parse_instruction
 b111xxxxx:
         bit 4, a
         jp nz, b1111xxxx
-set_volume_c: ; 1110xxxx        
+set_volume_c: ; 1110xxxx
+        and     0b00001111
+        ld      e, a
+        ld      a, REG10_C_VOLUME
+        call    BIOS_WRTPSG
         jp parse_instruction
 b1111xxxx: 
         bit 3, a
@@ -117,6 +145,7 @@ b1111000x:
         bit 0, a
         jp nz, set_envelope_b
 set_envelope_a: ; 11110000
+        envelopeA
         jp parse_instruction
 wait:
         and 0b00011111                          ; remove instruction code and keep wait cycles
@@ -144,11 +173,17 @@ set_tone_c:
         ld      a, REG4_C_NOTE_L
         call    BIOS_WRTPSG
         jp parse_instruction
-set_volume_b:
+set_volume_b: ; 1101xxxx
+        and     0b00001111
+        ld      e, a
+        ld      a, REG9_B_VOLUME
+        call    BIOS_WRTPSG
+        jp parse_instruction
+set_envelope_c: ; 11110010
+        envelopeC
         jp parse_instruction
-set_envelope_c:
-        jp parse_instruction        
-set_envelope_b:
+set_envelope_b: ; 11110001
+        envelopeB
         jp parse_instruction
 end_song:
         ; check if the loop address is zero. If so, the song ends,
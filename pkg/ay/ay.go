@@ -0,0 +1,230 @@
+// Package ay emulates the sound output of the AY-3-8910 (and compatible YM2149) Programmable
+// Sound Generator, as found in the MSX computers
+package ay
+
+import "math"
+
+// MSXClock is the frequency of the PSG in the MSX computers, in Hz: half of the 3.579545 MHz
+// Z80 clock, rounded
+const MSXClock = 1789773
+
+// registers of the chip
+const (
+	regToneAL = iota
+	regToneAH
+	regToneBL
+	regToneBH
+	regToneCL
+	regToneCH
+	regNoise
+	regMixer
+	regVolumeA
+	regVolumeB
+	regVolumeC
+	regEnvelopeL
+	regEnvelopeH
+	regEnvelopeShape
+	registers
+)
+
+const (
+	channels = 3
+	// bit of the volume registers that makes the channel follow the envelope generator
+	envelopeVolume = 0b10000
+	// the chip generators are updated every 8 clock cycles
+	clockDivider = 8
+)
+
+// bits of the envelope shape register
+const (
+	shapeHold      = 0b0001
+	shapeAlternate = 0b0010
+	shapeAttack    = 0b0100
+	shapeContinue  = 0b1000
+)
+
+// levels of the 16 volumes. Each volume step changes the amplitude by 3 dB
+var levels = func() [16]float64 {
+	var lv [16]float64
+	for v := 1; v < len(lv); v++ {
+		lv[v] = math.Pow(2, float64(v-15)/2)
+	}
+	return lv
+}()
+
+// Chip is an AY-3-8910 that is written through its registers, and read as audio samples
+type Chip struct {
+	regs              [registers]uint8
+	clock, sampleRate int
+	// clock cycles that were not consumed by the previous sample, multiplied by the sample rate
+	cycles int
+
+	toneCounter [channels]int
+	toneOutput  [channels]bool
+
+	noiseCounter int
+	noiseHalf    bool
+	// 17-bit linear-feedback shift register
+	noiseShift  uint32
+	noiseOutput bool
+
+	envelopeCounter int
+	envelopeStep    int
+	envelopeAttack  bool
+	envelopeHolding bool
+	envelopeVolume  int
+}
+
+// New chip that runs at the given clock (in Hz) and returns the given samples per second
+func New(clock, sampleRate int) *Chip {
+	c := &Chip{clock: clock, sampleRate: sampleRate, noiseShift: 1}
+	// all the tones and noises are disabled at start
+	c.regs[regMixer] = 0b111111
+	c.restartEnvelope()
+	return c
+}
+
+// Write a value into a register. Writing the envelope shape restarts the envelope, even if the
+// shape didn't change
+func (c *Chip) Write(reg int, value uint8) {
+	if reg < 0 || reg >= registers {
+		return
+	}
+	c.regs[reg] = value
+	if reg == regEnvelopeShape {
+		c.restartEnvelope()
+	}
+}
+
+// Sample returns the next output sample, as the average output of the three channels between
+// the previous sample and this one. It ranges from 0 (silence) to 1
+func (c *Chip) Sample() float64 {
+	c.cycles += c.clock
+	period := c.sampleRate * clockDivider
+	sum, ticks := 0.0, 0
+	for c.cycles >= period {
+		c.cycles -= period
+		c.tick()
+		sum += c.output()
+		ticks++
+	}
+	if ticks == 0 {
+		// the sample rate is higher than the rate of the generators
+		return c.output()
+	}
+	return sum / float64(ticks)
+}
+
+// tick updates the tone, noise and envelope generators
+func (c *Chip) tick() {
+	for ch := 0; ch < channels; ch++ {
+		c.toneCounter[ch]++
+		// each period is the half of the square wave
+		if c.toneCounter[ch] >= c.tonePeriod(ch) {
+			c.toneCounter[ch] = 0
+			c.toneOutput[ch] = !c.toneOutput[ch]
+		}
+	}
+	// the noise generator runs at half of the rate of the tone generators
+	c.noiseHalf = !c.noiseHalf
+	if c.noiseHalf {
+		c.noiseCounter++
+		if c.noiseCounter >= nonZero(int(c.regs[regNoise]&0b11111)) {
+			c.noiseCounter = 0
+			bit := (c.noiseShift ^ (c.noiseShift >> 3)) & 1
+			c.noiseShift = c.noiseShift>>1 | bit<<16
+			c.noiseOutput = c.noiseShift&1 == 1
+		}
+	}
+	// each envelope step lasts 16 clock cycles per envelope period unit
+	c.envelopeCounter++
+	if c.envelopeCounter >= 2*c.envelopePeriod() {
+		c.envelopeCounter = 0
+		c.stepEnvelope()
+	}
+}
+
+func (c *Chip) tonePeriod(ch int) int {
+	period := int(c.regs[regToneAH+2*ch]&0b1111)<<8 | int(c.regs[regToneAL+2*ch])
+	return nonZero(period)
+}
+
+func (c *Chip) envelopePeriod() int {
+	return nonZero(int(c.regs[regEnvelopeH])<<8 | int(c.regs[regEnvelopeL]))
+}
+
+// output of the mixed channels, from 0 to 1
+func (c *Chip) output() float64 {
+	out := 0.0
+	mixer := c.regs[regMixer]
+	for ch := 0; ch < channels; ch++ {
+		// a disabled tone or noise leaves the output high
+		tone := c.toneOutput[ch] || mixer&(1<<ch) != 0
+		noise := c.noiseOutput || mixer&(0b1000<<ch) != 0
+		if !tone || !noise {
+			continue
+		}
+		volume := int(c.regs[regVolumeA+ch] & 0b1111)
+		if c.regs[regVolumeA+ch]&envelopeVolume != 0 {
+			volume = c.envelopeVolume
+		}
+		out += levels[volume]
+	}
+	return out / channels
+}
+
+func (c *Chip) restartEnvelope() {
+	c.envelopeCounter = 0
+	c.envelopeStep = 0
+	c.envelopeHolding = false
+	c.envelopeAttack = c.regs[regEnvelopeShape]&shapeAttack != 0
+	c.updateEnvelopeVolume()
+}
+
+// stepEnvelope advances the envelope one of the 16 steps of its cycle. At the end of the cycle,
+// the envelope is repeated, alternated or held, according to its shape
+func (c *Chip) stepEnvelope() {
+	if c.envelopeHolding {
+		return
+	}
+	c.envelopeStep++
+	if c.envelopeStep < len(levels) {
+		c.updateEnvelopeVolume()
+		return
+	}
+	shape := c.regs[regEnvelopeShape]
+	switch {
+	case shape&shapeContinue == 0:
+		c.envelopeHolding = true
+		c.envelopeVolume = 0
+	case shape&shapeHold != 0:
+		c.envelopeHolding = true
+		if c.envelopeAttack != (shape&shapeAlternate != 0) {
+			c.envelopeVolume = len(levels) - 1
+		} else {
+			c.envelopeVolume = 0
+		}
+	default:
+		if shape&shapeAlternate != 0 {
+			c.envelopeAttack = !c.envelopeAttack
+		}
+		c.envelopeStep = 0
+		c.updateEnvelopeVolume()
+	}
+}
+
+func (c *Chip) updateEnvelopeVolume() {
+	if c.envelopeAttack {
+		c.envelopeVolume = c.envelopeStep
+	} else {
+		c.envelopeVolume = len(levels) - 1 - c.envelopeStep
+	}
+}
+
+// nonZero returns the period, or 1 if the period is zero, as the chip does
+func nonZero(period int) int {
+	if period == 0 {
+		return 1
+	}
+	return period
+}
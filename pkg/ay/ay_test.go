@@ -0,0 +1,109 @@
+package ay
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTone(t *testing.T) {
+	// one sample for each update of the generators
+	const sampleRate = 100000
+	chip := New(sampleRate*clockDivider, sampleRate)
+	chip.Write(regToneBL, 100) // 800000 / (16 * 100) = 500 Hz
+	chip.Write(regMixer, 0b111101)
+	chip.Write(regVolumeB, 15)
+	raises := 0
+	last := chip.Sample()
+	for i := 1; i < sampleRate; i++ {
+		sample := chip.Sample()
+		if sample > last {
+			raises++
+		}
+		last = sample
+	}
+	assert.Equal(t, 500, raises)
+}
+
+func TestVolume(t *testing.T) {
+	assert.Equal(t, 0.0, levels[0])
+	assert.Equal(t, 1.0, levels[15])
+	for v := 2; v < len(levels); v++ {
+		assert.InDelta(t, 1.41421, levels[v]/levels[v-1], 1e-5)
+	}
+	// disabled tone and noise leave the output at the volume level
+	chip := New(MSXClock, 44100)
+	chip.Write(regVolumeA, 13)
+	chip.Write(regVolumeC, 15)
+	assert.InDelta(t, (levels[13]+levels[15])/3, chip.Sample(), 1e-9)
+}
+
+func TestNoise(t *testing.T) {
+	chip := New(MSXClock, 44100)
+	chip.Write(regNoise, 1)
+	chip.Write(regMixer, 0b110111)
+	chip.Write(regVolumeA, 15)
+	values := map[float64]bool{}
+	for i := 0; i < 1000; i++ {
+		// compare the outputs of each generator update, without averaging
+		chip.tick()
+		values[chip.output()] = true
+	}
+	assert.Equal(t, map[float64]bool{0: true, 1.0 / 3: true}, values)
+}
+
+func TestEnvelopeShapes(t *testing.T) {
+	var decay, attack, low, high []int
+	for step := 0; step < 16; step++ {
+		decay = append(decay, 15-step)
+		attack = append(attack, step)
+		low = append(low, 0)
+		high = append(high, 15)
+	}
+	cycles := func(c ...[]int) []int {
+		var all []int
+		for _, cycle := range c {
+			all = append(all, cycle...)
+		}
+		return all
+	}
+	expected := map[uint8][]int{
+		0b1000: cycles(decay, decay, decay),
+		0b1001: cycles(decay, low, low),
+		0b1010: cycles(decay, attack, decay),
+		0b1011: cycles(decay, high, high),
+		0b1100: cycles(attack, attack, attack),
+		0b1101: cycles(attack, high, high),
+		0b1110: cycles(attack, decay, attack),
+		0b1111: cycles(attack, low, low),
+	}
+	// without the continue bit, the envelope holds the lowest volume after the first cycle
+	for shape := uint8(0); shape < 0b100; shape++ {
+		expected[shape] = cycles(decay, low, low)
+		expected[shape|0b100] = cycles(attack, low, low)
+	}
+	for shape, volumes := range expected {
+		chip := New(MSXClock, 44100)
+		chip.Write(regEnvelopeShape, shape)
+		var actual []int
+		for i := 0; i < len(volumes); i++ {
+			actual = append(actual, chip.envelopeVolume)
+			chip.stepEnvelope()
+		}
+		assert.Equalf(t, volumes, actual, "shape %04b", shape)
+	}
+}
+
+func TestEnvelopeRestart(t *testing.T) {
+	chip := New(MSXClock, 44100)
+	chip.Write(regEnvelopeL, 1)
+	chip.Write(regEnvelopeShape, 0b1101)
+	// each step lasts 2 updates of the generators
+	for i := 0; i < 10; i++ {
+		chip.tick()
+	}
+	assert.Equal(t, 5, chip.envelopeVolume)
+	// writing the same shape restarts the envelope
+	chip.Write(regEnvelopeShape, 0b1101)
+	assert.Equal(t, 0, chip.envelopeVolume)
+}
@@ -1,8 +1,13 @@
 package lang
 
 import (
+	"bufio"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/mariomac/msxmml/pkg/song"
 )
@@ -13,29 +18,136 @@ const (
 	maxOctave     = 8
 	minLength     = 1
 	maxLength     = 64
-	defaultLength = 4
-	maxVolume     = 15
+	// each dot doubles the denominator of the exact duration of a note, so they are limited
+	// to keep the durations of the song in the range of the fractions
+	maxDots        = 8
+	defaultLength  = 4
+	maxVolume      = 15
+	maxNoisePeriod = 31
+	minTempo       = 1
+	maxTempo       = 999
+	minTupletNotes = 2
+	maxTupletNotes = 64
+	// nested tuplets multiply their ratios (e.g. a triplet inside a triplet is a 9:4 tuplet),
+	// so the resulting ratios are limited
+	maxNestedTupletNotes = 1 << 20
+	// times that a repeat is played if no number is specified after the closing bracket
+	defaultRepeatTimes = 2
+	// the repeats are expanded when the song is played, so their times are limited
+	maxRepeatTimes = 99
 )
 
 func (p *Parser) eofErr() error {
-	return UnexpecedEofError{Row: p.t.row, Col: p.t.col}
+	file, row, col := p.t.pos()
+	return UnexpecedEofError{File: file, Row: row, Col: col}
 }
 
 type Parser struct {
-	t *Tokenizer
+	t tokenSource
+	// file system where the included files are looked up
+	fs fs.FS
+	// stack of the files that are being parsed. The last one is the current file
+	files []string
+	// default length for the notes of the tablature that is currently parsed
+	length noteLength
+	// default length of each channel, kept between channel statements
+	channelLengths map[string]noteLength
+	// key signature for the tablature that is currently parsed
+	key song.KeySignature
+	// key signature of the song header, which is taken by the constants and by the channels at
+	// their start
+	songKey song.KeySignature
+	// key signature of each channel, kept between channel statements
+	channelKeys map[string]song.KeySignature
+	// tokens of the tablature constants. They are parsed lazily, as they can refer to other
+	// constants that are defined later. They are resolved by the first channel statement that
+	// uses them, so all the constants that it refers must be already defined
+	constants map[string][]Token
+	// definition tokens of the tablature constants, in definition order
+	constantDefs []Token
+	// chain of the constants that are being currently resolved, to detect reference cycles
+	resolving []string
+	// octave at the start of the tablature that is currently parsed. Nil if it is unknown
+	// (e.g. in constant definitions)
+	octave *int
+	// octave of each channel, kept between channel statements
+	channelOctaves map[string]int
+	// errors found during the parsing
+	errors ErrorList
+	// if true, the length of the bars is verified against the time signature of the song
+	checkBars bool
+}
+
+// Option modifies the behavior of the parser
+type Option func(p *Parser)
+
+// WithBarCheck verifies that, if the song has a time signature (e.g. timesig 3/4 header
+// property), each bar between two bar lines of every channel lasts exactly one measure.
+// The wrong bars are reported as warnings: if the song has no errors, it is returned along
+// with an ErrorList that only contains warnings.
+func WithBarCheck() Option {
+	return func(p *Parser) {
+		p.checkBars = true
+	}
+}
+
+// noteLength is the length of the notes that don't explicitly specify it
+type noteLength struct {
+	length int
+	dots   int
+}
+
+// Parse a song from the provided reader. Included files are looked up from the
+// current working directory.
+func Parse(reader io.Reader, opts ...Option) (*song.Song, error) {
+	return parse(reader, os.DirFS("."), "", opts)
+}
+
+// ParseFile parses the song that is stored in the provided file. Included files are looked up
+// relatively to the file that includes them.
+func ParseFile(fsys fs.FS, name string, opts ...Option) (*song.Song, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parse(f, fsys, name, opts)
+}
+
+// ParseSource parses a song whose source is provided by the reader, as if it was stored in the
+// given file (e.g. the unsaved contents of a file in an editor). Included files are looked up
+// relatively to it.
+func ParseSource(fsys fs.FS, name string, reader io.Reader, opts ...Option) (*song.Song, error) {
+	return parse(reader, fsys, name, opts)
 }
 
 // Convention: tokenizer always receives a tokenizer with a token available, excepting the Root
 // program := constantDef* statement* ('loop:' statement*)?
-func Parse(reader io.ReadSeeker) (*song.Song, error) {
-	props, lines, err := parseHeader(reader)
+func parse(reader io.Reader, fsys fs.FS, name string, opts []Option) (*song.Song, error) {
+	input := bufio.NewReader(reader)
+	props, lines, firstLine, err := parseHeader(input)
 	if err != nil {
 		return nil, err
 	}
 
-	t := NewTokenizer(reader, lines)
+	t := newBodyTokenizer(input, firstLine, lines)
+	t.file = name
 	p := &Parser{
-		t: t,
+		t:              t,
+		fs:             fsys,
+		files:          []string{name},
+		channelLengths: map[string]noteLength{},
+		channelKeys:    map[string]song.KeySignature{},
+		channelOctaves: map[string]int{},
+		constants:      map[string][]Token{},
+	}
+	if key, ok := props[song.KeySignatureKey]; ok {
+		if p.songKey, err = song.ParseKeySignature(key); err != nil {
+			p.addError(fmt.Errorf("%q header property: %w", song.KeySignatureKey, err))
+		}
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
 	s := &song.Song{
 		Properties:   props,
@@ -44,64 +156,190 @@ func Parse(reader io.ReadSeeker) (*song.Song, error) {
 		LoopIndex:    -1,
 	}
 
-	if err := parseBody(s, p); err != nil {
-		return nil, err
+	parseBody(s, p)
+	if err := t.Err(); err != nil {
+		p.addError(err)
+	}
+	// resolving the constants that haven't been used by any channel
+	for _, def := range p.constantDefs {
+		if _, err := p.resolveConstant(s, def.getConstDefId(), def); err != nil {
+			p.addError(err)
+		}
+	}
+	if !p.errors.HasErrors() {
+		p.errors = append(p.errors, checkTiming(s)...)
+	}
+	if ts, ok := s.Properties[song.TimeSignatureKey]; ok {
+		timesig, err := song.ParseTimeSignature(ts)
+		if err != nil {
+			p.addError(fmt.Errorf("%q header property: %w", song.TimeSignatureKey, err))
+		} else if p.checkBars && !p.errors.HasErrors() {
+			p.errors = append(p.errors, checkBars(s, timesig)...)
+		}
+	}
+	if p.errors.HasErrors() {
+		return nil, p.errors
+	}
+	if len(p.errors) > 0 {
+		// only warnings
+		return s, p.errors
 	}
 	return s, nil
 }
 
-func parseBody(s *song.Song, p *Parser) error {
+func parseBody(s *song.Song, p *Parser) {
 	s.AddSyncedBlock()
 	p.t.Next()
+	p.statements(s)
+}
+
+// statements parses all the statements until the end of the tokens. When a statement is wrong,
+// its error is recorded and the parsing continues from the start of the next statement
+func (p *Parser) statements(s *song.Song) {
 	for !p.t.EOF() {
 		token := p.t.Get()
+		var err error
 		switch token.Type {
 		case ConstDef:
-			if err := p.constantDefNode(s); err != nil {
-				return err
-			}
+			err = p.constantDefNode(s)
 		case LoopTag:
-			if err := p.loopNode(s); err != nil {
-				return err
-			}
+			err = p.loopNode(s)
 		case ChannelSync:
 			s.AddSyncedBlock()
 			p.t.Next()
 		case ChannelId:
-			if err := p.channelFillNode(s); err != nil {
-				return err
-			}
+			err = p.channelFillNode(s)
+		case Include:
+			err = p.includeNode(s)
 		default:
-			return SyntaxError{t: token}
+			err = SyntaxError{t: token}
 		}
+		if err != nil {
+			p.addError(err)
+			p.skipStatement(token)
+		}
+	}
+}
+
+func (p *Parser) addError(err error) {
+	p.errors = append(p.errors, newDiagnostic(err))
+}
+
+// skipStatement discards the rest of the tokens of a wrong statement, given its first token.
+func (p *Parser) skipStatement(start Token) {
+	// the wrong statement is discarded at least by its first token, to avoid parsing it forever
+	if cur := p.t.Get(); !p.t.EOF() && cur.position() == start.position() {
+		p.t.Next()
+	}
+	for !p.t.EOF() {
+		switch p.t.Get().Type {
+		case ConstDef, LoopTag, ChannelSync, ChannelId, Include:
+			return
+		}
+		p.t.Next()
+	}
+}
+
+// include := 'include' '"' PATH '"'
+// The statements of the included file are parsed as if they were in the including file.
+// Header properties of the included file are added to the song, unless they are already defined.
+func (p *Parser) includeNode(s *song.Song) error {
+	tok := p.t.Get()
+	// the parent directories are resolved here, since the file system only accepts the paths
+	// that don't go out of its root
+	name := path.Join(path.Dir(p.files[len(p.files)-1]), tok.getIncludePath())
+	if !fs.ValidPath(name) {
+		return ParserError{t: tok, msg: fmt.Sprintf(
+			"can't include file %q: it is out of the root directory of the song files",
+			tok.getIncludePath())}
+	}
+	for _, f := range p.files {
+		if f == name {
+			return ParserError{t: tok,
+				msg: fmt.Sprintf("include cycle: %s -> %s", strings.Join(p.files, " -> "), name)}
+		}
+	}
+	f, err := p.fs.Open(name)
+	if err != nil {
+		return ParserError{t: tok, msg: fmt.Sprintf("can't include file: %v", err)}
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	props, lines, firstLine, err := parseHeader(reader)
+	if err != nil {
+		return ParserError{t: tok, msg: fmt.Sprintf("can't read header from %q: %v", name, err)}
+	}
+	for k, v := range props {
+		if _, ok := s.Properties[k]; !ok {
+			s.Properties[k] = v
+		}
+	}
+
+	t := newBodyTokenizer(reader, firstLine, lines)
+	t.file = name
+	src := p.t
+	p.t = t
+	p.files = append(p.files, name)
+	p.t.Next()
+	p.statements(s)
+	p.t = src
+	p.files = p.files[:len(p.files)-1]
+	p.t.Next()
+	if err := t.Err(); err != nil {
+		return ParserError{t: tok, msg: fmt.Sprintf("can't include file %q: %v", name, err)}
 	}
 	return nil
 }
 
 // constantDef := ID ':=' (instrumentDef | tablature+)
 func (p *Parser) constantDefNode(s *song.Song) error {
-	tok := p.t.Get()
-	id := tok.getConstDefId()
+	def := p.t.Get()
+	id := def.getConstDefId()
 	if _, ok := s.Constants[id]; ok {
-		return RedefinitionError{tok}
+		return RedefinitionError{def}
+	}
+	if _, ok := p.constants[id]; ok {
+		return RedefinitionError{def}
 	}
+	err := p.constantBodyNode(s, def)
+	if err != nil {
+		// an empty definition avoids reporting the references to the wrong constant as undefined
+		p.constants[id] = nil
+	}
+	return err
+}
+
+// constantBody := instrumentDef | tablature+
+func (p *Parser) constantBodyNode(s *song.Song, def Token) error {
+	id := def.getConstDefId()
 	if !p.t.Next() {
 		return p.eofErr()
 	}
-	tok = p.t.Get()
+	tok := p.t.Get()
 	switch tok.Type {
 	case OpenInstrument:
-		inst, err := p.instrumentDefinitionNode(tok.getInstrumentClass())
+		inst, err := p.instrumentDefinitionNode(tok)
 		if err != nil {
 			return err
 		}
-		s.Constants[id] = song.Tablature{{Instrument: &inst}}
+		s.Constants[id] = song.Tablature{{Instrument: &inst, Source: &song.Source{Position: tok.position()}}}
 	default:
-		tabl, err := p.tablatureNode(s, false)
+		// the tablature is parsed to check its syntax, but its tokens are recorded to be parsed
+		// again when the constant is resolved
+		rec := &tokenRecorder{tokenSource: p.t, tokens: []Token{tok}}
+		p.t = rec
+		p.length, p.key = noteLength{length: defaultLength}, p.songKey
+		_, err := p.tablatureNode(s, false)
+		p.t = rec.tokenSource
 		if err != nil {
 			return err
 		}
-		s.Constants[id] = tabl
+		if !p.t.EOF() {
+			// removing the token that finished the tablature
+			rec.tokens = rec.tokens[:len(rec.tokens)-1]
+		}
+		p.constants[id] = rec.tokens
+		p.constantDefs = append(p.constantDefs, def)
 	}
 	// not running p.t.Next as it was the last statement in both instrument and tablature nodes
 	return nil
@@ -118,10 +356,11 @@ func (p *Parser) loopNode(s *song.Song) error {
 }
 
 // instrumentDef := class '{' mapEntry* ('adsr:' adsrVector)? mapEntry* '}'
-func (p *Parser) instrumentDefinitionNode(class string) (song.Instrument, error) {
+func (p *Parser) instrumentDefinitionNode(tok Token) (song.Instrument, error) {
 	inst := song.Instrument{
-		Class:      class,
+		Class:      tok.getInstrumentClass(),
 		Properties: map[string]string{},
+		Position:   tok.position(),
 	}
 	if !p.t.Next() {
 		return inst, p.eofErr()
@@ -143,37 +382,150 @@ func (p *Parser) instrumentDefinitionNode(class string) (song.Instrument, error)
 	return inst, nil
 }
 
-// tablature := (ID | NOTE | SILENCE | OCTAVE | INCOCT | DECOCT | tuplet | '|')+
-func (p *Parser) tablatureNode(s *song.Song, allowConstants bool) (song.Tablature, error) {
+// resolveConstant returns the expanded items of the constant, parsing it if it hasn't
+// been previously resolved. The ref token is used to report errors
+func (p *Parser) resolveConstant(s *song.Song, id string, ref Token) (song.Tablature, error) {
+	if items, ok := s.Constants[id]; ok {
+		return items, nil
+	}
+	chain := func() string {
+		sb := strings.Builder{}
+		for _, r := range append(p.resolving, id) {
+			if sb.Len() > 0 {
+				sb.WriteString(" -> ")
+			}
+			sb.WriteString("$" + r)
+		}
+		return sb.String()
+	}
+	tokens, ok := p.constants[id]
+	if !ok {
+		if len(p.resolving) == 0 {
+			return nil, ParserError{t: ref, msg: fmt.Sprintf("constant %q not defined", id)}
+		}
+		return nil, ParserError{t: ref,
+			msg: fmt.Sprintf("constant %q not defined (%s)", id, chain())}
+	}
+	for _, r := range p.resolving {
+		if r == id {
+			return nil, ParserError{t: ref, msg: "constant reference cycle: " + chain()}
+		}
+	}
+
+	p.resolving = append(p.resolving, id)
+	src, length, key, octave := p.t, p.length, p.key, p.octave
+	p.t = newTokenReplay(tokens)
+	p.t.Next()
+	p.length, p.key, p.octave = noteLength{length: defaultLength}, p.songKey, nil
+	items, err := p.tablatureNode(s, true)
+	p.t, p.length, p.key, p.octave = src, length, key, octave
+	p.resolving = p.resolving[:len(p.resolving)-1]
+	if err != nil {
+		// the wrong constant is not resolved again, to report its errors only once
+		s.Constants[id] = song.Tablature{}
+		return nil, err
+	}
+	s.Constants[id] = items
+	return items, nil
+}
+
+// tablature := (ID | NOTE | SILENCE | NOISE | TEMPO | LENGTH | KEY | OCTAVE | INCOCT | DECOCT | tuplet | repeat | tie | '|')+
+// If expandConstants is false, the constant references are ignored. It is used to check the syntax
+// of the constant definitions before they are resolved
+func (p *Parser) tablatureNode(s *song.Song, expandConstants bool) (song.Tablature, error) {
 	t := song.Tablature{}
+	// not nil if the last note is tied to the next one
+	var tie *Token
 	for !p.t.EOF() {
 		tok := p.t.Get()
+		// items that are added by the current token
+		added := len(t)
+		if tie != nil && tok.Type != Note && tok.Type != Separator {
+			return nil, ParserError{t: tok, msg: "expecting a note after the tie"}
+		}
 		switch tok.Type {
 		case ConstRef:
-			if !allowConstants {
-				return nil, ParserError{t: tok, msg: "can't refer constants inside constants"}
-			}
-			id := tok.getConstRefId()
-			if items, ok := s.Constants[id]; !ok {
-				return nil, ParserError{t: tok, msg: fmt.Sprintf("constant %q not defined", id)}
-			} else { // expand constant as notes
-				t = append(t, items...)
+			if expandConstants {
+				items, err := p.resolveConstant(s, tok.getConstRefId(), tok)
+				if err != nil {
+					return nil, err
+				}
+				if items, err = p.parametrizeConstant(items, tok, t); err != nil {
+					return nil, err
+				}
+				// expand constant as notes
+				t = append(t, expandSources(items, tok.getConstRefId(), tok.position())...)
 			}
 		case Note:
-			if n, err := tok.getNote(); err != nil {
-				return nil, err
+			n, err := tok.getNote(p.length, p.key)
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
+			if tie != nil {
+				// tie := NOTE '&' NOTE, both with the same pitch. They can be separated by bar lines
+				bars := 0
+				for t[len(t)-1-bars].Bar {
+					bars++
+				}
+				last := t[len(t)-1-bars].Note
+				if last.Pitch != n.Pitch || last.Halftone != n.Halftone {
+					return nil, ParserError{t: tok, msg: "can't tie notes with different pitches"}
+				}
+				tieLast(t[:len(t)-bars], song.Tie{Length: n.Length, Dots: n.Dots, Bar: bars > 0})
+				tie = nil
 			} else {
 				t = append(t, song.TablatureItem{Note: &n})
 			}
+		case Tie:
+			if len(t) == 0 || t[len(t)-1].Note == nil {
+				return nil, ParserError{t: tok, msg: "a tie must follow a note"}
+			}
+			tie = &tok
+		case TieLength:
+			// tie := NOTE '^' LENGTH
+			tl, err := tok.getTieLength()
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
+			if !tieLast(t, tl) {
+				return nil, ParserError{t: tok, msg: "a tie must follow a note"}
+			}
 		case Volume:
-			n := tok.getVolume()
-			if n > maxVolume {
-				return t, ParserError{t: tok, msg: fmt.Sprintf("max volume is 16 (was: %d)", n)}
+			n, err := tok.getVolume()
+			if err != nil {
+				return t, ParserError{t: tok, msg: err.Error()}
 			}
 			t = append(t, song.TablatureItem{Volume: &n})
 		case Silence:
-			n := tok.getSilence()
+			n, err := tok.getSilence(p.length)
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
 			t = append(t, song.TablatureItem{Silence: &n})
+		case Noise:
+			if n, err := tok.getNoise(p.length); err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			} else {
+				t = append(t, song.TablatureItem{Noise: &n})
+			}
+		case DefaultLength:
+			l, err := tok.getDefaultLength()
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
+			p.length = l
+		case Key:
+			k, err := tok.getKey()
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
+			p.key = k
+		case Tempo:
+			bpm, err := tok.getTempo()
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
+			t = append(t, song.TablatureItem{Tempo: &bpm})
 		case Octave:
 			o := tok.getOctave()
 			t = append(t, song.TablatureItem{SetOctave: &o})
@@ -186,18 +538,119 @@ func (p *Parser) tablatureNode(s *song.Song, allowConstants bool) (song.Tablatur
 			} else {
 				t = append(t, tu...)
 			}
+		case OpenRepeat:
+			if rp, err := p.repeatNode(s, expandConstants); err != nil {
+				return nil, err
+			} else {
+				t = append(t, song.TablatureItem{Repeat: &rp})
+			}
 		case Separator:
-		// just ignore
+			t = append(t, song.TablatureItem{Bar: true})
 		default:
 			// end of tablature, return
 			return t, nil
 		}
+		setSources(t[added:], tok)
 		p.t.Next()
 	}
+	if tie != nil {
+		return nil, p.eofErr()
+	}
 	return t, nil
 }
 
-// tuplet := '(' (NOTE|OCTAVE|INCOCT|DECOCT) + ')' NUM
+// repeat := '[' tablature ('|' NUM tablature)* ']' NUM?
+func (p *Parser) repeatNode(s *song.Song, expandConstants bool) (song.Repeat, error) {
+	open := p.t.Get()
+	rp := song.Repeat{}
+	// octave inside the repeat depends on the iteration
+	octave := p.octave
+	p.octave = nil
+	defer func() { p.octave = octave }()
+	if !p.t.Next() {
+		return rp, p.eofErr()
+	}
+	items, err := p.tablatureNode(s, expandConstants)
+	if err != nil {
+		return rp, err
+	}
+	rp.Items = items
+	for !p.t.EOF() {
+		tok := p.t.Get()
+		switch tok.Type {
+		case RepeatEnding:
+			if tok.getRepeatEnding() != len(rp.Endings)+1 {
+				return rp, ParserError{t: tok,
+					msg: fmt.Sprintf("expected ending number %d", len(rp.Endings)+1)}
+			}
+			if !p.t.Next() {
+				return rp, p.eofErr()
+			}
+			ending, err := p.tablatureNode(s, expandConstants)
+			if err != nil {
+				return rp, err
+			}
+			rp.Endings = append(rp.Endings, ending)
+		case CloseRepeat:
+			if rp.Times, err = tok.getRepeatTimes(); err != nil {
+				return rp, ParserError{t: tok, msg: err.Error()}
+			}
+			if len(rp.Endings) > rp.Times {
+				return rp, ParserError{t: tok,
+					msg: fmt.Sprintf("repeat has %d endings but it is played only %d times",
+						len(rp.Endings), rp.Times)}
+			}
+			// not advancing the tokenizer: the invoking tablature will do it
+			return rp, nil
+		default:
+			return rp, ParserError{t: open, msg: "unclosed repeat"}
+		}
+	}
+	return rp, p.eofErr()
+}
+
+// parametrizeConstant applies the start octave and transposition of a constant reference
+// (e.g. $riff(o5,+7)) to the expanded items of the constant. The tablature is the part of the
+// current tablature that precedes the reference.
+func (p *Parser) parametrizeConstant(items song.Tablature, ref Token, t song.Tablature) (song.Tablature, error) {
+	octave, semitones, err := ref.getConstRefParams()
+	if err != nil {
+		return nil, ParserError{t: ref, msg: err.Error()}
+	}
+	if octave == nil && semitones == 0 {
+		return items, nil
+	}
+	items = transpose(items, semitones)
+	start := octave
+	if octave != nil {
+		items = append(song.Tablature{{SetOctave: octave}}, items...)
+	} else if p.octave != nil {
+		o := octaveAfter(t, *p.octave)
+		start = &o
+	}
+	// if the octave of the reference is unknown, we can't verify the range of the notes
+	if start != nil {
+		if err := checkOctaveRange(items, *start); err != nil {
+			return nil, ParserError{t: ref, msg: err.Error()}
+		}
+	}
+	return items, nil
+}
+
+// tieLast adds the ties to the last item of the tablature, if it is a note.
+// Returns false if the last item is not a note.
+func tieLast(t song.Tablature, ties ...song.Tie) bool {
+	if len(t) == 0 || t[len(t)-1].Note == nil {
+		return false
+	}
+	// copying the note, as it could be shared with a constant definition
+	n := *t[len(t)-1].Note
+	n.Ties = append(append([]song.Tie{}, n.Ties...), ties...)
+	t[len(t)-1].Note = &n
+	return true
+}
+
+// tuplet := '(' (NOTE|SILENCE|NOISE|VOLUME|OCTAVE|INCOCT|DECOCT|tuplet)+ ')' NUM (':' NUM)?
 func (p *Parser) tupletNode() (song.Tablature, error) {
 	if !p.t.Next() {
 		return nil, p.eofErr()
@@ -205,33 +658,67 @@ func (p *Parser) tupletNode() (song.Tablature, error) {
 	t := song.Tablature{}
 	for !p.t.EOF() {
 		tok := p.t.Get()
+		added := len(t)
 		switch tok.Type {
 		case Note:
-			if n, err := tok.getNote(); err != nil {
-				return nil, err
+			if n, err := tok.getNote(p.length, p.key); err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
 			} else {
 				t = append(t, song.TablatureItem{Note: &n})
 			}
 		case Volume:
-			n := tok.getVolume()
-			if n > maxVolume {
-				return t, ParserError{t: tok, msg: fmt.Sprintf("max volume is 16 (was: %d)", n)}
+			n, err := tok.getVolume()
+			if err != nil {
+				return t, ParserError{t: tok, msg: err.Error()}
 			}
 			t = append(t, song.TablatureItem{Volume: &n})
 		case Silence:
-			n := tok.getSilence()
+			n, err := tok.getSilence(p.length)
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
 			t = append(t, song.TablatureItem{Silence: &n})
+		case Noise:
+			if n, err := tok.getNoise(p.length); err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			} else {
+				t = append(t, song.TablatureItem{Noise: &n})
+			}
 		case Octave:
 			o := tok.getOctave()
 			t = append(t, song.TablatureItem{SetOctave: &o})
 		case OctaveStep:
 			o := tok.getOctaveStep()
 			t = append(t, song.TablatureItem{OctaveStep: &o})
+		case OpenTuple:
+			// nested tuplet
+			tu, err := p.tupletNode()
+			if err != nil {
+				return nil, err
+			}
+			t = append(t, tu...)
 		case CloseTuple:
-			tn := tok.getTupletNumber()
+			tuplet, err := tok.getTuplet()
+			if err != nil {
+				return nil, ParserError{t: tok, msg: err.Error()}
+			}
 			for n := range t {
-				if t[n].Note != nil {
-					t[n].Note.Tuplet = tn
+				var item *song.Tuplet
+				switch {
+				case t[n].Note != nil:
+					item = &t[n].Note.Tuplet
+				case t[n].Silence != nil:
+					item = &t[n].Silence.Tuplet
+				case t[n].Noise != nil:
+					item = &t[n].Noise.Tuplet
+				default:
+					continue
+				}
+				if *item = item.Within(tuplet); item.Notes > maxNestedTupletNotes ||
+					item.Span > maxNestedTupletNotes {
+					return nil, ParserError{t: tok, msg: fmt.Sprintf(
+						"nested tuplets play %d notes in the time of %d. Must be at most %d notes",
+						item.Notes, item.Span, maxNestedTupletNotes)}
 				}
 			}
 			return t, nil
@@ -245,30 +732,78 @@ func (p *Parser) tupletNode() (song.Tablature, error) {
 			}
 			return nil, SyntaxError{tok}
 		}
+		setSources(t[added:], tok)
 		p.t.Next()
 	}
 	return nil, p.eofErr()
 }
 
+// setSources sets the token position as the source of the items that don't have it
+func setSources(items song.Tablature, tok Token) {
+	for i := range items {
+		if items[i].Source == nil {
+			items[i].Source = &song.Source{Position: tok.position()}
+		}
+	}
+}
+
+// expandSources returns a copy of the items of a constant, where the sources of the items
+// also refer to the position where the constant is referenced
+func expandSources(items song.Tablature, constant string, at song.Position) song.Tablature {
+	expanded := make(song.Tablature, 0, len(items))
+	for _, ti := range items {
+		if ti.Source != nil {
+			ti.Source = ti.Source.Expanded(constant, at)
+		}
+		if ti.Repeat != nil {
+			rp := *ti.Repeat
+			rp.Items = expandSources(rp.Items, constant, at)
+			rp.Endings = make([]song.Tablature, 0, len(ti.Repeat.Endings))
+			for _, e := range ti.Repeat.Endings {
+				rp.Endings = append(rp.Endings, expandSources(e, constant, at))
+			}
+			ti.Repeat = &rp
+		}
+		expanded = append(expanded, ti)
+	}
+	return expanded
+}
+
 func (p *Parser) channelFillNode(s *song.Song) error {
-	tok := p.t.Get()
-	channelId := tok.getChannelId()
+	statement := p.t.Get()
+	channelId := statement.getChannelId()
 	if !p.t.Next() {
 		return p.eofErr()
 	}
-	tok = p.t.Get()
+	tok := p.t.Get()
 	if tok.Type != SendArrow {
 		return SyntaxError{t: tok}
 	}
 	if !p.t.Next() {
 		return p.eofErr()
 	}
+	var ok bool
+	if p.length, ok = p.channelLengths[channelId]; !ok {
+		p.length = noteLength{length: defaultLength}
+	}
+	if p.key, ok = p.channelKeys[channelId]; !ok {
+		p.key = p.songKey
+	}
+	octave, ok := p.channelOctaves[channelId]
+	if !ok {
+		octave = defaultOctave
+	}
+	p.octave = &octave
 	tab, err := p.tablatureNode(s, true)
+	p.octave = nil
 	if err != nil {
 		return err
 	}
+	p.channelLengths[channelId] = p.length
+	p.channelKeys[channelId] = p.key
+	p.channelOctaves[channelId] = octaveAfter(tab, octave)
 	// tablature might be empty. Return error or just accept it?
-	s.AddItems(channelId, tab...)
+	s.AddStatement(channelId, statement.position(), tab...)
 
 	// not advancing the tokenizer. After a tablature, the token points to the next statement
 	return nil
@@ -3,6 +3,7 @@ package lang
 import (
 	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/mariomac/msxmml/pkg/song"
 	"github.com/stretchr/testify/assert"
@@ -31,6 +32,7 @@ $voice := trumpet {
 			"wave":    "sine",
 			"sordine": "true",
 		},
+		Position: song.Position{Row: 3, Col: 11},
 	}, *voice.Instrument)
 }
 
@@ -64,6 +66,7 @@ loop:		; some comments here
 				"wave": "sine",
 				"adsr": "traka",
 			},
+			Position: song.Position{Row: 2, Col: 11},
 		},
 		s.Constants["voice"][0].Instrument)
 	// check $const constant definition
@@ -126,7 +129,7 @@ loop:		; some comments here
 		*s.Blocks[1].Channels["ch1"].Items[3].OctaveStep)
 
 	// @ch2 <- v13aco2 | d
-	require.Len(t, s.Blocks[1].Channels["ch2"].Items, 5)
+	require.Len(t, s.Blocks[1].Channels["ch2"].Items, 6)
 	assert.Equal(t,
 		13,
 		*s.Blocks[1].Channels["ch2"].Items[0].Volume)
@@ -139,20 +142,21 @@ loop:		; some comments here
 	assert.Equal(t,
 		2,
 		*s.Blocks[1].Channels["ch2"].Items[3].SetOctave)
+	assert.True(t, s.Blocks[1].Channels["ch2"].Items[4].Bar)
 	assert.Equal(t,
 		&song.Note{Pitch: song.D, Length: defaultLength},
-		s.Blocks[1].Channels["ch2"].Items[4].Note)
+		s.Blocks[1].Channels["ch2"].Items[5].Note)
 
 	// check synced block after barrier
 	// @ch1 <- {dec}3
 	assert.Equal(t,
-		&song.Note{Pitch: song.D, Tuplet: 3, Length: defaultLength},
+		&song.Note{Pitch: song.D, Tuplet: song.Tuplet{Notes: 3, Span: 2}, Length: defaultLength},
 		s.Blocks[2].Channels["ch1"].Items[0].Note)
 	assert.Equal(t,
-		&song.Note{Pitch: song.E, Tuplet: 3, Length: defaultLength},
+		&song.Note{Pitch: song.E, Tuplet: song.Tuplet{Notes: 3, Span: 2}, Length: defaultLength},
 		s.Blocks[2].Channels["ch1"].Items[1].Note)
 	assert.Equal(t,
-		&song.Note{Pitch: song.C, Tuplet: 3, Length: defaultLength},
+		&song.Note{Pitch: song.C, Tuplet: song.Tuplet{Notes: 3, Span: 2}, Length: defaultLength},
 		s.Blocks[2].Channels["ch1"].Items[2].Note)
 }
 
@@ -166,13 +170,514 @@ func TestParseTupletWithOctaveChange(t *testing.T) {
 	require.NotNil(t, it[0].SetOctave)
 	assert.Equal(t, 4, *it[0].SetOctave)
 	require.NotNil(t, it[1].Note)
-	require.Equal(t, song.Note{Pitch: song.A, Length: 4, Tuplet: 3}, *it[1].Note)
+	require.Equal(t, song.Note{Pitch: song.A, Length: 4, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, *it[1].Note)
 	require.NotNil(t, it[2].Note)
-	require.Equal(t, song.Note{Pitch: song.B, Length: 4, Tuplet: 3}, *it[2].Note)
+	require.Equal(t, song.Note{Pitch: song.B, Length: 4, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, *it[2].Note)
 	require.NotNil(t, it[3].OctaveStep)
 	require.Equal(t, 1, *it[3].OctaveStep)
 	require.NotNil(t, it[4].Note)
-	require.Equal(t, song.Note{Pitch: song.C, Length: 4, Tuplet: 3}, *it[4].Note)
+	require.Equal(t, song.Note{Pitch: song.C, Length: 4, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, *it[4].Note)
 	require.NotNil(t, it[5].Note)
 	require.Equal(t, song.Note{Pitch: song.A, Length: 4}, *it[5].Note)
-}
\ No newline at end of file
+}
+
+func TestParseTuplets(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+@ch1 <- (c d)2 (c d e f g)5 (c d e f g a)6 (c d e f g a b)7 (c d e f g a b c d)9
+@ch2 <- (c d)2:3 (c r8 d8)3:2 (c (d e f)3 g)3 (c d e f)12:16
+`))
+	require.NoError(t, err)
+	tu := func(notes, span int) song.Tuplet {
+		return song.Tuplet{Notes: notes, Span: span}
+	}
+	tuplets := func(items song.Tablature) []song.Tuplet {
+		var tus []song.Tuplet
+		for _, ti := range items {
+			switch {
+			case ti.Note != nil:
+				tus = append(tus, ti.Note.Tuplet)
+			case ti.Silence != nil:
+				tus = append(tus, ti.Silence.Tuplet)
+			}
+		}
+		return tus
+	}
+	expected := []song.Tuplet{tu(2, 1), tu(2, 1)}
+	for _, tuplet := range []song.Tuplet{tu(5, 4), tu(6, 4), tu(7, 4), tu(9, 8)} {
+		for n := 0; n < tuplet.Notes; n++ {
+			expected = append(expected, tuplet)
+		}
+	}
+	assert.Equal(t, expected, tuplets(s.Blocks[0].Channels["ch1"].Items))
+	assert.Equal(t, []song.Tuplet{
+		tu(2, 3), tu(2, 3),
+		tu(3, 2), tu(3, 2), tu(3, 2),
+		tu(3, 2), tu(9, 4), tu(9, 4), tu(9, 4), tu(3, 2),
+		tu(12, 16), tu(12, 16), tu(12, 16), tu(12, 16),
+	}, tuplets(s.Blocks[0].Channels["ch2"].Items))
+
+	// durations of the tuplets, in beats
+	beats := func(items song.Tablature) song.Duration {
+		var b song.Duration
+		for i := range items {
+			b = b.Add(items[i].DurationBeats())
+		}
+		return b
+	}
+	assert.Equal(t, song.NewDuration(1+4+4+4+8, 1), beats(s.Blocks[0].Channels["ch1"].Items))
+	// 3 + 4/3 + 8/3 + 16/3
+	assert.Equal(t, song.NewDuration(37, 3), beats(s.Blocks[0].Channels["ch2"].Items))
+}
+
+func TestParseTuplets_Errors(t *testing.T) {
+	for _, src := range []string{"@ch1 <- (c)1", "@ch1 <- (c d e)3:0"} {
+		t.Run(src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(src + "\n"))
+			err = firstError(t, err)
+			require.IsType(t, ParserError{}, err)
+			assert.Equal(t, 1, err.(ParserError).t.Row)
+		})
+	}
+}
+
+func TestParseNoise(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+@drums <- n12 n3,8. (n1,8 n2,8 n3,8)3
+`))
+	require.NoError(t, err)
+	it := s.Blocks[0].Channels["drums"].Items
+	require.Len(t, it, 5)
+	assert.Equal(t, &song.Noise{Period: 12, Length: defaultLength}, it[0].Noise)
+	assert.Equal(t, &song.Noise{Period: 3, Length: 8, Dots: 1}, it[1].Noise)
+	assert.Equal(t, &song.Noise{Period: 1, Length: 8, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, it[2].Noise)
+	assert.Equal(t, &song.Noise{Period: 2, Length: 8, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, it[3].Noise)
+	assert.Equal(t, &song.Noise{Period: 3, Length: 8, Tuplet: song.Tuplet{Notes: 3, Span: 2}}, it[4].Noise)
+}
+
+func TestParseNoise_WrongPeriod(t *testing.T) {
+	_, err := Parse(strings.NewReader(`
+@drums <- n12 n32
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 2, err.(ParserError).t.Row)
+	assert.Equal(t, 15, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), "wrong noise period: 32. Must be in range 0 to 31")
+
+	for _, tc := range []struct {
+		src string
+		msg string
+	}{
+		{src: "@drums <- n99999999999999999999\n",
+			msg: "1:11 - wrong noise period: 99999999999999999999. Must be in range 0 to 31"},
+		{src: "@drums <- n3,0\n", msg: "1:11 - wrong noise length: 0. Must be in range 1 to 64"},
+		{src: "@drums <- n3,99999999999999999999\n",
+			msg: "1:11 - wrong noise length: 99999999999999999999. Must be in range 1 to 64"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Contains(t, err.Error(), tc.msg)
+		})
+	}
+}
+
+func TestParseTempo(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+tempo 120
+@ch1 <- a T90 b t60 c
+`))
+	require.NoError(t, err)
+	it := s.Blocks[0].Channels["ch1"].Items
+	require.Len(t, it, 5)
+	require.NotNil(t, it[1].Tempo)
+	assert.Equal(t, 90, *it[1].Tempo)
+	require.NotNil(t, it[3].Tempo)
+	assert.Equal(t, 60, *it[3].Tempo)
+
+	_, err = Parse(strings.NewReader(`
+@ch1 <- a t0 b
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 2, err.(ParserError).t.Row)
+	assert.Equal(t, 11, err.(ParserError).t.Col)
+}
+
+func TestParseDefaultLength(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+$riff := c l16 d e8
+@ch1 <- a l8 b $riff c. r
+@ch2 <- a L2. b c4
+---
+@ch1 <- d r4.
+`))
+	require.NoError(t, err)
+	// constants start with the global default length
+	assert.Equal(t, song.Tablature{
+		{Note: &song.Note{Pitch: song.C, Length: 4}},
+		{Note: &song.Note{Pitch: song.D, Length: 16}},
+		{Note: &song.Note{Pitch: song.E, Length: 8}},
+	}, withoutSources(s.Constants["riff"]))
+	ch1 := s.Blocks[0].Channels["ch1"].Items
+	require.Len(t, ch1, 7)
+	assert.Equal(t, &song.Note{Pitch: song.A, Length: 4}, ch1[0].Note)
+	assert.Equal(t, &song.Note{Pitch: song.B, Length: 8}, ch1[1].Note)
+	// the constant default length does not leak into the channel
+	assert.Equal(t, &song.Note{Pitch: song.C, Length: 8, Dots: 1}, ch1[5].Note)
+	assert.Equal(t, &song.Silence{Length: 8}, ch1[6].Silence)
+	ch2 := s.Blocks[0].Channels["ch2"].Items
+	require.Len(t, ch2, 3)
+	assert.Equal(t, &song.Note{Pitch: song.A, Length: 4}, ch2[0].Note)
+	assert.Equal(t, &song.Note{Pitch: song.B, Length: 2, Dots: 1}, ch2[1].Note)
+	assert.Equal(t, &song.Note{Pitch: song.C, Length: 4}, ch2[2].Note)
+	// the default length is kept for the rest of the channel
+	ch1 = s.Blocks[1].Channels["ch1"].Items
+	require.Len(t, ch1, 2)
+	assert.Equal(t, &song.Note{Pitch: song.D, Length: 8}, ch1[0].Note)
+	assert.Equal(t, &song.Silence{Length: 4, Dots: 1}, ch1[1].Silence)
+
+	_, err = Parse(strings.NewReader(`
+@ch1 <- a l128 b
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 11, err.(ParserError).t.Col)
+}
+
+func TestParseKeySignature(t *testing.T) {
+	s, err := Parse(strings.NewReader(`key d
+$a := f c g
+@ch1 <- f c g f- c= g+ f## c--
+@ch2 <- kb-m e b f $a
+@ch2 <- e b
+`))
+	require.NoError(t, err)
+	halftones := func(items song.Tablature) []song.Halftone {
+		var hts []song.Halftone
+		for _, ti := range items {
+			if ti.Note != nil {
+				hts = append(hts, ti.Note.Halftone)
+			}
+		}
+		return hts
+	}
+	assert.Equal(t, []song.Halftone{
+		song.Sharp, song.Sharp, song.NoHalftone, song.Flat, song.NoHalftone, song.Sharp,
+		song.DoubleSharp, song.DoubleFlat,
+	}, halftones(s.Blocks[0].Channels["ch1"].Items))
+	// the key changes are kept between the statements of a channel, but the constants
+	// always take the key of the song
+	assert.Equal(t, []song.Halftone{
+		song.Flat, song.Flat, song.NoHalftone, song.Sharp, song.Sharp, song.NoHalftone,
+		song.Flat, song.Flat,
+	}, halftones(s.Blocks[0].Channels["ch2"].Items))
+}
+
+func TestParseKeySignature_Keys(t *testing.T) {
+	for key, accidentals := range map[string]int{
+		"c": 0, "am": 0, "g": 1, "em": 1, "F#": 6, "d#m": 6, "c+": 7, "a#m": 7,
+		"f": -1, "dm": -1, "b-": -2, "gm": -2, "c-": -7, "a-m": -7,
+	} {
+		ks, err := song.ParseKeySignature(key)
+		require.NoError(t, err, key)
+		assert.Equal(t, accidentals, ks.Accidentals, key)
+		assert.Equal(t, strings.HasSuffix(key, "m"), ks.Minor, key)
+	}
+}
+
+func TestParseKeySignature_Errors(t *testing.T) {
+	_, err := Parse(strings.NewReader("key h\n@ch1 <- c\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `"key" header property: wrong key "h"`)
+
+	_, err = Parse(strings.NewReader("@ch1 <- c kg#\n"))
+	err = firstError(t, err)
+	require.IsType(t, ParserError{}, err)
+	assert.Equal(t, 11, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), `key "g#" has too many accidentals`)
+}
+
+func TestParseTies(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+$a := c d
+@ch1 <- e4&e16 | f+2 &
+        f+8. g^8^16. $a&d8 a
+`))
+	require.NoError(t, err)
+	assert.Equal(t, song.Tablature{
+		{Note: &song.Note{Pitch: song.E, Length: 4, Ties: []song.Tie{{Length: 16}}}},
+		{Bar: true},
+		{Note: &song.Note{Pitch: song.F, Halftone: song.Sharp, Length: 2, Ties: []song.Tie{{Length: 8, Dots: 1}}}},
+		{Note: &song.Note{Pitch: song.G, Length: 4, Ties: []song.Tie{{Length: 8}, {Length: 16, Dots: 1}}}},
+		{Note: &song.Note{Pitch: song.C, Length: 4}},
+		{Note: &song.Note{Pitch: song.D, Length: 4, Ties: []song.Tie{{Length: 8}}}},
+		{Note: &song.Note{Pitch: song.A, Length: 4}},
+	}, withoutSources(s.Blocks[0].Channels["ch1"].Items))
+	// tying a constant's note does not modify the constant
+	assert.Equal(t, &song.Note{Pitch: song.D, Length: 4}, s.Constants["a"][1].Note)
+}
+
+func TestParseTies_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		src      string
+		row, col int
+	}{
+		{src: "@ch1 <- c4&d4", row: 1, col: 12},
+		{src: "@ch1 <- o4 &c", row: 1, col: 12},
+		{src: "@ch1 <- c4 & r4", row: 1, col: 14},
+		{src: "@ch1 <- r4^4", row: 1, col: 11},
+		{src: "@ch1 <- c4& o5 c", row: 1, col: 13},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src + "\n"))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Equal(t, tc.row, err.(ParserError).t.Row)
+			assert.Equal(t, tc.col, err.(ParserError).t.Col)
+		})
+	}
+}
+
+func TestParseRepeats(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+@ch1 <- a [b [c]3 |1 d |2 e]2 f [g]
+`))
+	require.NoError(t, err)
+	note := func(p song.Pitch) song.TablatureItem {
+		return song.TablatureItem{Note: &song.Note{Pitch: p, Length: 4}}
+	}
+	items := withoutSources(s.Blocks[0].Channels["ch1"].Items)
+	require.Len(t, items, 4)
+	assert.Equal(t, note(song.A), items[0])
+	assert.Equal(t, &song.Repeat{
+		Times: 2,
+		Items: song.Tablature{
+			note(song.B),
+			{Repeat: &song.Repeat{Times: 3, Items: song.Tablature{note(song.C)}}},
+		},
+		Endings: []song.Tablature{{note(song.D)}, {note(song.E)}},
+	}, items[1].Repeat)
+	assert.Equal(t, note(song.F), items[2])
+	assert.Equal(t, &song.Repeat{Times: 2, Items: song.Tablature{note(song.G)}}, items[3].Repeat)
+
+	var unrolled []song.Pitch
+	for _, it := range items.Unroll() {
+		unrolled = append(unrolled, it.Note.Pitch)
+	}
+	assert.Equal(t, []song.Pitch{
+		song.A,
+		song.B, song.C, song.C, song.C, song.D,
+		song.B, song.C, song.C, song.C, song.E,
+		song.F, song.G, song.G,
+	}, unrolled)
+}
+
+func TestParseRepeats_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		src      string
+		row, col int
+	}{
+		{src: "@ch1 <- [a b\n@ch2 <- c", row: 1, col: 9},
+		{src: "@ch1 <- [a |2 b]", row: 1, col: 12},
+		{src: "@ch1 <- [a |1 b |2 c |3 d]2", row: 1, col: 26},
+		{src: "@ch1 <- [a]0", row: 1, col: 11},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src + "\n"))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Equal(t, tc.row, err.(ParserError).t.Row)
+			assert.Equal(t, tc.col, err.(ParserError).t.Col)
+		})
+	}
+}
+
+func TestConstantIntoConstant(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+$foo := ab $baz
+$bar := c $foo d
+$baz := e
+$empty :=
+@ch1 <- $bar $empty
+`))
+	require.NoError(t, err)
+	var pitches []song.Pitch
+	for _, it := range s.Blocks[0].Channels["ch1"].Items {
+		pitches = append(pitches, it.Note.Pitch)
+	}
+	assert.Equal(t, []song.Pitch{song.C, song.A, song.B, song.E, song.D}, pitches)
+	require.Len(t, s.Constants["foo"], 3)
+	require.Len(t, s.Constants["bar"], 5)
+	require.Len(t, s.Constants["baz"], 1)
+	require.Empty(t, s.Constants["empty"])
+}
+
+func TestParseTransposedConstant(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+$riff := a4 b8 > c
+@ch1 <- $riff(+3)
+`))
+	require.NoError(t, err)
+	up, down := 1, -1
+	assert.Equal(t, song.Tablature{
+		{OctaveStep: &up},
+		{Note: &song.Note{Pitch: song.C, Length: 4}},
+		{Note: &song.Note{Pitch: song.D, Length: 8}},
+		{OctaveStep: &up},
+		{OctaveStep: &down},
+		{Note: &song.Note{Pitch: song.D, Halftone: song.Sharp, Length: 4}},
+	}, withoutSources(s.Blocks[0].Channels["ch1"].Items))
+	// the constant is not modified
+	assert.Equal(t, &song.Note{Pitch: song.A, Length: 4}, s.Constants["riff"][0].Note)
+}
+
+func TestParseTransposedConstant_OutOfRange(t *testing.T) {
+	for _, src := range []string{
+		"@ch1 <- o8 c $riff(+12)",
+		"@ch1 <- $riff(o1,-1)",
+		"@ch1 <- o2 c\n@ch1 <- < $riff(-3)",
+	} {
+		t.Run(src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader("$riff := c d\n" + src + "\n"))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Contains(t, err.Error(), "out of range")
+		})
+	}
+	// if the octave is unknown, the transposition is not checked
+	_, err := Parse(strings.NewReader(`
+$riff := c d
+$twice := o8 c $riff(+12)
+`))
+	require.NoError(t, err)
+}
+
+func TestParseFile_Include(t *testing.T) {
+	fsys := fstest.MapFS{
+		"songs/song.m4l": {Data: []byte(`
+tempo 90
+include "common/drums.m4l"
+@ch1 <- $riff
+include "intro.m4l"
+`)},
+		"songs/common/drums.m4l": {Data: []byte(`
+tempo 120 ; not overriding the including file's tempo
+psg.hz 50
+$riff := a b
+`)},
+		"songs/intro.m4l": {Data: []byte(`
+@ch2 <- c
+---
+`)},
+	}
+	s, err := ParseFile(fsys, "songs/song.m4l")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"tempo": "90", "psg.hz": "50"}, s.Properties)
+	require.Len(t, s.Blocks, 2)
+	require.Len(t, s.Blocks[0].Channels["ch1"].Items, 2)
+	require.Len(t, s.Blocks[0].Channels["ch2"].Items, 1)
+}
+
+func TestParseFile_IncludeParent(t *testing.T) {
+	fsys := fstest.MapFS{
+		"songs/song.m4l": {Data: []byte(`
+include "../shared/riffs.m4l"
+@ch1 <- $riff
+`)},
+		"songs/shared/riffs.m4l": {Data: []byte("$riff := c\n")},
+		"shared/riffs.m4l":       {Data: []byte("include \"../common.m4l\"\n$riff := a $drums\n")},
+		"common.m4l":             {Data: []byte("$drums := b\n")},
+	}
+	s, err := ParseFile(fsys, "songs/song.m4l")
+	require.NoError(t, err)
+	var pitches []song.Pitch
+	for _, it := range s.Blocks[0].Channels["ch1"].Items {
+		pitches = append(pitches, it.Note.Pitch)
+	}
+	assert.Equal(t, []song.Pitch{song.A, song.B}, pitches)
+}
+
+func TestParseFile_IncludeErrors(t *testing.T) {
+	fsys := fstest.MapFS{
+		"song.m4l":  {Data: []byte("include \"inc/a.m4l\"\n")},
+		"inc/a.m4l": {Data: []byte("$a := abc\n@ch1 <- $a tracatraca\n")},
+		"cycle.m4l": {Data: []byte("include \"inc/b.m4l\"\n")},
+		"inc/b.m4l": {Data: []byte("include \"../cycle.m4l\"\n")},
+		"miss.m4l":  {Data: []byte("$a := abc\ninclude \"nope.m4l\"\n")},
+		"up.m4l":    {Data: []byte("include \"inc/../../up.m4l\"\n")},
+	}
+	_, err := ParseFile(fsys, "song.m4l")
+	err = firstError(t, err)
+	require.IsTypef(t, SyntaxError{}, err, "%#v", err)
+	assert.Equal(t, "inc/a.m4l:2:12 - Syntax Error: unexpected \"tracatraca\"", err.Error())
+
+	_, err = ParseFile(fsys, "cycle.m4l")
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, "inc/b.m4l:1:1 - include cycle: cycle.m4l -> inc/b.m4l -> cycle.m4l", err.Error())
+
+	_, err = ParseFile(fsys, "miss.m4l")
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Contains(t, err.Error(), "miss.m4l:2:1 - can't include file")
+
+	// the included files can't be out of the root of the file system
+	_, err = ParseFile(fsys, "up.m4l")
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, `up.m4l:1:1 - can't include file "inc/../../up.m4l": it is out of the root `+
+		"directory of the song files", err.Error())
+}
+
+func TestParseSources(t *testing.T) {
+	s, err := Parse(strings.NewReader(`
+$inner := c (de)3
+$outer := [$inner]
+$piano := psg { pattern: 3 }
+@ch1 <- a $piano
+@ch1 <- $outer(+2)
+`))
+	require.NoError(t, err)
+	ch1 := s.Blocks[0].Channels["ch1"]
+	assert.Equal(t, []song.Position{{Row: 5, Col: 1}, {Row: 6, Col: 1}}, ch1.Statements)
+	require.Len(t, ch1.Items, 3)
+	assert.Equal(t, &song.Source{Position: song.Position{Row: 5, Col: 9}}, ch1.Items[0].Source)
+	assert.Equal(t, &song.Source{
+		Position:   song.Position{Row: 4, Col: 11},
+		References: []song.Reference{{Constant: "piano", Position: song.Position{Row: 5, Col: 11}}},
+	}, ch1.Items[1].Source)
+
+	rp := ch1.Items[2]
+	require.NotNil(t, rp.Repeat)
+	assert.Equal(t, "3:11 (from $outer at 6:9)", rp.Source.String())
+	require.Len(t, rp.Repeat.Items, 3)
+	// transposed notes keep the sources of the original notes
+	assert.Equal(t, "2:11 (from $inner at 3:12, from $outer at 6:9)", rp.Repeat.Items[0].Source.String())
+	assert.Equal(t, song.Position{Row: 6, Col: 9}, rp.Repeat.Items[0].Source.UseSite())
+	assert.Equal(t, "2:14 (from $inner at 3:12, from $outer at 6:9)", rp.Repeat.Items[1].Source.String())
+	assert.Equal(t, "2:15 (from $inner at 3:12, from $outer at 6:9)", rp.Repeat.Items[2].Source.String())
+	// the constants keep their own sources
+	assert.Equal(t, "2:11", s.Constants["inner"][0].Source.String())
+}
+
+// withoutSources returns a copy of the tablature without the source of the items, to compare
+// only the musical contents
+func withoutSources(t song.Tablature) song.Tablature {
+	stripped := make(song.Tablature, 0, len(t))
+	for _, ti := range t {
+		ti.Source = nil
+		if ti.Repeat != nil {
+			rp := *ti.Repeat
+			rp.Items = withoutSources(rp.Items)
+			rp.Endings = nil
+			for _, e := range ti.Repeat.Endings {
+				rp.Endings = append(rp.Endings, withoutSources(e))
+			}
+			ti.Repeat = &rp
+		}
+		stripped = append(stripped, ti)
+	}
+	return stripped
+}
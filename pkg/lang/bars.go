@@ -0,0 +1,141 @@
+package lang
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+// checkBars returns a warning for each bar of the song whose length differs from the measure of
+// the time signature. Only the bars that are enclosed between two bar lines are checked, so the
+// channels can start with an incomplete measure (anacrusis) or finish in the middle of a measure.
+// The repetitions of the repeats are checked, and their start, endings and end also act as bar
+// lines.
+func checkBars(s *song.Song, ts song.TimeSignature) ErrorList {
+	var warnings ErrorList
+	reported := map[song.Position]bool{}
+	for b := range s.Blocks {
+		names := make([]string, 0, len(s.Blocks[b].Channels))
+		for name := range s.Blocks[b].Channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			bc := barCounter{measure: ts.MeasureBeats(), timesig: ts}
+			bc.check(s.Blocks[b].Channels[name].Items)
+			for _, w := range bc.warnings {
+				// a wrong bar inside a constant is reported only once, despite being used many times
+				if !reported[w.Position] {
+					reported[w.Position] = true
+					warnings = append(warnings, w)
+				}
+			}
+		}
+	}
+	sort.SliceStable(warnings, func(i, j int) bool {
+		pi, pj := warnings[i].Position, warnings[j].Position
+		if pi.File != pj.File {
+			return pi.File < pj.File
+		}
+		if pi.Row != pj.Row {
+			return pi.Row < pj.Row
+		}
+		return pi.Col < pj.Col
+	})
+	return warnings
+}
+
+// barCounter accumulates the length of the current bar of a channel
+type barCounter struct {
+	measure song.Duration
+	timesig song.TimeSignature
+	// open is true if the current bar started in a bar line
+	open bool
+	// beats of the current bar
+	beats song.Duration
+	// beats of the tied notes that belong to the next bar
+	carry    song.Duration
+	warnings ErrorList
+}
+
+// check the bars of the tablature
+func (bc *barCounter) check(t song.Tablature) {
+	for i := range t {
+		ti := &t[i]
+		switch {
+		case ti.Bar:
+			bc.barLine(ti)
+		case ti.Repeat != nil:
+			bc.barLine(ti)
+			bc.checkRepeat(ti)
+		case ti.Note != nil && len(ti.Note.Ties) > 0:
+			// the ties after a bar separator belong to the next bar
+			n := *ti.Note
+			n.Ties = nil
+			bc.beats = bc.beats.Add(n.Beats())
+			carry := false
+			for _, tie := range ti.Note.Ties {
+				carry = carry || tie.Bar
+				if carry {
+					bc.carry = bc.carry.Add(tie.Beats())
+				} else {
+					bc.beats = bc.beats.Add(tie.Beats())
+				}
+			}
+		default:
+			bc.beats = bc.beats.Add(ti.DurationBeats())
+		}
+	}
+}
+
+// checkRepeat checks the bars of all the repetitions of a repeat, without unrolling it. Once a
+// repetition starts in the same bar state and plays the same ending as the previous one, the
+// rest of the repetitions are equal, so they are not checked
+func (bc *barCounter) checkRepeat(ti *song.TablatureItem) {
+	type barState struct {
+		open         bool
+		beats, carry song.Duration
+	}
+	var last barState
+	for r := 0; r < ti.Repeat.Times; r++ {
+		state := barState{open: bc.open, beats: bc.beats, carry: bc.carry}
+		if r > 0 && r >= len(ti.Repeat.Endings) && state == last {
+			return
+		}
+		last = state
+		bc.check(ti.Repeat.Items)
+		if ending := ti.Repeat.Ending(r); ending != nil {
+			bc.barLine(ti)
+			bc.check(ending)
+		}
+		bc.barLine(ti)
+	}
+}
+
+// barLine finishes the current bar, verifying it if it started in another bar line, and starts
+// a new bar. Empty bars (e.g. a separator followed by a repeat) are ignored
+func (bc *barCounter) barLine(ti *song.TablatureItem) {
+	if bc.beats.IsZero() && bc.carry.IsZero() {
+		bc.open = true
+		return
+	}
+	if bc.open && bc.beats.Cmp(bc.measure) != 0 {
+		w := Diagnostic{
+			Severity: SeverityWarning,
+			Message: fmt.Sprintf("bar lasts %s beats, but a %v measure lasts %s beats",
+				formatBeats(bc.beats), bc.timesig, formatBeats(bc.measure)),
+		}
+		if ti.Source != nil {
+			w.Position = ti.Source.Position
+		}
+		bc.warnings = append(bc.warnings, w)
+	}
+	bc.open = true
+	bc.beats, bc.carry = bc.carry, song.Duration{}
+}
+
+func formatBeats(beats song.Duration) string {
+	return strconv.FormatFloat(beats.Float64(), 'g', 4, 64)
+}
@@ -0,0 +1,97 @@
+package lang
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const barsSong = `timesig 3/4
+$bar := c2 d4 | e2
+@ch1 <- c4 | c2. | c2 c8 | (c8 c8 c8)3 c2 | c2 d4 & | d4 c2 | e4.. f16 g4 | a
+@ch2 <- | [c2. |1 d4 d2 |2 e4]2 | $bar g4 | r4 $bar | f2.
+`
+
+func TestCheckBars(t *testing.T) {
+	s, err := Parse(strings.NewReader(barsSong), WithBarCheck())
+	require.NotNil(t, s)
+	require.IsType(t, ErrorList{}, err)
+	assert.False(t, err.(ErrorList).HasErrors())
+	assert.Equal(t, ErrorList{{
+		Position: song.Position{Row: 2, Col: 15},
+		Severity: SeverityWarning,
+		Message:  "bar lasts 4 beats, but a 3/4 measure lasts 3 beats",
+	}, {
+		Position: song.Position{Row: 3, Col: 26},
+		Severity: SeverityWarning,
+		Message:  "bar lasts 2.5 beats, but a 3/4 measure lasts 3 beats",
+	}, {
+		Position: song.Position{Row: 4, Col: 11},
+		Severity: SeverityWarning,
+		Message:  "bar lasts 1 beats, but a 3/4 measure lasts 3 beats",
+	}, {
+		Position: song.Position{Row: 4, Col: 53},
+		Severity: SeverityWarning,
+		Message:  "bar lasts 2 beats, but a 3/4 measure lasts 3 beats",
+	}}, err)
+	assert.Equal(t, "2:15 - warning: bar lasts 4 beats, but a 3/4 measure lasts 3 beats",
+		err.(ErrorList)[0].Error())
+}
+
+func TestCheckBars_Repeats(t *testing.T) {
+	// the first ending is wrong, and the second one is played in the rest of the repetitions
+	for _, times := range []string{"2", "99"} {
+		t.Run(times, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(
+				"timesig 3/4\n@ch1 <- | [c2. |1 d2 |2 e2.]"+times+" | f2.\n"), WithBarCheck())
+			require.IsType(t, ErrorList{}, err)
+			assert.Equal(t, ErrorList{{
+				Position: song.Position{Row: 2, Col: 11},
+				Severity: SeverityWarning,
+				Message:  "bar lasts 2 beats, but a 3/4 measure lasts 3 beats",
+			}}, err)
+		})
+	}
+}
+
+func TestCheckBars_Disabled(t *testing.T) {
+	// the check is opt-in
+	s, err := Parse(strings.NewReader(barsSong))
+	require.NoError(t, err)
+	assert.Equal(t, "3/4", s.Properties["timesig"])
+
+	// the check does nothing if the song has no time signature
+	s, err = Parse(strings.NewReader(strings.TrimPrefix(barsSong, "timesig 3/4\n")), WithBarCheck())
+	require.NoError(t, err)
+	require.NotNil(t, s)
+}
+
+func TestCheckBars_CompoundTime(t *testing.T) {
+	_, err := Parse(strings.NewReader(`timesig 6/8
+@ch1 <- | c4. d4. | (e8 f8 g8)3 a4 b8 r8 |
+`), WithBarCheck())
+	require.NoError(t, err)
+}
+
+func TestCheckBars_ErrorsHidingWarnings(t *testing.T) {
+	// the song is not returned if there are errors
+	s, err := Parse(strings.NewReader("timesig 3/4\n@ch1 <- | c4 | c4 $undefined\n"), WithBarCheck())
+	assert.Nil(t, s)
+	require.IsType(t, ErrorList{}, err)
+	assert.True(t, err.(ErrorList).HasErrors())
+	require.Len(t, err.(ErrorList), 1)
+}
+
+func TestWrongTimeSignature(t *testing.T) {
+	for _, ts := range []string{"3", "0/4", "3/5", "3/128", "three/4"} {
+		t.Run(ts, func(t *testing.T) {
+			_, err := Parse(strings.NewReader("timesig " + ts + "\n@ch1 <- c\n"))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), `"timesig" header property: wrong time signature`)
+		})
+	}
+}
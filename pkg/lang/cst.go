@@ -0,0 +1,94 @@
+package lang
+
+import (
+	"bufio"
+	"io"
+)
+
+// SyntaxTree is the concrete syntax tree of a song source. Unlike the song.Song that is returned
+// by the parser, it keeps the comments, the separators and the layout of the source code, and
+// its contents are not semantically verified (e.g. undefined constants).
+type SyntaxTree struct {
+	Header     []HeaderLine
+	Statements []Statement
+}
+
+// Statement of the song body
+type Statement struct {
+	// Type of the first token: ConstDef, ChannelId, ChannelSync, LoopTag, Include, or Comment
+	// for the comment lines between statements
+	Type TokenType
+	// Tokens of the statement, including the comments and separators
+	Tokens []Token
+	// EmptyLinesBefore is the number of empty lines between the statement and the previous one
+	EmptyLinesBefore int
+}
+
+// ParseSyntaxTree reads the concrete syntax tree of a song source
+func ParseSyntaxTree(reader io.Reader) (*SyntaxTree, error) {
+	input := bufio.NewReader(reader)
+	header, lines, firstLine, err := readHeader(input)
+	if err != nil {
+		return nil, err
+	}
+	t := newBodyTokenizer(input, firstLine, lines)
+	t.keepComments = true
+
+	st := &SyntaxTree{Header: header}
+	// comment lines that follow the current statement. They belong to the next statement
+	// if they are placed before it, or to the current statement if it continues after them
+	var comments []Token
+	// row of the last token of the previous statement. Initially, the last line of the header
+	lastRow := lines
+	if firstLine != "" {
+		lastRow--
+	}
+	appendStatement := func(tok Token) {
+		st.Statements = append(st.Statements, Statement{
+			Type:             tok.Type,
+			Tokens:           []Token{tok},
+			EmptyLinesBefore: tok.Row - lastRow - 1,
+		})
+		lastRow = tok.Row
+	}
+	for t.Next() {
+		tok := t.Get()
+		var current *Statement
+		if len(st.Statements) > 0 {
+			current = &st.Statements[len(st.Statements)-1]
+		}
+		switch tok.Type {
+		case Comment:
+			if current != nil && current.Type != Comment && len(comments) == 0 &&
+				tok.Row == current.Tokens[len(current.Tokens)-1].Row {
+				// comment at the end of a statement line
+				current.Tokens = append(current.Tokens, tok)
+			} else {
+				comments = append(comments, tok)
+			}
+			continue
+		case ConstDef, ChannelId, ChannelSync, LoopTag, Include:
+			for _, c := range comments {
+				appendStatement(c)
+			}
+			comments = nil
+			appendStatement(tok)
+		default:
+			if current == nil || current.Type == Comment || current.Type == ChannelSync ||
+				current.Type == LoopTag || current.Type == Include {
+				return nil, SyntaxError{t: tok}
+			}
+			current.Tokens = append(current.Tokens, comments...)
+			comments = nil
+			current.Tokens = append(current.Tokens, tok)
+			lastRow = tok.Row
+		}
+	}
+	if err := t.Err(); err != nil {
+		return nil, err
+	}
+	for _, c := range comments {
+		appendStatement(c)
+	}
+	return st, nil
+}
@@ -1,9 +1,21 @@
 package lang
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
 
 func errHeader(t Token) string {
-	return fmt.Sprintf("%d:%d - ", t.Row, t.Col)
+	return t.position().String() + " - "
+}
+
+// positionedError is implemented by the errors that refer to a given place of the source
+type positionedError interface {
+	error
+	position() song.Position
+	message() string
 }
 
 type SyntaxError struct {
@@ -11,16 +23,33 @@ type SyntaxError struct {
 }
 
 func (p SyntaxError) Error() string {
-	return errHeader(p.t) + fmt.Sprintf("Syntax Error: unexpected %q", p.t.Content)
+	return errHeader(p.t) + p.message()
+}
+
+func (p SyntaxError) position() song.Position {
+	return p.t.position()
+}
+
+func (p SyntaxError) message() string {
+	return fmt.Sprintf("Syntax Error: unexpected %q", p.t.Content)
 }
 
 type UnexpecedEofError struct {
-	Row int
-	Col int
+	File string
+	Row  int
+	Col  int
 }
 
 func (p UnexpecedEofError) Error() string {
-	return fmt.Sprintf("%d:%d - Unexpected EOF", p.Row, p.Col)
+	return p.position().String() + " - " + p.message()
+}
+
+func (p UnexpecedEofError) position() song.Position {
+	return song.Position{File: p.File, Row: p.Row, Col: p.Col}
+}
+
+func (p UnexpecedEofError) message() string {
+	return "Unexpected EOF"
 }
 
 type RedefinitionError struct {
@@ -28,7 +57,15 @@ type RedefinitionError struct {
 }
 
 func (r RedefinitionError) Error() string {
-	return errHeader(r.t) + fmt.Sprintf("can't redefine: %v", r.t.Content)
+	return errHeader(r.t) + r.message()
+}
+
+func (r RedefinitionError) position() song.Position {
+	return r.t.position()
+}
+
+func (r RedefinitionError) message() string {
+	return fmt.Sprintf("can't redefine: %v", r.t.Content)
 }
 
 type ParserError struct {
@@ -39,3 +76,83 @@ type ParserError struct {
 func (p ParserError) Error() string {
 	return errHeader(p.t) + p.msg
 }
+
+func (p ParserError) position() song.Position {
+	return p.t.position()
+}
+
+func (p ParserError) message() string {
+	return p.msg
+}
+
+// Severity of a Diagnostic
+type Severity int
+
+const (
+	// SeverityError diagnostics prevent the song from being parsed
+	SeverityError Severity = iota
+	// SeverityWarning diagnostics point to places of the song that are probably wrong
+	SeverityWarning
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	}
+	return fmt.Sprintf("unknown: %d (probably a bug)", s)
+}
+
+// Diagnostic is an error or warning found in a given place of the song source
+type Diagnostic struct {
+	Position song.Position
+	Severity Severity
+	Message  string
+	// Err is the original error, if any
+	Err error
+}
+
+func newDiagnostic(err error) Diagnostic {
+	if pe, ok := err.(positionedError); ok {
+		return Diagnostic{Position: pe.position(), Severity: SeverityError, Message: pe.message(), Err: err}
+	}
+	return Diagnostic{Severity: SeverityError, Message: err.Error(), Err: err}
+}
+
+func (d Diagnostic) Error() string {
+	sb := strings.Builder{}
+	if d.Position != (song.Position{}) {
+		sb.WriteString(d.Position.String() + " - ")
+	}
+	if d.Severity == SeverityWarning {
+		sb.WriteString("warning: ")
+	}
+	sb.WriteString(d.Message)
+	return sb.String()
+}
+
+// ErrorList contains all the diagnostics found when parsing a song, in the order they were found
+type ErrorList []Diagnostic
+
+func (e ErrorList) Error() string {
+	sb := strings.Builder{}
+	for i, d := range e {
+		if i > 0 {
+			sb.WriteByte('\n')
+		}
+		sb.WriteString(d.Error())
+	}
+	return sb.String()
+}
+
+// HasErrors returns true if any of the diagnostics is an error. Otherwise, they are warnings
+func (e ErrorList) HasErrors() bool {
+	for _, d := range e {
+		if d.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
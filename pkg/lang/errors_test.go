@@ -1,8 +1,13 @@
 package lang
 
 import (
+	"errors"
+	"io"
+	"io/fs"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -14,6 +19,7 @@ $foo := pgs { wave: square }
 $bar := abce
 $foo := ffe
 `))
+	err = firstError(t, err)
 	require.IsTypef(t, RedefinitionError{}, err, "%#v", err)
 	terr := err.(RedefinitionError)
 	assert.Equal(t, 4, terr.t.Row)
@@ -24,19 +30,249 @@ func TestSyntaxError(t *testing.T) {
 	_, err := Parse(strings.NewReader(`
 $foo := ( wave: square )
 `))
+	err = firstError(t, err)
 	require.IsTypef(t, SyntaxError{}, err, "%#v", err)
 	terr := err.(SyntaxError)
 	assert.Equal(t, 2, terr.t.Row)
 	assert.Equal(t, 11, terr.t.Col)
 }
 
-func TestConstantIntoConstant(t *testing.T) {
+func TestConstantReferenceCycle(t *testing.T) {
 	_, err := Parse(strings.NewReader(`
-$foo := abc
-$bar := a $foo b 
+$foo := abc $baz
+$bar := a $foo b
+$baz := [c $bar]
+@ch1 <- $bar
 `))
-	assert.Error(t, err)
-	assert.IsType(t, ParserError{}, err)
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 4, err.(ParserError).t.Row)
+	assert.Equal(t, 12, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), "$bar -> $foo -> $baz -> $bar")
+}
+
+func TestConstantSelfReference(t *testing.T) {
+	_, err := Parse(strings.NewReader(`
+$foo := abc $foo
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 2, err.(ParserError).t.Row)
+	assert.Equal(t, 13, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), "$foo -> $foo")
+}
+
+func TestConstantUndefinedReference(t *testing.T) {
+	_, err := Parse(strings.NewReader(`
+$foo := abc $bar
+$bar := c $baz
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
 	assert.Equal(t, 3, err.(ParserError).t.Row)
 	assert.Equal(t, 11, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), `constant "baz" not defined ($foo -> $bar -> $baz)`)
 }
+
+func TestConstantForwardReferenceFromChannel(t *testing.T) {
+	// $bar is defined after being used by a channel through $foo
+	_, err := Parse(strings.NewReader(`
+$foo := abc $bar
+@ch1 <- $foo
+$bar := c
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Equal(t, 2, err.(ParserError).t.Row)
+	assert.Equal(t, 13, err.(ParserError).t.Col)
+	assert.Contains(t, err.Error(), `constant "bar" not defined ($foo -> $bar)`)
+}
+
+func TestConstantDefinedAfterUse(t *testing.T) {
+	// constants can refer to constants that are defined later, but a channel statement needs
+	// all the constants that it uses to be already defined
+	for _, tc := range []struct {
+		src string
+		msg string
+	}{
+		{src: "@ch1 <- $piece\n$piece := c d\n", msg: `1:9 - constant "piece" not defined`},
+		{src: "$twice := $piece $piece\n@ch1 <- $twice\n$piece := c d\n",
+			msg: `1:11 - constant "piece" not defined ($twice -> $piece)`},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Contains(t, err.Error(), tc.msg)
+		})
+	}
+}
+
+func TestLengthLimits(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		msg string
+	}{
+		{src: "@ch1 <- c.........\n", msg: "1:9 - too many dots for a note: 9. The maximum is 8"},
+		{src: "@ch1 <- l4..... c....\n", msg: "1:17 - too many dots for a note: 9. The maximum is 8"},
+		{src: "@ch1 <- l4.........\n", msg: "1:9 - too many dots for a default length: 9"},
+		{src: "@ch1 <- r8.........\n", msg: "1:9 - too many dots for a silence: 9"},
+		{src: "@ch1 <- n3,8.........\n", msg: "1:9 - too many dots for a noise: 9"},
+		{src: "@ch1 <- c^8.........\n", msg: "too many dots for a tie: 9"},
+		{src: "$riff := (c d r.........)3\n@ch1 <- $riff\n", msg: "too many dots for a silence: 9"},
+		{src: "@ch1 <- r0\n", msg: "1:9 - wrong silence length: 0. Must be in range 1 to 64"},
+		{src: "$riff := r65\n@ch1 <- $riff\n", msg: "wrong silence length: 65"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Contains(t, err.Error(), tc.msg)
+		})
+	}
+	// the maximum number of dots is accepted
+	_, err := Parse(strings.NewReader("@ch1 <- l4.... c.... r8........ n3,8........ c^8........\n"))
+	require.NoError(t, err)
+}
+
+func TestNumberLimits(t *testing.T) {
+	// the numbers that are too big to be parsed are reported as any other out of range number
+	for _, tc := range []struct {
+		src string
+		msg string
+	}{
+		{src: "@ch1 <- t0\n", msg: "1:9 - wrong tempo: 0. Must be in range 1 to 999"},
+		{src: "@ch1 <- t1000\n", msg: "1:9 - wrong tempo: 1000. Must be in range 1 to 999"},
+		{src: "@ch1 <- t99999999999999999999\n",
+			msg: "1:9 - wrong tempo: 99999999999999999999. Must be in range 1 to 999"},
+		{src: "@ch1 <- v99999999999999999999\n",
+			msg: "1:9 - max volume is 16 (was: 99999999999999999999)"},
+		{src: "@ch1 <- c99999999999999999999\n",
+			msg: "1:9 - wrong note length: 99999999999999999999. Must be in range 1 to 64"},
+		{src: "@ch1 <- r99999999999999999999\n",
+			msg: "1:9 - wrong silence length: 99999999999999999999. Must be in range 1 to 64"},
+		{src: "@ch1 <- l0 c\n", msg: "1:9 - wrong default length: 0. Must be in range 1 to 64"},
+		{src: "@ch1 <- l99999999999999999999 c\n",
+			msg: "1:9 - wrong default length: 99999999999999999999. Must be in range 1 to 64"},
+		{src: "@ch1 <- c^0\n", msg: "1:10 - wrong tie length: 0. Must be in range 1 to 64"},
+		{src: "@ch1 <- c^99999999999999999999\n",
+			msg: "1:10 - wrong tie length: 99999999999999999999. Must be in range 1 to 64"},
+		{src: "@ch1 <- (c d)1\n", msg: "1:13 - wrong tuplet notes: 1. Must be in range 2 to 64"},
+		{src: "@ch1 <- (c d)65\n", msg: "1:13 - wrong tuplet notes: 65. Must be in range 2 to 64"},
+		{src: "@ch1 <- (c d)99999999999999999999\n",
+			msg: "1:13 - wrong tuplet notes: 99999999999999999999. Must be in range 2 to 64"},
+		{src: "@ch1 <- (c d)3:0\n", msg: "1:13 - wrong tuplet span: 0. Must be in range 1 to 64"},
+		{src: "@ch1 <- (c d)3:99999999999999999999\n",
+			msg: "1:13 - wrong tuplet span: 99999999999999999999. Must be in range 1 to 64"},
+		{src: "@ch1 <- ((((((c)64)64)64)64)64)\n",
+			msg: "1:25 - nested tuplets play 16777216 notes in the time of 1048576. Must be at most 1048576 notes"},
+		{src: "@ch1 <- [c]0\n", msg: "1:11 - wrong repeat times: 0. Must be in range 1 to 99"},
+		{src: "@ch1 <- [c]100\n", msg: "1:11 - wrong repeat times: 100. Must be in range 1 to 99"},
+		{src: "@ch1 <- [c]900000000\n",
+			msg: "1:11 - wrong repeat times: 900000000. Must be in range 1 to 99"},
+		{src: "@ch1 <- [c |99999999999999999999 d]\n", msg: "1:12 - expected ending number 1"},
+		{src: "$x := c\n@ch1 <- $x(+85)\n", msg: "2:9 - wrong transposition: +85. Must be in range -84 to 84"},
+		{src: "$x := c\n@ch1 <- $x(+99999999999999999999)\n",
+			msg: "2:9 - wrong transposition: +99999999999999999999. Must be in range -84 to 84"},
+		{src: "$x := c\n@ch1 <- $x(o4,-99999999999999999999)\n",
+			msg: "2:9 - wrong transposition: -99999999999999999999. Must be in range -84 to 84"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src))
+			err = firstError(t, err)
+			require.IsTypef(t, ParserError{}, err, "%#v", err)
+			assert.Contains(t, err.Error(), tc.msg)
+		})
+	}
+}
+
+func TestMultipleErrors(t *testing.T) {
+	_, err := Parse(strings.NewReader(`
+$foo := abc v20 def
+$bar := cde
+@ch1 <- $foo (abc tracatraca
+@ch2 <- c99 d e
+$bar := fga
+--
+@ch1 <- $undefined
+loop:
+loop:
+@ch3 <- abc
+`))
+	require.IsTypef(t, ErrorList{}, err, "%#v", err)
+	type diag struct {
+		row, col int
+		msg      string
+	}
+	var diags []diag
+	for _, d := range err.(ErrorList) {
+		assert.Equal(t, SeverityError, d.Severity)
+		diags = append(diags, diag{row: d.Position.Row, col: d.Position.Col, msg: d.Message})
+	}
+	assert.Equal(t, []diag{
+		{row: 2, col: 13, msg: "max volume is 16 (was: 20)"},
+		{row: 4, col: 19, msg: `Syntax Error: unexpected "tracatraca"`},
+		{row: 5, col: 9, msg: "wrong note length: 99. Must be in range 1 to 64"},
+		{row: 6, col: 1, msg: "can't redefine: $bar :="},
+		{row: 8, col: 9, msg: `constant "undefined" not defined`},
+		{row: 10, col: 1, msg: "duplicate 'loop:' tag"},
+	}, diags)
+}
+
+func TestErrorList_Error(t *testing.T) {
+	_, err := Parse(strings.NewReader(`@ch1 <- v20
+@ch2 <- abc )3
+`))
+	require.Error(t, err)
+	assert.Equal(t, "1:9 - max volume is 16 (was: 20)\n"+
+		`2:13 - Syntax Error: unexpected ")3"`, err.Error())
+}
+
+// firstError returns the original error of the first diagnostic that is returned by the parser
+func firstError(t *testing.T, err error) error {
+	t.Helper()
+	require.IsTypef(t, ErrorList{}, err, "%#v", err)
+	require.NotEmpty(t, err)
+	return err.(ErrorList)[0].Err
+}
+
+func TestParse_ReadError(t *testing.T) {
+	readErr := errors.New("device not ready")
+	// failing while reading the header
+	_, err := Parse(io.MultiReader(strings.NewReader("tempo 120\n"), iotest.ErrReader(readErr)))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, readErr), "%v", err)
+	// failing while reading the body
+	_, err = Parse(io.MultiReader(strings.NewReader("tempo 120\n@ch1 <- a\n"), iotest.ErrReader(readErr)))
+	err = firstError(t, err)
+	assert.True(t, errors.Is(err, readErr), "%v", err)
+	assert.Equal(t, "can't read line 3: device not ready", err.Error())
+
+	fsys := fstest.MapFS{"song.m4l": {Data: []byte("include \"inc.m4l\"\n@ch1 <- a\n")}}
+	_, err = ParseFile(errorFS{MapFS: fsys, name: "inc.m4l", err: readErr}, "song.m4l")
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Contains(t, err.Error(), `song.m4l:1:1 - can't include file "inc.m4l"`)
+	assert.Contains(t, err.Error(), readErr.Error())
+}
+
+// errorFS returns a file that fails after its first line
+type errorFS struct {
+	fstest.MapFS
+	name string
+	err  error
+}
+
+func (e errorFS) Open(name string) (fs.File, error) {
+	if name != e.name {
+		return e.MapFS.Open(name)
+	}
+	return errorFile{Reader: io.MultiReader(strings.NewReader("@ch2 <- c\n"), iotest.ErrReader(e.err))}, nil
+}
+
+type errorFile struct {
+	io.Reader
+}
+
+func (errorFile) Stat() (fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (errorFile) Close() error               { return nil }
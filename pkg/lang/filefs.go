@@ -0,0 +1,39 @@
+package lang
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// FileFS returns the file system of the operating system where a song file and the files that
+// it includes are looked up, as well as the name of the song file in it, to parse the song with
+// ParseFile or ParseSource. If the file is in the working directory, or in any of its
+// subdirectories, the file system is rooted at the working directory, so the song can include
+// the files of its parent directories (e.g. include "../shared/drums.m4l"). Otherwise, it is
+// rooted at the directory of the song file.
+func FileFS(file string) (fs.FS, string) {
+	if wd, name, ok := workingDirName(file); ok {
+		return os.DirFS(wd), name
+	}
+	return os.DirFS(filepath.Dir(file)), filepath.Base(file)
+}
+
+// workingDirName returns the working directory and the name of the file relative to it, or false
+// if the file is not inside the working directory
+func workingDirName(file string) (string, string, bool) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", "", false
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", "", false
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return "", "", false
+	}
+	name := filepath.ToSlash(rel)
+	return wd, name, fs.ValidPath(name) && name != "."
+}
@@ -0,0 +1,50 @@
+package lang
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileFS(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"songs/song.m4l":   "include \"../shared/riffs.m4l\"\n@ch1 <- $riff\n",
+		"shared/riffs.m4l": "$riff := a b\n",
+	}
+	for name, src := range files {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		require.NoError(t, os.WriteFile(file, []byte(src), 0644))
+	}
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.Chdir(wd)) }()
+
+	// files inside the working directory can include the files of its parent directories
+	require.NoError(t, os.Chdir(root))
+	for _, file := range []string{"songs/song.m4l", filepath.Join(root, "songs", "song.m4l")} {
+		fsys, name := FileFS(file)
+		assert.Equal(t, "songs/song.m4l", name)
+		s, err := ParseFile(fsys, name)
+		require.NoError(t, err)
+		require.Len(t, s.Blocks[0].Channels["ch1"].Items, 2)
+	}
+
+	// files out of the working directory can't include their parent directories
+	require.NoError(t, os.Chdir(filepath.Join(root, "shared")))
+	fsys, name := FileFS(filepath.Join("..", "songs", "song.m4l"))
+	assert.Equal(t, "song.m4l", name)
+	_, err = ParseFile(fsys, name)
+	err = firstError(t, err)
+	assert.Equal(t, `song.m4l:1:1 - can't include file "../shared/riffs.m4l": it is out of the root `+
+		"directory of the song files", err.Error())
+
+	_, err = ParseSource(fsys, name, strings.NewReader("include \"missing.m4l\"\n"))
+	err = firstError(t, err)
+	assert.Contains(t, err.Error(), "can't include file: open missing.m4l")
+}
@@ -0,0 +1,201 @@
+package lang
+
+import (
+	"io"
+	"strings"
+)
+
+// indentation of the instrument properties
+const instrumentIndent = "    "
+
+// Format reads a song source and writes it in the canonical layout: aligned header properties,
+// one statement per group of lines, lowercase commands and '#' for the sharp notes.
+// Comments, bar separators and the line breaks inside the statements are preserved.
+func Format(dst io.Writer, src io.Reader) error {
+	st, err := ParseSyntaxTree(src)
+	if err != nil {
+		return err
+	}
+	return st.Format(dst)
+}
+
+// Format writes the syntax tree in the canonical layout
+func (st *SyntaxTree) Format(w io.Writer) error {
+	var lines []string
+	lines = append(lines, formatHeader(st.Header)...)
+	for _, s := range st.Statements {
+		if s.EmptyLinesBefore > 0 {
+			lines = append(lines, "")
+		}
+		lines = append(lines, formatStatement(s)...)
+	}
+	sb := strings.Builder{}
+	// removing the leading, trailing and consecutive empty lines
+	pendingEmpty := false
+	for _, l := range lines {
+		if l == "" {
+			pendingEmpty = sb.Len() > 0
+			continue
+		}
+		if pendingEmpty {
+			sb.WriteByte('\n')
+			pendingEmpty = false
+		}
+		sb.WriteString(l)
+		sb.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func formatHeader(header []HeaderLine) []string {
+	keyWidth, propWidth := 0, 0
+	for _, hl := range header {
+		if hl.Key != "" && len(hl.Key) > keyWidth {
+			keyWidth = len(hl.Key)
+		}
+	}
+	for _, hl := range header {
+		if hl.Key != "" && keyWidth+1+len(hl.Value) > propWidth {
+			propWidth = keyWidth + 1 + len(hl.Value)
+		}
+	}
+	lines := make([]string, 0, len(header))
+	for _, hl := range header {
+		if hl.Key == "" {
+			lines = append(lines, hl.Comment)
+			continue
+		}
+		line := pad(hl.Key, keyWidth) + " " + hl.Value
+		if hl.Comment != "" {
+			line = pad(line, propWidth) + " " + hl.Comment
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// formatStatement returns the lines of the statement. The line breaks inside a tablature are
+// preserved, and the continuation lines are aligned with the start of the tablature
+func formatStatement(s Statement) []string {
+	var lines []string
+	line := strings.Builder{}
+	indent := ""
+	inInstrument := false
+	newLine := func(prefix string) {
+		lines = append(lines, strings.TrimRight(line.String(), " "))
+		line.Reset()
+		line.WriteString(prefix)
+	}
+	for i, tok := range s.Tokens {
+		text := canonical(tok)
+		if i == 0 {
+			line.WriteString(text)
+			continue
+		}
+		prev := s.Tokens[i-1]
+		switch {
+		case tok.Type == Comment && tok.Row == prev.Row:
+			// comment at the end of the line
+			line.WriteString(" " + text)
+			continue
+		case inInstrument && tok.Type == CloseInstrument:
+			inInstrument = false
+			newLine("")
+		case inInstrument:
+			newLine(instrumentIndent)
+		case tok.Row > prev.Row:
+			newLine(indent)
+		case !glued(prev, tok):
+			line.WriteByte(' ')
+		}
+		line.WriteString(text)
+		switch tok.Type {
+		case SendArrow, ConstDef:
+			// the tablature is aligned with the first token after the statement head
+			indent = strings.Repeat(" ", line.Len()+1)
+		case OpenInstrument:
+			inInstrument = true
+		}
+	}
+	newLine("")
+	return lines
+}
+
+// glued returns true if there must not be any space between both tokens
+func glued(prev, tok Token) bool {
+	switch prev.Type {
+	case OpenTuple, OpenRepeat, Tie:
+		return true
+	}
+	switch tok.Type {
+	case CloseTuple, CloseRepeat, Tie, TieLength:
+		return true
+	}
+	return false
+}
+
+// canonical returns the canonical representation of a token
+func canonical(tok Token) string {
+	sm := tok.Submatch
+	switch tok.Type {
+	case Note:
+		halftone := ""
+		switch sm[1] {
+		case "#", "+":
+			halftone = "#"
+		case "##", "++":
+			halftone = "##"
+		case "-", "--", "=":
+			halftone = sm[1]
+		}
+		return strings.ToLower(sm[0]) + halftone + sm[2] + sm[3]
+	case Key:
+		return "k" + strings.ReplaceAll(strings.ToLower(sm[0]), "+", "#")
+	case Volume:
+		return "v" + sm[0]
+	case Silence:
+		return "r" + sm[0] + sm[1]
+	case Noise:
+		if sm[1] != "" {
+			return "n" + sm[0] + "," + sm[1] + sm[2]
+		}
+		return "n" + sm[0] + sm[2]
+	case Tempo:
+		return "t" + sm[0]
+	case DefaultLength:
+		return "l" + sm[0] + sm[1]
+	case Octave:
+		return "o" + sm[0]
+	case LoopTag:
+		return "loop:"
+	case ConstDef:
+		return "$" + sm[0] + " :="
+	case ConstRef:
+		var params []string
+		if sm[1] != "" {
+			params = append(params, "o"+sm[1])
+		}
+		if sm[2] != "" {
+			params = append(params, sm[2])
+		}
+		if len(params) == 0 {
+			return "$" + sm[0]
+		}
+		return "$" + sm[0] + "(" + strings.Join(params, ",") + ")"
+	case OpenInstrument:
+		return sm[0] + " {"
+	case MapEntry:
+		return sm[0] + ": " + sm[1]
+	case Include:
+		return `include "` + sm[0] + `"`
+	}
+	return tok.Content
+}
+
+func pad(s string, width int) string {
+	if len(s) >= width {
+		return s
+	}
+	return s + strings.Repeat(" ", width-len(s))
+}
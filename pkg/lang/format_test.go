@@ -0,0 +1,120 @@
+package lang
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const unformattedSong = `
+; my song
+tempo 120 ; beats per minute
+psg.hz    60
+title  "My song"   ; quoted
+
+
+; instruments
+$piano:=psg{ pattern: 3 cycle:2 } ; nice
+$riff := C#8 D+8 e-8 O5 V10 R4. N3,2 L8 T100   |   ( a b c )3 [ d |1 e |2 f ]3 g4&g16 a^8
+@ch1 <- $riff $riff(O5,+2) ; first
+   ; middle comment
+        A B C KF+M c++ d= E--
+; before ch2
+
+
+@ch2 <- cde||fga
+--
+LOOP:
+@ch1 <- c
+; final
+`
+
+const formattedSong = `; my song
+tempo  120       ; beats per minute
+psg.hz 60
+title  "My song" ; quoted
+
+; instruments
+$piano := psg {
+    pattern: 3
+    cycle: 2
+} ; nice
+$riff := c#8 d#8 e-8 o5 v10 r4. n3,2 l8 t100 | (a b c)3 [d |1 e |2 f]3 g4&g16 a^8
+@ch1 <- $riff $riff(o5,+2) ; first
+        ; middle comment
+        a b c kf#m c## d= e--
+; before ch2
+
+@ch2 <- c d e || f g a
+--
+loop:
+@ch1 <- c
+; final
+`
+
+func TestFormat(t *testing.T) {
+	out := bytes.Buffer{}
+	require.NoError(t, Format(&out, strings.NewReader(unformattedSong)))
+	assert.Equal(t, formattedSong, out.String())
+
+	// formatting an already formatted song does not change it
+	out.Reset()
+	require.NoError(t, Format(&out, strings.NewReader(formattedSong)))
+	assert.Equal(t, formattedSong, out.String())
+}
+
+func TestFormat_SameSong(t *testing.T) {
+	examples, err := filepath.Glob("../../examples/*.m4l")
+	require.NoError(t, err)
+	require.NotEmpty(t, examples)
+	for _, example := range append(examples, "") {
+		t.Run(example, func(t *testing.T) {
+			src := unformattedSong
+			if example != "" {
+				content, err := os.ReadFile(example)
+				require.NoError(t, err)
+				src = string(content)
+			}
+			out := bytes.Buffer{}
+			require.NoError(t, Format(&out, strings.NewReader(src)))
+			expected, err := Parse(strings.NewReader(src))
+			require.NoError(t, err)
+			actual, err := Parse(&out)
+			require.NoError(t, err)
+			assert.Equal(t, expected.Properties, actual.Properties)
+			assert.Equal(t, len(expected.Blocks), len(actual.Blocks))
+			for b := range expected.Blocks {
+				for name, ch := range expected.Blocks[b].Channels {
+					require.Contains(t, actual.Blocks[b].Channels, name)
+					assert.Equal(t, withoutSources(ch.Items),
+						withoutSources(actual.Blocks[b].Channels[name].Items))
+				}
+			}
+		})
+	}
+}
+
+func TestFormat_SyntaxError(t *testing.T) {
+	err := Format(&bytes.Buffer{}, strings.NewReader("tempo 120\n\nabc\n"))
+	require.IsTypef(t, SyntaxError{}, err, "%#v", err)
+	assert.Equal(t, 3, err.(SyntaxError).t.Row)
+	assert.Equal(t, 1, err.(SyntaxError).t.Col)
+}
+
+func TestFormat_ReadError(t *testing.T) {
+	readErr := errors.New("device not ready")
+	out := bytes.Buffer{}
+	err := Format(&out, io.MultiReader(strings.NewReader("tempo 120\n@ch1 <- a\n"), iotest.ErrReader(readErr)))
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, readErr), "%v", err)
+	// the partially read song is not written
+	assert.Empty(t, out.String())
+}
@@ -4,35 +4,74 @@ import (
 	"bufio"
 	"io"
 	"regexp"
+	"strings"
 )
 
+const includeKeyword = "include"
+
 var ignoreLine = regexp.MustCompile(`^\s*(;.*)?\n?$`)
-var headerProperty = regexp.MustCompile(`^\s*([\w\.]+)\s+([\w\.]+)\s*(;.*)?\n?$`)
+var headerProperty = regexp.MustCompile(`^\s*([\w\.]+)\s+([\w\./#+\-]+|"[^"\n]*")\s*(;.*)?\n?$`)
+
+// HeaderLine is a line of the song header: a property, a comment or an empty line
+type HeaderLine struct {
+	// Key and Value of the property, as written in the source code. Values with spaces are
+	// written between quotes (e.g. title "My song"). Empty if the line does not define a property
+	Key, Value string
+	// Comment of the line, including the leading ';'. Empty if the line has no comment
+	Comment string
+}
 
-// second argument: lines read
-func parseHeader(reader io.ReadSeeker) (map[string]string, int, error) {
+// parseHeader reads the header properties. Since the reader can't go back, it also returns the
+// first line after the header (empty if there are no more lines), as well as the number of lines
+// that have been read, including it.
+func parseHeader(reader *bufio.Reader) (map[string]string, int, string, error) {
+	header, lines, firstLine, err := readHeader(reader)
+	if err != nil {
+		return nil, 0, "", err
+	}
 	props := map[string]string{}
-	lineRead := bufio.NewReader(reader)
+	for _, hl := range header {
+		if hl.Key != "" {
+			props[hl.Key] = strings.Trim(hl.Value, `"`)
+		}
+	}
+	return props, lines, firstLine, nil
+}
+
+// readHeader works as parseHeader, but returning all the lines of the header
+func readHeader(reader *bufio.Reader) ([]HeaderLine, int, string, error) {
+	var header []HeaderLine
 	lines := 0
-	readBytes := 0
 	for {
-		line, err := lineRead.ReadString('\n')
-		if err != nil {
-			return nil, 0, err
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, "", err
 		}
-		lines++
-		readBytes += len(line)
-		if ignoreLine.MatchString(line) {
+		if len(line) > 0 {
+			lines++
+		}
+		if sm := ignoreLine.FindStringSubmatch(line); sm != nil {
+			if len(line) > 0 {
+				header = append(header, HeaderLine{Comment: trimComment(sm[1])})
+			}
+			if err == io.EOF {
+				return header, lines, "", nil
+			}
 			continue
 		}
 		sm := headerProperty.FindStringSubmatch(line)
-		if sm == nil {
-			// no submatch, we assume end of the header zone so we rewind to the beginning of the line
-			if _, err := reader.Seek(int64(readBytes-len(line)), io.SeekStart); err != nil {
-				return nil, 0, err
-			}
-			return props, lines - 1, nil
+		// include statements look like properties with a quoted value
+		if sm == nil || sm[1] == includeKeyword {
+			// no submatch, we assume end of the header zone
+			return header, lines, line, nil
+		}
+		header = append(header, HeaderLine{Key: sm[1], Value: sm[2], Comment: trimComment(sm[3])})
+		if err == io.EOF {
+			return header, lines, "", nil
 		}
-		props[sm[1]] = sm[2]
 	}
 }
+
+func trimComment(comment string) string {
+	return strings.TrimRight(comment, " \t\r\n")
+}
@@ -1,6 +1,7 @@
 package lang
 
 import (
+	"io"
 	"strings"
 	"testing"
 
@@ -26,6 +27,18 @@ tempo 120     ; this should be ignored
 	require.Len(t, s.Blocks[0].Channels["ch1"].Items, 3)
 }
 
+func TestParseWithHeader_QuotedValues(t *testing.T) {
+	s, err := Parse(strings.NewReader(`title "Dance of the #1 knights" ; Prokofiev
+author ""
+@ch1 <- abc
+`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"title":  "Dance of the #1 knights",
+		"author": "",
+	}, s.Properties)
+}
+
 func TestParseWithHeader_Tokenizer_Position_Ok(t *testing.T) {
 	_, err := Parse(strings.NewReader(`
 ; some comments here
@@ -35,7 +48,51 @@ tempo 120     ; this should be ignored
 ; should show an error here
 @ch1 <- tracatraca
 `))
+	err = firstError(t, err)
 	assert.IsType(t, SyntaxError{}, err)
 	assert.Equal(t, err.(SyntaxError).t.Col, 9)
 	assert.Equal(t, err.(SyntaxError).t.Row, 7)
 }
+
+// onlyReader hides any other interface than io.Reader from the wrapped reader
+type onlyReader struct {
+	io.Reader
+}
+
+func TestParseWithHeader_NonSeekableReader(t *testing.T) {
+	s, err := Parse(onlyReader{strings.NewReader(`psg.hz 60
+tempo 120
+@ch1 <- abc
+@ch2 <- de`)})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"psg.hz": "60",
+		"tempo":  "120",
+	}, s.Properties)
+	require.Len(t, s.Blocks, 1)
+	assert.Len(t, s.Blocks[0].Channels["ch1"].Items, 3)
+	// the last line is parsed even if it does not finish with a newline
+	assert.Len(t, s.Blocks[0].Channels["ch2"].Items, 2)
+}
+
+func TestParseWithHeader_NonSeekableReader_Position(t *testing.T) {
+	_, err := Parse(onlyReader{strings.NewReader(`psg.hz 60
+
+@ch1 <- abc
+@ch1 <- tracatraca`)})
+	err = firstError(t, err)
+	require.IsType(t, SyntaxError{}, err)
+	assert.Equal(t, 9, err.(SyntaxError).t.Col)
+	assert.Equal(t, 4, err.(SyntaxError).t.Row)
+}
+
+func TestParseWithHeader_OnlyHeader(t *testing.T) {
+	s, err := Parse(onlyReader{strings.NewReader("psg.hz 60\ntempo 120")})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"psg.hz": "60",
+		"tempo":  "120",
+	}, s.Properties)
+	require.Len(t, s.Blocks, 1)
+	assert.Empty(t, s.Blocks[0].Channels)
+}
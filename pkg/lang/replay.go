@@ -0,0 +1,62 @@
+package lang
+
+// tokenSource provides the tokens to the parser
+type tokenSource interface {
+	Next() bool
+	Get() Token
+	EOF() bool
+	// position of the last read token
+	pos() (file string, row, col int)
+}
+
+func (t *Tokenizer) pos() (string, int, int) {
+	return t.file, t.row, t.col
+}
+
+// tokenRecorder stores all the tokens that are read from the underlying source
+type tokenRecorder struct {
+	tokenSource
+	tokens []Token
+}
+
+func (r *tokenRecorder) Next() bool {
+	if !r.tokenSource.Next() {
+		return false
+	}
+	r.tokens = append(r.tokens, r.tokenSource.Get())
+	return true
+}
+
+// tokenReplay reads again a set of previously recorded tokens
+type tokenReplay struct {
+	tokens []Token
+	cur    int
+}
+
+func newTokenReplay(tokens []Token) *tokenReplay {
+	return &tokenReplay{tokens: tokens, cur: -1}
+}
+
+func (r *tokenReplay) Next() bool {
+	if r.EOF() {
+		return false
+	}
+	r.cur++
+	return !r.EOF()
+}
+
+func (r *tokenReplay) Get() Token {
+	return r.tokens[r.cur]
+}
+
+func (r *tokenReplay) EOF() bool {
+	return r.cur >= len(r.tokens)
+}
+
+func (r *tokenReplay) pos() (string, int, int) {
+	if len(r.tokens) == 0 {
+		return "", 0, 0
+	}
+	last := r.tokens[len(r.tokens)-1]
+	return last.File, last.Row, last.Col
+}
@@ -0,0 +1,67 @@
+package lang
+
+import (
+	"sort"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const timingOverflowMsg = "the exact time of the song overflows. There are too many different tuplets"
+
+// checkTiming returns an error if the time of the items of the song can't be exactly represented
+// (e.g. after many tuplets with different ratios), since the exporters couldn't place them. The
+// channels of each synced block start at the end of the longest channel of the previous block.
+// Only the first item whose time overflows is reported, since the time of the following items
+// overflows too
+func checkTiming(s *song.Song) ErrorList {
+	constants := make([]string, 0, len(s.Constants))
+	for name := range s.Constants {
+		constants = append(constants, name)
+	}
+	sort.Strings(constants)
+	for _, name := range constants {
+		if _, ti := timeAfter(song.Duration{}, s.Constants[name]); ti != nil {
+			return ErrorList{timingError(ti)}
+		}
+	}
+	start := song.Duration{}
+	for b := range s.Blocks {
+		names := make([]string, 0, len(s.Blocks[b].Channels))
+		for name := range s.Blocks[b].Channels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		end := start
+		for _, name := range names {
+			t, ti := timeAfter(start, s.Blocks[b].Channels[name].Items)
+			if ti != nil {
+				return ErrorList{timingError(ti)}
+			}
+			if end.Less(t) {
+				end = t
+			}
+		}
+		start = end
+	}
+	return nil
+}
+
+// timeAfter returns the time after playing the items from the given start. If it overflows, it
+// also returns the item that caused it
+func timeAfter(start song.Duration, items song.Tablature) (song.Duration, *song.TablatureItem) {
+	t := start
+	for i := range items {
+		if t = t.Add(items[i].DurationBeats()); t.Overflow() {
+			return t, &items[i]
+		}
+	}
+	return t, nil
+}
+
+func timingError(ti *song.TablatureItem) Diagnostic {
+	d := Diagnostic{Severity: SeverityError, Message: timingOverflowMsg}
+	if ti.Source != nil {
+		d.Position = ti.Source.Position
+	}
+	return d
+}
@@ -0,0 +1,45 @@
+package lang
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the tuplets below have coprime ratios, so the exact time of the channel needs a denominator
+// that is the product of all of them
+const primeTuplets = "(c)3 (c)5 (c)7 (c)11 (c)13 (c)17 (c)19 (c)23 (c)29 (c)31 (c)37 (c)41 (c)43 " +
+	"(c)47 (c)53 (c)59 (c)61"
+
+func TestCheckTiming(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		src  string
+		pos  string
+	}{
+		{name: "channel", src: "@ch1 <- " + primeTuplets + " c\n", pos: "1:91"},
+		// the time of each channel starts at the end of the previous synced block
+		{name: "synced blocks", src: "@ch1 <- (c)3 (c)5 (c)7 (c)11 (c)13\n@ch2 <- (c)17 (c)19\n" +
+			"-----\n@ch1 <- (c)23 (c)29 (c)31 (c)37 (c)41 (c)43 (c)47 (c)53 (c)59 (c)61 c\n",
+			pos: "4:58"},
+		{name: "unused constant", src: "$x := " + primeTuplets + " c\n@ch1 <- c\n", pos: "1:89"},
+		{name: "repeat", src: "@ch1 <- c [" + primeTuplets + "]\n", pos: "1:11"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse(strings.NewReader(tc.src))
+			require.Error(t, err)
+			errs := err.(ErrorList)
+			require.Len(t, errs, 1)
+			assert.Equal(t, tc.pos+" - "+timingOverflowMsg, errs[0].Error())
+		})
+	}
+}
+
+func TestCheckTiming_Fits(t *testing.T) {
+	// the same tuplets many times don't make the denominator grow
+	_, err := Parse(strings.NewReader("@ch1 <- [(c)3 (c)5 (c)7 (c)11 (c)13 (c)17]99\n" +
+		"@ch2 <- [(c)19 (c)23 (c)29 (c)31]99\n-----\n@ch1 <- [(c d e)3]99\n"))
+	assert.NoError(t, err)
+}
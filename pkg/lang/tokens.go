@@ -22,18 +22,30 @@ const (
 	CloseTuple
 	CloseInstrument
 	MapEntry
+	OpenRepeat
+	CloseRepeat
+	RepeatEnding
 	Separator
+	Tie
+	TieLength
 	ConstDef
 	ConstRef
 	Assign
 	ChannelId
 	ChannelSync
+	Include
+	// Comment tokens are only returned by the tokenizers that keep the comments
+	Comment
 	// Tablature stuff needs to go at the bottom, to not get confusion with other language grammar items
 	Note
 	Volume
 	Silence
+	Noise
+	Tempo
+	DefaultLength
 	Octave
 	OctaveStep
+	Key
 	Number
 	// NoMatch must be the last token
 	NoMatch
@@ -61,20 +73,42 @@ func (t TokenType) String() string {
 		return "CloseTuple"
 	case MapEntry:
 		return "MapEntry"
+	case OpenRepeat:
+		return "OpenRepeat"
+	case CloseRepeat:
+		return "CloseRepeat"
+	case RepeatEnding:
+		return "RepeatEnding"
 	case Separator:
 		return "Separator"
+	case Tie:
+		return "Tie"
+	case TieLength:
+		return "TieLength"
 	case ChannelSync:
 		return "ChannelSync"
+	case Include:
+		return "Include"
+	case Comment:
+		return "Comment"
 	case Note:
 		return "Note"
 	case Volume:
 		return "Volume"
 	case Silence:
 		return "Silence"
+	case Noise:
+		return "Noise"
+	case Tempo:
+		return "Tempo"
+	case DefaultLength:
+		return "DefaultLength"
 	case Octave:
 		return "Octave"
 	case OctaveStep:
 		return "OctaveStep"
+	case Key:
+		return "Key"
 	case Number:
 		return "Number"
 	case ChannelId:
@@ -90,33 +124,52 @@ var tokenDefs = map[TokenType]*regexp.Regexp{
 	SendArrow:       regexp.MustCompile(`^<-$`),
 	LoopTag:         regexp.MustCompile(`^[Ll][Oo][Oo][Pp]\s*:$`),
 	OpenTuple:       regexp.MustCompile(`^\($`),
-	CloseTuple:      regexp.MustCompile(`^\)(\d)+$`),
+	CloseTuple:      regexp.MustCompile(`^\)(\d+)(?::(\d+))?$`),
 	CloseInstrument: regexp.MustCompile(`^}$`),
 	MapEntry:        regexp.MustCompile(`^(\w+)\s*:\s*(\w*)$`),
+	OpenRepeat:      regexp.MustCompile(`^\[$`),
+	CloseRepeat:     regexp.MustCompile(`^](\d*)$`),
+	RepeatEnding:    regexp.MustCompile(`^\|(\d+)$`),
 	Separator:       regexp.MustCompile(`^\|+$`),
+	Tie:             regexp.MustCompile(`^&$`),
+	TieLength:       regexp.MustCompile(`^\^(\d+)(\.*)$`),
 	ConstDef:        regexp.MustCompile(`^\$(\w+)\s*:=$`),
-	ConstRef:        regexp.MustCompile(`^\$(\w+)$`),
+	ConstRef:        regexp.MustCompile(`^\$(\w+)(?:\((?:[Oo](\d))?,?([+\-]\d+)?\))?$`),
 	Assign:          regexp.MustCompile(`^:=$`),
 	ChannelId:       regexp.MustCompile(`^@(\w+)$`),
 	ChannelSync:     regexp.MustCompile(`^-{2,}$`),
+	Include:         regexp.MustCompile(`^include\s+"([^"]+)"$`),
+	Comment:         regexp.MustCompile(`^;.*$`),
 	// Tablature stuff needs to go at the bottom, to not get confusion with other language grammar items
-	Note:       regexp.MustCompile(`^([a-gA-G])([#+\-]?)(\d*)(\.*)$`),
-	Volume:     regexp.MustCompile(`^[Vv](\d*)$`),
-	Silence:    regexp.MustCompile(`^[Rr](\d*)$`),
-	Octave:     regexp.MustCompile(`^[Oo](\d)$`),
-	OctaveStep: regexp.MustCompile(`^(<|>)$`),
-	Number:     regexp.MustCompile(`^(\d+)$`),
+	Note:          regexp.MustCompile(`^([a-gA-G])(##|\+\+|--|[#+\-=]?)(\d*)(\.*)$`),
+	Volume:        regexp.MustCompile(`^[Vv](\d*)$`),
+	Silence:       regexp.MustCompile(`^[Rr](\d*)(\.*)$`),
+	Noise:         regexp.MustCompile(`^[Nn](\d+)(?:,(\d+))?(\.*)$`),
+	Tempo:         regexp.MustCompile(`^[Tt](\d+)$`),
+	DefaultLength: regexp.MustCompile(`^[Ll](\d+)(\.*)$`),
+	Octave:        regexp.MustCompile(`^[Oo](\d)$`),
+	OctaveStep:    regexp.MustCompile(`^(<|>)$`),
+	Key:           regexp.MustCompile(`^[Kk]([a-gA-G][#+\-]?[mM]?)$`),
+	Number:        regexp.MustCompile(`^(\d+)$`),
 }
 
 const commentSymbol = ';'
 
 type Tokenizer struct {
+	// name of the tokenized file. Empty if the input is not a file
+	file      string
 	row       int
 	col       int
 	input     *bufio.Reader
 	lineRest  string //line that is being currently parsed
 	lastMatch string
 	tokens    *regexp.Regexp
+	// eof is true when there are no more tokens to get
+	eof bool
+	// keepComments returns the comments as tokens instead of ignoring them
+	keepComments bool
+	// err is the error that stopped reading the input, excepting io.EOF
+	err error
 }
 
 func NewTokenizer(input io.Reader, startRow int) *Tokenizer {
@@ -127,6 +180,18 @@ func NewTokenizer(input io.Reader, startRow int) *Tokenizer {
 	}
 }
 
+// newBodyTokenizer continues tokenizing an input whose header has been already read.
+// The firstLine is the line that was read after the header, and row is its number.
+func newBodyTokenizer(input *bufio.Reader, firstLine string, row int) *Tokenizer {
+	return &Tokenizer{
+		input:    input,
+		tokens:   mergeAllTokens(),
+		row:      row,
+		col:      1,
+		lineRest: firstLine,
+	}
+}
+
 func mergeAllTokens() *regexp.Regexp {
 	tokens := make([]TokenType, NoMatch)
 	for i := 0; i < len(tokens); i++ {
@@ -146,7 +211,7 @@ func mergeAllTokens() *regexp.Regexp {
 // todo: ignore comments
 func (t *Tokenizer) Next() bool {
 	t.col += len(t.lastMatch)
-	for !t.EOF() {
+	for len(t.lineRest) > 0 || t.input != nil {
 		// trimming leading spaces
 		i := 0
 		for i < len(t.lineRest) && (t.lineRest[i] == ' ' || t.lineRest[i] == '\t') {
@@ -155,6 +220,11 @@ func (t *Tokenizer) Next() bool {
 		t.col += i
 		t.lineRest = t.lineRest[i:]
 
+		if len(t.lineRest) > 0 && t.lineRest[0] == commentSymbol && t.keepComments {
+			t.lastMatch = strings.TrimRight(t.lineRest, " \t\r\n")
+			t.lineRest = ""
+			return true
+		}
 		// ignore the line as soon as we find a comment symbol
 		if len(t.lineRest) == 0 || t.lineRest[0] == commentSymbol {
 			t.readMoreLines()
@@ -168,27 +238,43 @@ func (t *Tokenizer) Next() bool {
 		}
 		t.readMoreLines()
 	}
+	t.eof = true
 	return false
 }
 
 func (t *Tokenizer) readMoreLines() {
 	var err error
 	t.lastMatch = ""
+	if t.input == nil {
+		t.lineRest = ""
+		return
+	}
 	t.lineRest, err = t.input.ReadString('\n')
 	if err != nil {
-		if err == io.EOF {
-			t.input = nil
-			t.lineRest = ""
+		if err != io.EOF {
+			// the tokens finish here, and the error is reported by Err
+			t.err = fmt.Errorf("can't read line %d: %w", t.row+1, err)
+			t.input, t.lineRest = nil, ""
+			return
+		}
+		// the last line might not finish with a newline
+		t.input = nil
+		if len(t.lineRest) == 0 {
 			return
 		}
-		panic(fmt.Errorf("can't read next line: %w", err))
 	}
 	t.col = 1
 	t.row++
 }
 
 func (t *Tokenizer) EOF() bool {
-	return len(t.lineRest) == 0 && t.input == nil
+	return t.eof
+}
+
+// Err returns the error that stopped reading the input before its end. Nil if the input
+// was read until the end
+func (t *Tokenizer) Err() error {
+	return t.err
 }
 
 // Get a token from a token type, if len(tokens) == 0, it searches across all the tokens
@@ -202,19 +288,25 @@ type Token struct {
 	Content string
 	// TODO: replace inline indexing by typesafe functions
 	Submatch []string
+	// File is empty if the token was not read from a file
+	File     string
 	Row, Col int
 }
 
+func (t *Token) position() song.Position {
+	return song.Position{File: t.File, Row: t.Row, Col: t.Col}
+}
+
 // if len(tokens) == 0, it searches across all the tokens
 func (t *Tokenizer) parseToken(token string) Token {
 	for tt := TokenType(0); tt < NoMatch; tt++ {
 		td := tokenDefs[tt]
 		submatches := td.FindStringSubmatch(token)
 		if submatches != nil {
-			return Token{Type: tt, Content: token, Submatch: submatches[1:], Row: t.row, Col: t.col}
+			return Token{Type: tt, Content: token, Submatch: submatches[1:], File: t.file, Row: t.row, Col: t.col}
 		}
 	}
-	return Token{Type: NoMatch, Content: token, Row: t.row, Col: t.col}
+	return Token{Type: NoMatch, Content: token, File: t.file, Row: t.row, Col: t.col}
 }
 
 func (f *Token) assertType(expected TokenType) {
@@ -233,9 +325,44 @@ func (f *Token) getConstRefId() string {
 	return f.Submatch[0]
 }
 
-func (f *Token) getTupletNumber() int {
+// getConstRefParams returns the start octave (nil if not set) and the semitones transposition of
+// a constant reference. e.g. $riff(o5,+7)
+func (f *Token) getConstRefParams() (*int, int, error) {
+	f.assertType(ConstRef)
+	var octave *int
+	if len(f.Submatch[1]) > 0 {
+		o := mustAtoi(f.Submatch[1])
+		octave = &o
+	}
+	semitones := 0
+	if len(f.Submatch[2]) > 0 {
+		var err error
+		semitones, err = atoiRange("transposition", f.Submatch[2], -maxTransposition, maxTransposition)
+		if err != nil {
+			return octave, semitones, err
+		}
+	}
+	return octave, semitones, nil
+}
+
+// getTuplet returns the n:m ratio of a tuplet. If m is not specified, the n notes are played in
+// the time of the nearest lower power of two (e.g. 3:2, 5:4, 6:4, 7:4, 9:8, 2:1)
+func (f *Token) getTuplet() (song.Tuplet, error) {
 	f.assertType(CloseTuple)
-	return mustAtoi(f.Submatch[0])
+	tu := song.Tuplet{}
+	var err error
+	if tu.Notes, err = atoiRange("tuplet notes", f.Submatch[0], minTupletNotes, maxTupletNotes); err != nil {
+		return tu, err
+	}
+	if len(f.Submatch[1]) > 0 {
+		tu.Span, err = atoiRange("tuplet span", f.Submatch[1], 1, maxTupletNotes)
+		return tu, err
+	}
+	tu.Span = 1
+	for tu.Span*2 < tu.Notes {
+		tu.Span *= 2
+	}
+	return tu, nil
 }
 
 func mustAtoi(num string) int {
@@ -246,6 +373,16 @@ func mustAtoi(num string) int {
 	return n
 }
 
+// atoiRange parses a number that must be in the min to max range. The numbers that are too big
+// to be parsed are also reported as out of range
+func atoiRange(item, num string, min, max int) (int, error) {
+	n, err := strconv.Atoi(num)
+	if err != nil || n < min || n > max {
+		return n, fmt.Errorf("wrong %s: %s. Must be in range %d to %d", item, num, min, max)
+	}
+	return n, nil
+}
+
 func (f *Token) getOctaveStep() int {
 	f.assertType(OctaveStep)
 	switch f.Content[0] {
@@ -262,8 +399,9 @@ var pitches = [8]song.Pitch{song.A, song.B, song.C, song.D, song.E, song.F, song
 
 // A note should come represented by an array where
 // 0: pitch - 1: halftone - 2: length - 3: dots
-// todo: return t, error if a given note can't be sharp or flat
-func (f *Token) getNote() (song.Note, error) {
+// If the length is not specified, the note takes the default length and dots.
+// If the halftone is not specified, the note takes the halftone of the key signature.
+func (f *Token) getNote(def noteLength, key song.KeySignature) (song.Note, error) {
 	f.assertType(Note)
 
 	var pitch song.Pitch
@@ -278,17 +416,24 @@ func (f *Token) getNote() (song.Note, error) {
 
 	n := song.Note{
 		Pitch:    pitch,
-		Length:   defaultLength,
-		Halftone: song.NoHalftone,
-		Dots:     len(f.Submatch[3]),
+		Length:   def.length,
+		Halftone: key.Halftone(pitch),
+		Dots:     def.dots + len(f.Submatch[3]),
 	}
 	// get halftone
 	if len(f.Submatch[1]) > 0 {
-		switch f.Submatch[1][0] {
-		case '+', '#':
+		switch f.Submatch[1] {
+		case "+", "#":
 			n.Halftone = song.Sharp
-		case '-':
+		case "-":
 			n.Halftone = song.Flat
+		case "++", "##":
+			n.Halftone = song.DoubleSharp
+		case "--":
+			n.Halftone = song.DoubleFlat
+		case "=":
+			// natural sign overrides the key signature
+			n.Halftone = song.NoHalftone
 		default:
 			panic(fmt.Sprintf("BUG detected. Wrong halftone %q", f.Submatch[1]))
 		}
@@ -296,18 +441,14 @@ func (f *Token) getNote() (song.Note, error) {
 
 	// get Length
 	if len(f.Submatch[2]) > 0 {
-		l, err := strconv.Atoi(f.Submatch[2])
+		l, err := atoiRange("note length", f.Submatch[2], minLength, maxLength)
 		if err != nil {
-			panic(fmt.Sprintf("BUG detected. Wrong length for note: %#v. Err: %s",
-				f, err.Error()))
-		}
-		if l < minLength || l > maxLength {
-			return n, fmt.Errorf(
-				"wrong note length: %d. Must be in range %d to %d", l, minLength, maxLength)
+			return n, err
 		}
 		n.Length = l
+		n.Dots = len(f.Submatch[3])
 	}
-	return n, nil
+	return n, checkDots("note", n.Dots)
 }
 
 func (token *Token) getOctave() int {
@@ -315,20 +456,108 @@ func (token *Token) getOctave() int {
 	return mustAtoi(token.Submatch[0])
 }
 
-func (token *Token) getVolume() int {
+func (token *Token) getRepeatTimes() (int, error) {
+	token.assertType(CloseRepeat)
+	if len(token.Submatch[0]) == 0 {
+		return defaultRepeatTimes, nil
+	}
+	return atoiRange("repeat times", token.Submatch[0], 1, maxRepeatTimes)
+}
+
+func (token *Token) getRepeatEnding() int {
+	token.assertType(RepeatEnding)
+	n, err := strconv.Atoi(token.Submatch[0])
+	if err != nil {
+		// a number that overflows is never the expected ending number
+		return 0
+	}
+	return n
+}
+
+func (token *Token) getTempo() (int, error) {
+	token.assertType(Tempo)
+	return atoiRange("tempo", token.Submatch[0], minTempo, maxTempo)
+}
+
+func (token *Token) getKey() (song.KeySignature, error) {
+	token.assertType(Key)
+	return song.ParseKeySignature(token.Submatch[0])
+}
+
+func (token *Token) getVolume() (int, error) {
 	token.assertType(Volume)
-	return mustAtoi(token.Submatch[0])
+	n, err := strconv.Atoi(token.Submatch[0])
+	if err != nil || n > maxVolume {
+		return n, fmt.Errorf("max volume is 16 (was: %s)", token.Submatch[0])
+	}
+	return n, nil
 }
 
-func (token *Token) getSilence() song.Silence {
+func (token *Token) getSilence(def noteLength) (song.Silence, error) {
 	token.assertType(Silence)
 	n := song.Silence{}
 	if len(token.Submatch[0]) == 0 {
-		n.Length = defaultLength
-		return n
+		n.Length = def.length
+		n.Dots = def.dots + len(token.Submatch[1])
+		return n, checkDots("silence", n.Dots)
 	}
-	n.Length = mustAtoi(token.Submatch[0])
-	return n
+	n.Dots = len(token.Submatch[1])
+	var err error
+	if n.Length, err = atoiRange("silence length", token.Submatch[0], minLength, maxLength); err != nil {
+		return n, err
+	}
+	return n, checkDots("silence", n.Dots)
+}
+
+// A noise should come represented by an array where
+// 0: period - 1: length - 2: dots
+func (token *Token) getNoise(def noteLength) (song.Noise, error) {
+	token.assertType(Noise)
+	n := song.Noise{
+		Length: def.length,
+		Dots:   def.dots + len(token.Submatch[2]),
+	}
+	var err error
+	if n.Period, err = atoiRange("noise period", token.Submatch[0], 0, maxNoisePeriod); err != nil {
+		return n, err
+	}
+	if len(token.Submatch[1]) > 0 {
+		l, err := atoiRange("noise length", token.Submatch[1], minLength, maxLength)
+		if err != nil {
+			return n, err
+		}
+		n.Length = l
+		n.Dots = len(token.Submatch[2])
+	}
+	return n, checkDots("noise", n.Dots)
+}
+
+func (token *Token) getTieLength() (song.Tie, error) {
+	token.assertType(TieLength)
+	t := song.Tie{Dots: len(token.Submatch[1])}
+	var err error
+	if t.Length, err = atoiRange("tie length", token.Submatch[0], minLength, maxLength); err != nil {
+		return t, err
+	}
+	return t, checkDots("tie", t.Dots)
+}
+
+func (token *Token) getDefaultLength() (noteLength, error) {
+	token.assertType(DefaultLength)
+	l := noteLength{dots: len(token.Submatch[1])}
+	var err error
+	if l.length, err = atoiRange("default length", token.Submatch[0], minLength, maxLength); err != nil {
+		return l, err
+	}
+	return l, checkDots("default length", l.dots)
+}
+
+// checkDots verifies the dots of a length, including the dots of the default length
+func checkDots(item string, dots int) error {
+	if dots > maxDots {
+		return fmt.Errorf("too many dots for a %s: %d. The maximum is %d", item, dots, maxDots)
+	}
+	return nil
 }
 
 func (tok *Token) getInstrumentClass() string {
@@ -341,6 +570,11 @@ func (tok *Token) getMapKeyValue() (string, string) {
 	return tok.Submatch[0], tok.Submatch[1]
 }
 
+func (t *Token) getIncludePath() string {
+	t.assertType(Include)
+	return t.Submatch[0]
+}
+
 func (t *Token) getChannelId() string {
 	t.assertType(ChannelId)
 	return t.Submatch[0]
@@ -2,7 +2,11 @@ package lang
 
 import (
 	"bytes"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/stretchr/testify/require"
 
@@ -67,7 +71,7 @@ func TestTokenizer_TwoChannels(t *testing.T) {
 	assert.Equal(t, n("c", 6, 8), next())
 	assert.Equal(t, n("d", 6, 9), next())
 	assert.Equal(t, n("e", 6, 10), next())
-	assert.Equal(t, Token{Type: CloseTuple, Submatch: []string{"3"}, Content: `)3`, Row: 6, Col: 11}, next())
+	assert.Equal(t, Token{Type: CloseTuple, Submatch: []string{"3", ""}, Content: `)3`, Row: 6, Col: 11}, next())
 	assert.Equal(t, Token{Type: Note, Content: "e-3..", Submatch: []string{"e", "-", "3", ".."}, Row: 6, Col: 13}, next())
 	assert.Equal(t, Token{Type: Separator, Submatch: []string{}, Content: `|`, Row: 6, Col: 19}, next())
 	assert.Equal(t, n("a", 6, 21), next())
@@ -108,9 +112,9 @@ loop:
 	assert.Equal(t, Token{Type: Note, Content: "b-4..", Submatch: []string{"b", "-", "4", ".."}, Row: 6, Col: 12}, next())
 	assert.Equal(t, Token{Type: ChannelId, Content: "@ch1", Submatch: []string{"ch1"}, Row: 8, Col: 1}, next())
 	assert.Equal(t, Token{Type: SendArrow, Content: "<-", Submatch: []string{}, Row: 8, Col: 6}, next())
-	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro"}, Row: 8, Col: 9}, next())
-	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro"}, Row: 8, Col: 15}, next())
-	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro"}, Row: 8, Col: 21}, next())
+	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro", "", ""}, Row: 8, Col: 9}, next())
+	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro", "", ""}, Row: 8, Col: 15}, next())
+	assert.Equal(t, Token{Type: ConstRef, Content: "$intro", Submatch: []string{"intro", "", ""}, Row: 8, Col: 21}, next())
 	assert.Equal(t, Token{Type: LoopTag, Content: "loop:", Submatch: []string{}, Row: 9, Col: 1}, next())
 	assert.Equal(t, Token{Type: ChannelId, Content: "@ch1", Submatch: []string{"ch1"}, Row: 10, Col: 1}, next())
 	assert.Equal(t, Token{Type: SendArrow, Content: "<-", Submatch: []string{}, Row: 10, Col: 6}, next())
@@ -123,3 +127,32 @@ loop:
 
 	assert.False(t, tok.Next())
 }
+
+func TestTokenizer_Noise(t *testing.T) {
+	tok := NewTokenizer(bytes.NewReader([]byte("@drums <- n12 N3,8. n0,16\n")), 0)
+	next := func() Token {
+		require.True(t, tok.Next())
+		return tok.Get()
+	}
+	assert.Equal(t, Token{Type: ChannelId, Content: "@drums", Submatch: []string{"drums"}, Row: 1, Col: 1}, next())
+	assert.Equal(t, Token{Type: SendArrow, Content: "<-", Submatch: []string{}, Row: 1, Col: 8}, next())
+	assert.Equal(t, Token{Type: Noise, Content: "n12", Submatch: []string{"12", "", ""}, Row: 1, Col: 11}, next())
+	assert.Equal(t, Token{Type: Noise, Content: "N3,8.", Submatch: []string{"3", "8", "."}, Row: 1, Col: 15}, next())
+	assert.Equal(t, Token{Type: Noise, Content: "n0,16", Submatch: []string{"0", "16", ""}, Row: 1, Col: 21}, next())
+	assert.False(t, tok.Next())
+}
+
+func TestTokenizer_ReadError(t *testing.T) {
+	readErr := errors.New("device not ready")
+	input := io.MultiReader(strings.NewReader("@ch1 <- a\n"), iotest.ErrReader(readErr))
+	tok := NewTokenizer(input, 0)
+	var tokens []string
+	for tok.Next() {
+		tokens = append(tokens, tok.Get().Content)
+	}
+	assert.Equal(t, []string{"@ch1", "<-", "a"}, tokens)
+	assert.True(t, tok.EOF())
+	require.Error(t, tok.Err())
+	assert.True(t, errors.Is(tok.Err(), readErr))
+	assert.Contains(t, tok.Err().Error(), "can't read line 2")
+}
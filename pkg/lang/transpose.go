@@ -0,0 +1,192 @@
+package lang
+
+import (
+	"fmt"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const (
+	// range of octaves where the transposed notes can be placed, according to the frequencies
+	// that are supported by the PSG
+	minTransposedOctave = 1
+	maxTransposedOctave = 8
+	// any transposition that is longer than the range of octaves moves the notes out of range
+	maxTransposition = song.SemitonesPerOctave * (maxTransposedOctave - minTransposedOctave)
+)
+
+// transpose returns a copy of the tablature with all the notes transposed by the given semitones.
+// Since the octave of the tablature is relative to the place where it is inserted, the notes that
+// are shifted to another octave are surrounded by octave steps, and the tablature finishes in the
+// same octave as the original.
+func transpose(t song.Tablature, semitones int) song.Tablature {
+	if semitones == 0 {
+		return t
+	}
+	tr := make(song.Tablature, 0, len(t))
+	// number of octaves that the transposed tablature is shifted with respect to the original
+	shift := 0
+	stepTo := func(octaves int) {
+		if octaves != shift {
+			step := octaves - shift
+			tr = append(tr, song.TablatureItem{OctaveStep: &step})
+			shift = octaves
+		}
+	}
+	for _, ti := range t {
+		switch {
+		case ti.Note != nil:
+			n, octaves := ti.Note.Transposed(semitones)
+			stepTo(octaves)
+			tr = append(tr, song.TablatureItem{Note: &n, Source: ti.Source})
+		case ti.SetOctave != nil:
+			tr = append(tr, ti)
+			shift = 0
+		case ti.Repeat != nil:
+			// each repetition must start and finish in the same octave
+			stepTo(0)
+			rp := *ti.Repeat
+			rp.Items = transpose(rp.Items, semitones)
+			rp.Endings = make([]song.Tablature, 0, len(ti.Repeat.Endings))
+			for _, e := range ti.Repeat.Endings {
+				rp.Endings = append(rp.Endings, transpose(e, semitones))
+			}
+			tr = append(tr, song.TablatureItem{Repeat: &rp, Source: ti.Source})
+		default:
+			tr = append(tr, ti)
+		}
+	}
+	stepTo(0)
+	return tr
+}
+
+// checkOctaveRange verifies that all the notes of the tablature are within the range of the
+// transposable octaves, given the octave at the start of the tablature
+func checkOctaveRange(t song.Tablature, octave int) error {
+	_, err := checkOctaves(t, octave)
+	return err
+}
+
+// checkOctaves verifies the range of the notes of the tablature and returns the octave after
+// playing it. The repeats are not unrolled: the repetitions that play the same items shift the
+// octave by the same amount, so only the first and the last of them need to be verified
+func checkOctaves(t song.Tablature, octave int) (int, error) {
+	var err error
+	for _, ti := range t {
+		switch {
+		case ti.SetOctave != nil:
+			octave = *ti.SetOctave
+		case ti.OctaveStep != nil:
+			octave += *ti.OctaveStep
+		case ti.Note != nil:
+			if octave < minTransposedOctave || octave > maxTransposedOctave {
+				return octave, fmt.Errorf("transposed note %c%s is out of range (octave %d)",
+					ti.Note.Pitch, ti.Note.Halftone, octave)
+			}
+		case ti.Repeat != nil:
+			if octave, err = checkRepeatOctaves(ti.Repeat, octave); err != nil {
+				return octave, err
+			}
+		}
+	}
+	return octave, nil
+}
+
+func checkRepeatOctaves(rp *song.Repeat, octave int) (int, error) {
+	pass := func(r, octave int) (int, error) {
+		octave, err := checkOctaves(rp.Items, octave)
+		if err != nil {
+			return octave, err
+		}
+		return checkOctaves(rp.Ending(r), octave)
+	}
+	// repetitions with their own ending
+	r := 0
+	var err error
+	for ; r < len(rp.Endings)-1; r++ {
+		if octave, err = pass(r, octave); err != nil {
+			return octave, err
+		}
+	}
+	// the rest of the repetitions play the same items and the last ending, starting from the
+	// first octave to the last one
+	first := octave
+	change := repetitionChange(rp, r)
+	last := change.times(rp.Times - r - 1).apply(first)
+	if octave, err = pass(r, first); err != nil || last == first {
+		return octave, err
+	}
+	if octave, err = pass(r, last); err != nil {
+		// reporting the first repetition that is out of range
+		for n := 1; ; n++ {
+			if _, err := pass(r, change.times(n).apply(first)); err != nil {
+				return octave, err
+			}
+		}
+	}
+	return octave, nil
+}
+
+// octaveAfter returns the octave after playing the tablature from the given octave
+func octaveAfter(t song.Tablature, octave int) int {
+	return octaveChangeOf(t).apply(octave)
+}
+
+// octaveChange is the change of octave after playing a tablature: an absolute octave, if the
+// tablature sets the octave, or a number of octaves that are relative to the start octave
+type octaveChange struct {
+	absolute bool
+	octaves  int
+}
+
+func octaveChangeOf(t song.Tablature) octaveChange {
+	oc := octaveChange{}
+	for _, ti := range t {
+		switch {
+		case ti.SetOctave != nil:
+			oc = octaveChange{absolute: true, octaves: *ti.SetOctave}
+		case ti.OctaveStep != nil:
+			oc.octaves += *ti.OctaveStep
+		case ti.Repeat != nil:
+			rp := ti.Repeat
+			r := 0
+			for ; r < len(rp.Endings)-1; r++ {
+				oc = oc.then(repetitionChange(rp, r))
+			}
+			oc = oc.then(repetitionChange(rp, r).times(rp.Times - r))
+		}
+	}
+	return oc
+}
+
+// repetitionChange returns the change of octave of the given repetition of a repeat
+func repetitionChange(rp *song.Repeat, r int) octaveChange {
+	return octaveChangeOf(rp.Items).then(octaveChangeOf(rp.Ending(r)))
+}
+
+// then returns the change of playing this change and the next one
+func (oc octaveChange) then(next octaveChange) octaveChange {
+	if next.absolute {
+		return next
+	}
+	return octaveChange{absolute: oc.absolute, octaves: oc.octaves + next.octaves}
+}
+
+// times returns the change of playing this change n times
+func (oc octaveChange) times(n int) octaveChange {
+	switch {
+	case n <= 0:
+		return octaveChange{}
+	case oc.absolute:
+		// playing it again sets the same octave
+		return oc
+	}
+	return octaveChange{octaves: oc.octaves * n}
+}
+
+func (oc octaveChange) apply(octave int) int {
+	if oc.absolute {
+		return oc.octaves
+	}
+	return octave + oc.octaves
+}
@@ -0,0 +1,79 @@
+package lang
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+// unrolledOctaves returns the octave of each note of the unrolled tablature, and the octave
+// after playing it
+func unrolledOctaves(t song.Tablature, octave int) ([]int, int) {
+	var octaves []int
+	for _, ti := range t.Unroll() {
+		switch {
+		case ti.SetOctave != nil:
+			octave = *ti.SetOctave
+		case ti.OctaveStep != nil:
+			octave += *ti.OctaveStep
+		case ti.Note != nil:
+			octaves = append(octaves, octave)
+		}
+	}
+	return octaves, octave
+}
+
+func TestOctaveChanges(t *testing.T) {
+	for _, src := range []string{
+		"c > d < e",
+		"[c >]3",
+		"[c >]3 [d <<]2",
+		"[c > |1 d |2 e <]4",
+		"[c > |1 d < |2 e o3 |3 f >]5",
+		"[[c >]2 <]3",
+		"[c o2 >]4 d",
+		"> [[c]3 >]2 [o6 d <]3",
+		"[c |1 > |2 <<]2",
+	} {
+		t.Run(src, func(t *testing.T) {
+			s, err := Parse(strings.NewReader("@ch1 <- " + src + "\n"))
+			require.NoError(t, err)
+			tab := song.Tablature(s.Blocks[0].Channels["ch1"].Items)
+			for _, start := range []int{1, 4, 8} {
+				octaves, after := unrolledOctaves(tab, start)
+				assert.Equal(t, after, octaveAfter(tab, start))
+				// the range check fails in the same cases as checking the unrolled notes
+				inRange := true
+				for _, o := range octaves {
+					inRange = inRange && o >= minTransposedOctave && o <= maxTransposedOctave
+				}
+				err := checkOctaveRange(tab, start)
+				assert.Equalf(t, inRange, err == nil, "start octave %d: %v", start, err)
+			}
+		})
+	}
+}
+
+func TestNestedRepeats(t *testing.T) {
+	// the repeats are not unrolled while the song is parsed
+	s, err := Parse(strings.NewReader(`
+$riff := [[[[c d]99]99 > e <]99]99
+@ch1 <- $riff(o4) e
+@ch1 <- $riff f
+`))
+	require.NoError(t, err)
+	assert.Len(t, s.Blocks[0].Channels["ch1"].Items, 5)
+
+	// a repeat that raises the octave in each repetition eventually gets out of range
+	_, err = Parse(strings.NewReader(`
+$riff := [c >]99
+@ch1 <- $riff(o4)
+`))
+	err = firstError(t, err)
+	require.IsTypef(t, ParserError{}, err, "%#v", err)
+	assert.Contains(t, err.Error(), "3:9 - transposed note c is out of range (octave 9)")
+}
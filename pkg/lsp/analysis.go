@@ -0,0 +1,295 @@
+package lsp
+
+import (
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+// document is an open m4l file, with the results of its analysis
+type document struct {
+	uri   string
+	lines []string
+	// tokens of the whole document, including the header
+	tokens      []lang.Token
+	diagnostics []diagnostic
+	// last song that was successfully parsed from the document. It could be outdated
+	// if the current contents have errors
+	song *song.Song
+}
+
+// newDocument analyzes the contents of the document. The previous version of the document
+// provides the last successfully parsed song in case the new contents have errors
+func newDocument(uri, text string, previous *document) *document {
+	doc := &document{
+		uri:         uri,
+		lines:       strings.Split(text, "\n"),
+		diagnostics: []diagnostic{},
+	}
+	t := lang.NewTokenizer(strings.NewReader(text), 0)
+	for t.Next() {
+		doc.tokens = append(doc.tokens, t.Get())
+	}
+	fsys, name := fileOf(uri)
+	s, err := lang.ParseSource(fsys, name, strings.NewReader(text), lang.WithBarCheck())
+	if err == nil {
+		doc.song = s
+		return doc
+	}
+	if s != nil {
+		// the song only has warnings
+		doc.song = s
+	} else if previous != nil {
+		doc.song = previous.song
+	}
+	if errs, ok := err.(lang.ErrorList); ok {
+		for _, e := range errs {
+			doc.diagnostics = append(doc.diagnostics, doc.diagnostic(e, name))
+		}
+	} else {
+		doc.diagnostics = append(doc.diagnostics, diagnostic{
+			Severity: severityError, Source: serverName, Message: err.Error(),
+		})
+	}
+	return doc
+}
+
+// fileOf returns the file system and the file name of a document URI, to look up the
+// files that are included by the document
+func fileOf(uri string) (fs.FS, string) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "file" {
+		return os.DirFS("."), ""
+	}
+	return lang.FileFS(filepath.FromSlash(u.Path))
+}
+
+func (doc *document) diagnostic(d lang.Diagnostic, name string) diagnostic {
+	diag := diagnostic{Severity: severityError, Source: serverName, Message: d.Message}
+	if d.Severity == lang.SeverityWarning {
+		diag.Severity = severityWarning
+	}
+	if d.Position.File != name {
+		// error in an included file: reported at the start of the document
+		diag.Message = d.Error()
+		return diag
+	}
+	start := position{Line: d.Position.Row - 1, Character: d.Position.Col - 1}
+	if start.Line < 0 {
+		start.Line = 0
+	}
+	if start.Character < 0 {
+		start.Character = 0
+	}
+	diag.Range = doc.lspRange(textRange{Start: start, End: doc.wordEnd(start)})
+	return diag
+}
+
+// lspRange converts a range whose characters are byte offsets, as the columns of the tokens,
+// into the UTF-16 code units that LSP uses to count the characters
+func (doc *document) lspRange(rng textRange) textRange {
+	return textRange{Start: doc.lspPosition(rng.Start), End: doc.lspPosition(rng.End)}
+}
+
+func (doc *document) lspPosition(pos position) position {
+	if pos.Line >= len(doc.lines) {
+		return pos
+	}
+	line := doc.lines[pos.Line]
+	// positions after the end of the line are kept after it
+	extra := 0
+	if pos.Character > len(line) {
+		extra = pos.Character - len(line)
+		pos.Character = len(line)
+	}
+	units := 0
+	for _, r := range line[:pos.Character] {
+		units++
+		if r >= 0x10000 {
+			// encoded as a surrogate pair
+			units++
+		}
+	}
+	pos.Character = units + extra
+	return pos
+}
+
+// bytePosition converts a position that is received from the client, in UTF-16 code units,
+// into a byte offset of the line
+func (doc *document) bytePosition(pos position) position {
+	if pos.Line < 0 || pos.Line >= len(doc.lines) {
+		return pos
+	}
+	units := 0
+	for i, r := range doc.lines[pos.Line] {
+		if units >= pos.Character {
+			pos.Character = i
+			return pos
+		}
+		units++
+		if r >= 0x10000 {
+			units++
+		}
+	}
+	pos.Character = len(doc.lines[pos.Line]) + pos.Character - units
+	return pos
+}
+
+// wordEnd returns the position where the word that starts in the given position finishes
+func (doc *document) wordEnd(start position) position {
+	end := start
+	if start.Line >= len(doc.lines) {
+		return end
+	}
+	line := doc.lines[start.Line]
+	for end.Character < len(line) && !strings.ContainsRune(" \t\r", rune(line[end.Character])) {
+		end.Character++
+	}
+	if end.Character == start.Character {
+		end.Character++
+	}
+	return end
+}
+
+// symbol is a constant or channel name, prefixed by $ or @
+type symbol string
+
+// symbolOf returns the symbol that is defined or referred by a token, and its range in bytes
+func symbolOf(tok lang.Token) (symbol, textRange, bool) {
+	var sym symbol
+	switch tok.Type {
+	case lang.ConstDef, lang.ConstRef:
+		sym = symbol("$" + tok.Submatch[0])
+	case lang.ChannelId:
+		sym = symbol("@" + tok.Submatch[0])
+	default:
+		return "", textRange{}, false
+	}
+	start := position{Line: tok.Row - 1, Character: tok.Col - 1}
+	end := position{Line: start.Line, Character: start.Character + len(sym)}
+	return sym, textRange{Start: start, End: end}, true
+}
+
+// symbolAt returns the symbol in the given position of the document, and its range in
+// UTF-16 code units
+func (doc *document) symbolAt(pos position) (symbol, textRange, bool) {
+	pos = doc.bytePosition(pos)
+	for _, tok := range doc.tokens {
+		if tok.Row-1 != pos.Line || pos.Character < tok.Col-1 || pos.Character > tok.Col-1+len(tok.Content) {
+			continue
+		}
+		if sym, rng, ok := symbolOf(tok); ok {
+			return sym, doc.lspRange(rng), true
+		}
+	}
+	return "", textRange{}, false
+}
+
+// definition returns where the constant is defined, or the first statement of the channel
+func (doc *document) definition(pos position) (location, bool) {
+	sym, _, ok := doc.symbolAt(pos)
+	if !ok {
+		return location{}, false
+	}
+	for _, tok := range doc.tokens {
+		if tok.Type != lang.ConstDef && tok.Type != lang.ChannelId {
+			continue
+		}
+		if s, rng, _ := symbolOf(tok); s == sym {
+			return location{URI: doc.uri, Range: doc.lspRange(rng)}, true
+		}
+	}
+	return location{}, false
+}
+
+// references returns all the places where the constant is referenced or the channel is used
+func (doc *document) references(pos position, includeDeclaration bool) []location {
+	locs := []location{}
+	sym, _, ok := doc.symbolAt(pos)
+	if !ok {
+		return locs
+	}
+	for _, tok := range doc.tokens {
+		if tok.Type == lang.ConstDef && !includeDeclaration {
+			continue
+		}
+		if s, rng, ok := symbolOf(tok); ok && s == sym {
+			locs = append(locs, location{URI: doc.uri, Range: doc.lspRange(rng)})
+		}
+	}
+	return locs
+}
+
+// hover shows the length of a constant in beats
+func (doc *document) hover(pos position) (hover, bool) {
+	sym, rng, ok := doc.symbolAt(pos)
+	if !ok || sym[0] != '$' || doc.song == nil {
+		return hover{}, false
+	}
+	items, ok := doc.song.Constants[string(sym[1:])]
+	if !ok {
+		return hover{}, false
+	}
+	var text string
+	if len(items) == 1 && items[0].Instrument != nil {
+		text = fmt.Sprintf("**%s**: %s instrument", sym, items[0].Instrument.Class)
+	} else {
+		beats := items.Beats()
+		text = fmt.Sprintf("**%s**: %s beats", sym, strconv.FormatFloat(beats.Float64(), 'g', 6, 64))
+	}
+	return hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: &rng}, true
+}
+
+// commands that can be completed in a tablature or as statements
+var commandCompletions = []completionItem{
+	{Label: "a", Kind: kindKeyword, Detail: "note A (la)"},
+	{Label: "b", Kind: kindKeyword, Detail: "note B (si)"},
+	{Label: "c", Kind: kindKeyword, Detail: "note C (do)"},
+	{Label: "d", Kind: kindKeyword, Detail: "note D (re)"},
+	{Label: "e", Kind: kindKeyword, Detail: "note E (mi)"},
+	{Label: "f", Kind: kindKeyword, Detail: "note F (fa)"},
+	{Label: "g", Kind: kindKeyword, Detail: "note G (sol)"},
+	{Label: "r", Kind: kindKeyword, Detail: "silence"},
+	{Label: "n", Kind: kindKeyword, Detail: "noise hit: n<period>,<length>"},
+	{Label: "o", Kind: kindKeyword, Detail: "set octave: o<octave>"},
+	{Label: "<", Kind: kindKeyword, Detail: "decrease octave"},
+	{Label: ">", Kind: kindKeyword, Detail: "increase octave"},
+	{Label: "v", Kind: kindKeyword, Detail: "volume: v<0-15>"},
+	{Label: "t", Kind: kindKeyword, Detail: "tempo: t<bpm>"},
+	{Label: "l", Kind: kindKeyword, Detail: "default length: l<length>"},
+	{Label: "k", Kind: kindKeyword, Detail: "key signature: k<key> (e.g. kd, kf#m)"},
+	{Label: "loop:", Kind: kindKeyword, Detail: "start of the song loop"},
+	{Label: "include", Kind: kindModule, Detail: `include "file.m4l"`},
+}
+
+// completion returns the commands, as well as the constants and channels of the document
+func (doc *document) completion() []completionItem {
+	items := append([]completionItem{}, commandCompletions...)
+	if doc == nil {
+		return items
+	}
+	added := map[symbol]bool{}
+	for _, tok := range doc.tokens {
+		if tok.Type != lang.ConstDef && tok.Type != lang.ChannelId {
+			continue
+		}
+		sym, _, _ := symbolOf(tok)
+		if added[sym] {
+			continue
+		}
+		added[sym] = true
+		detail := "constant"
+		if tok.Type == lang.ChannelId {
+			detail = "channel"
+		}
+		items = append(items, completionItem{Label: string(sym), Kind: kindVariable, Detail: detail})
+	}
+	return items
+}
@@ -0,0 +1,96 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+)
+
+// JSON-RPC error codes
+const (
+	parseError     = -32700
+	methodNotFound = -32601
+	invalidParams  = -32602
+)
+
+// maxContentLength is the size of the longest message that is accepted, in bytes
+const maxContentLength = 16 << 20
+
+// errDecode is returned by readMessage when a message is received but it is not valid JSON-RPC.
+// The server can still read the next messages
+var errDecode = errors.New("can't decode message")
+
+// message is a JSON-RPC request, notification (without ID) or response
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	ID      *json.RawMessage `json:"id,omitempty"`
+	Method  string           `json:"method,omitempty"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Result  interface{}      `json:"result,omitempty"`
+	Error   *responseError   `json:"error,omitempty"`
+}
+
+type responseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// readMessage reads a message with the LSP base protocol: a header with the Content-Length
+// of the JSON-RPC message, followed by an empty line and the message
+func readMessage(in *bufio.Reader) (*message, error) {
+	body, err := readBody(in)
+	if err != nil {
+		return nil, err
+	}
+	msg := &message{}
+	if err := json.Unmarshal(body, msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", errDecode, err)
+	}
+	return msg, nil
+}
+
+// readBody reads the JSON-RPC contents of a message
+func readBody(in *bufio.Reader) ([]byte, error) {
+	header, err := textproto.NewReader(in).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("wrong Content-Length header: %w", err)
+	}
+	if length < 0 {
+		// the end of the message is unknown, so the next messages can't be read
+		return nil, fmt.Errorf("wrong Content-Length header: %d", length)
+	}
+	if length > maxContentLength {
+		// skipping the message without storing it, so the next messages can be read
+		if _, err := io.CopyN(io.Discard, in, int64(length)); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: message of %d bytes is longer than %d bytes",
+			errDecode, length, maxContentLength)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(in, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+func writeMessage(out io.Writer, msg *message) error {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(out, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = out.Write(body)
+	return err
+}
@@ -0,0 +1,184 @@
+// Package lsp implements a Language Server Protocol server for the m4l songs, which
+// communicates with the editors through the standard input and output.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+)
+
+const serverName = "m4l"
+
+// Server of the Language Server Protocol. It only accepts full document synchronization
+type Server struct {
+	in  *bufio.Reader
+	out io.Writer
+	// open documents, by URI
+	docs map[string]*document
+}
+
+func NewServer(in io.Reader, out io.Writer) *Server {
+	return &Server{
+		in:   bufio.NewReader(in),
+		out:  out,
+		docs: map[string]*document{},
+	}
+}
+
+// Serve handles the client messages until the client sends the exit notification or
+// closes the input
+func (s *Server) Serve() error {
+	for {
+		msg, err := readMessage(s.in)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if errors.Is(err, errDecode) {
+			// the ID of the wrong message is unknown, so the error is answered with a null ID
+			null := json.RawMessage("null")
+			response := &message{ID: &null, Error: &responseError{Code: parseError, Message: err.Error()}}
+			if err := writeMessage(s.out, response); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		result, rerr := s.handle(msg)
+		if msg.ID == nil {
+			// notifications are not answered
+			if rerr != nil {
+				log.Printf("error handling %s notification: %s", msg.Method, rerr.Message)
+			}
+			continue
+		}
+		response := &message{ID: msg.ID, Error: rerr}
+		if rerr == nil {
+			raw, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			response.Result = (*json.RawMessage)(&raw)
+		}
+		if err := writeMessage(s.out, response); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) handle(msg *message) (interface{}, *responseError) {
+	switch msg.Method {
+	case "initialize":
+		res := initializeResult{}
+		res.ServerInfo.Name = serverName
+		res.Capabilities = serverCapabilities{
+			TextDocumentSync:   textDocumentSyncFull,
+			DefinitionProvider: true,
+			ReferencesProvider: true,
+			HoverProvider:      true,
+		}
+		res.Capabilities.CompletionProvider.TriggerCharacters = []string{"$", "@"}
+		return res, nil
+	case "initialized", "shutdown", "$/cancelRequest":
+		return nil, nil
+	case "textDocument/didOpen":
+		p := didOpenParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		s.update(p.TextDocument.URI, p.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		p := didChangeParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		if len(p.ContentChanges) > 0 {
+			// with full synchronization, the last change contains the whole document
+			s.update(p.TextDocument.URI, p.ContentChanges[len(p.ContentChanges)-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		p := didCloseParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		delete(s.docs, p.TextDocument.URI)
+		return nil, s.notify("textDocument/publishDiagnostics",
+			publishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []diagnostic{}})
+	case "textDocument/definition":
+		p := textDocumentPositionParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		if doc, ok := s.docs[p.TextDocument.URI]; ok {
+			if loc, ok := doc.definition(p.Position); ok {
+				return loc, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/references":
+		p := referenceParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		if doc, ok := s.docs[p.TextDocument.URI]; ok {
+			return doc.references(p.Position, p.Context.IncludeDeclaration), nil
+		}
+		return []location{}, nil
+	case "textDocument/hover":
+		p := textDocumentPositionParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		if doc, ok := s.docs[p.TextDocument.URI]; ok {
+			if h, ok := doc.hover(p.Position); ok {
+				return h, nil
+			}
+		}
+		return nil, nil
+	case "textDocument/completion":
+		p := textDocumentPositionParams{}
+		if err := json.Unmarshal(msg.Params, &p); err != nil {
+			return nil, paramsError(err)
+		}
+		var doc *document
+		if d, ok := s.docs[p.TextDocument.URI]; ok {
+			doc = d
+		}
+		return doc.completion(), nil
+	}
+	return nil, &responseError{Code: methodNotFound, Message: "unsupported method: " + msg.Method}
+}
+
+// update the contents of a document and publish its diagnostics
+func (s *Server) update(uri, text string) {
+	doc := newDocument(uri, text, s.docs[uri])
+	s.docs[uri] = doc
+	if err := s.notify("textDocument/publishDiagnostics",
+		publishDiagnosticsParams{URI: uri, Diagnostics: doc.diagnostics}); err != nil {
+		log.Printf("can't publish diagnostics: %s", err.Message)
+	}
+}
+
+func (s *Server) notify(method string, params interface{}) *responseError {
+	raw, err := json.Marshal(params)
+	if err != nil {
+		return &responseError{Code: invalidParams, Message: err.Error()}
+	}
+	if err := writeMessage(s.out, &message{Method: method, Params: raw}); err != nil {
+		return &responseError{Code: invalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+func paramsError(err error) *responseError {
+	return &responseError{Code: invalidParams, Message: err.Error()}
+}
@@ -0,0 +1,320 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const docURI = "file:///songs/song.m4l"
+
+const songText = `tempo 120
+
+$riff := c8 d8 e4 | f2
+$piano := psg { pattern: 3 }
+@ch1 <- $piano $riff
+@ch2 <- a b $riff
+@ch1 <- $riff
+`
+
+// rawBody is sent as the body of a message, without encoding it as JSON
+type rawBody string
+
+// session sends the messages to a server and returns all the messages that the server wrote
+func session(t *testing.T, msgs ...interface{}) []map[string]interface{} {
+	t.Helper()
+	in := bytes.Buffer{}
+	for _, m := range msgs {
+		body := []byte(nil)
+		if raw, ok := m.(rawBody); ok {
+			body = []byte(raw)
+		} else {
+			var err error
+			body, err = json.Marshal(m)
+			require.NoError(t, err)
+		}
+		in.WriteString("Content-Length: ")
+		in.WriteString(strconv.Itoa(len(body)))
+		in.WriteString("\r\n\r\n")
+		in.Write(body)
+	}
+	out := bytes.Buffer{}
+	require.NoError(t, NewServer(&in, &out).Serve())
+
+	var received []map[string]interface{}
+	reader := bufio.NewReader(&out)
+	for {
+		body, err := readBody(reader)
+		if errors.Is(err, io.EOF) {
+			return received
+		}
+		require.NoError(t, err)
+		// decoding as a generic map to easily check the contents
+		generic := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(body, &generic))
+		received = append(received, generic)
+	}
+}
+
+func request(id int, method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notification(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func didOpen(text string) map[string]interface{} {
+	return notification("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": docURI, "languageId": "m4l", "version": 1, "text": text},
+	})
+}
+
+func at(line, character int) map[string]interface{} {
+	return map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": docURI},
+		"position":     map[string]interface{}{"line": line, "character": character},
+	}
+}
+
+func rng(line, start, end int) map[string]interface{} {
+	return map[string]interface{}{
+		"start": map[string]interface{}{"line": float64(line), "character": float64(start)},
+		"end":   map[string]interface{}{"line": float64(line), "character": float64(end)},
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	msgs := session(t,
+		request(1, "initialize", map[string]interface{}{}),
+		notification("initialized", map[string]interface{}{}),
+		request(2, "shutdown", nil),
+		notification("exit", nil),
+	)
+	require.Len(t, msgs, 2)
+	assert.EqualValues(t, 1, msgs[0]["id"])
+	caps := msgs[0]["result"].(map[string]interface{})["capabilities"].(map[string]interface{})
+	assert.EqualValues(t, 1, caps["textDocumentSync"])
+	assert.Equal(t, true, caps["definitionProvider"])
+	assert.Equal(t, true, caps["referencesProvider"])
+	assert.Equal(t, true, caps["hoverProvider"])
+	assert.EqualValues(t, 2, msgs[1]["id"])
+	assert.Contains(t, msgs[1], "result")
+	assert.Nil(t, msgs[1]["result"])
+}
+
+func TestDiagnostics(t *testing.T) {
+	msgs := session(t,
+		didOpen("@ch1 <- abc\n@ch2 <- v20 c\n@ch3 <- c $undefined\n"),
+		notification("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": docURI, "version": 2},
+			"contentChanges": []interface{}{map[string]interface{}{"text": "@ch1 <- abc\n"}},
+		}),
+	)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, "textDocument/publishDiagnostics", msgs[0]["method"])
+	params := msgs[0]["params"].(map[string]interface{})
+	assert.Equal(t, docURI, params["uri"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"range": rng(1, 8, 11), "severity": float64(1), "source": "m4l",
+			"message": "max volume is 16 (was: 20)",
+		},
+		map[string]interface{}{
+			"range": rng(2, 10, 20), "severity": float64(1), "source": "m4l",
+			"message": `constant "undefined" not defined`,
+		},
+	}, params["diagnostics"])
+
+	// once fixed, the diagnostics are cleaned
+	params = msgs[1]["params"].(map[string]interface{})
+	assert.Equal(t, []interface{}{}, params["diagnostics"])
+}
+
+func TestDiagnostics_Warnings(t *testing.T) {
+	msgs := session(t, didOpen("timesig 3/4\n$r := c4 d4\n@ch1 <- | c2. | $r | e2.\n"),
+		request(1, "textDocument/hover", at(2, 16)),
+	)
+	require.Len(t, msgs, 2)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{
+			"range": rng(2, 19, 20), "severity": float64(2), "source": "m4l",
+			"message": "bar lasts 2 beats, but a 3/4 measure lasts 3 beats",
+		},
+	}, msgs[0]["params"].(map[string]interface{})["diagnostics"])
+	// songs with warnings are still analyzed
+	assert.Equal(t, "**$r**: 2 beats",
+		msgs[1]["result"].(map[string]interface{})["contents"].(map[string]interface{})["value"])
+}
+
+func TestDefinitionAndReferences(t *testing.T) {
+	msgs := session(t,
+		didOpen(songText),
+		// $riff in the @ch2 statement
+		request(1, "textDocument/definition", at(5, 14)),
+		// @ch1 in the last statement
+		request(2, "textDocument/definition", at(6, 2)),
+		request(3, "textDocument/references", map[string]interface{}{
+			"textDocument": map[string]interface{}{"uri": docURI},
+			"position":     map[string]interface{}{"line": 2, "character": 3},
+			"context":      map[string]interface{}{"includeDeclaration": true},
+		}),
+		request(4, "textDocument/references", at(4, 1)),
+		// a note has no definition
+		request(5, "textDocument/definition", at(5, 8)),
+	)
+	require.Len(t, msgs, 6)
+	assert.Equal(t, map[string]interface{}{"uri": docURI, "range": rng(2, 0, 5)}, msgs[1]["result"])
+	assert.Equal(t, map[string]interface{}{"uri": docURI, "range": rng(4, 0, 4)}, msgs[2]["result"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"uri": docURI, "range": rng(2, 0, 5)},
+		map[string]interface{}{"uri": docURI, "range": rng(4, 15, 20)},
+		map[string]interface{}{"uri": docURI, "range": rng(5, 12, 17)},
+		map[string]interface{}{"uri": docURI, "range": rng(6, 8, 13)},
+	}, msgs[3]["result"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"uri": docURI, "range": rng(4, 0, 4)},
+		map[string]interface{}{"uri": docURI, "range": rng(6, 0, 4)},
+	}, msgs[4]["result"])
+	assert.Nil(t, msgs[5]["result"])
+}
+
+func TestHover(t *testing.T) {
+	msgs := session(t,
+		didOpen(songText),
+		request(1, "textDocument/hover", at(4, 17)),
+		request(2, "textDocument/hover", at(3, 2)),
+		// the hover keeps working while the document has errors
+		notification("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": docURI, "version": 2},
+			"contentChanges": []interface{}{map[string]interface{}{"text": songText + "@ch3 <- v99\n"}},
+		}),
+		request(3, "textDocument/hover", at(6, 10)),
+	)
+	require.Len(t, msgs, 5)
+	assert.Equal(t, map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": "**$riff**: 4 beats"},
+		"range":    rng(4, 15, 20),
+	}, msgs[1]["result"])
+	assert.Equal(t, map[string]interface{}{
+		"contents": map[string]interface{}{"kind": "markdown", "value": "**$piano**: psg instrument"},
+		"range":    rng(3, 0, 6),
+	}, msgs[2]["result"])
+	assert.Equal(t, "**$riff**: 4 beats",
+		msgs[4]["result"].(map[string]interface{})["contents"].(map[string]interface{})["value"])
+}
+
+func TestCompletion(t *testing.T) {
+	msgs := session(t,
+		didOpen(songText),
+		request(1, "textDocument/completion", at(6, 8)),
+	)
+	require.Len(t, msgs, 2)
+	labels := map[string]string{}
+	for _, it := range msgs[1]["result"].([]interface{}) {
+		item := it.(map[string]interface{})
+		labels[item["label"].(string)] = item["detail"].(string)
+	}
+	assert.Equal(t, "note C (do)", labels["c"])
+	assert.Equal(t, "silence", labels["r"])
+	assert.Equal(t, "constant", labels["$riff"])
+	assert.Equal(t, "constant", labels["$piano"])
+	assert.Equal(t, "channel", labels["@ch1"])
+	assert.Equal(t, "channel", labels["@ch2"])
+}
+
+func TestUnsupportedMethod(t *testing.T) {
+	msgs := session(t, request(1, "workspace/symbol", map[string]interface{}{}))
+	require.Len(t, msgs, 1)
+	assert.EqualValues(t, methodNotFound, msgs[0]["error"].(map[string]interface{})["code"])
+}
+
+func TestParseError(t *testing.T) {
+	msgs := session(t,
+		rawBody(`{"jsonrpc": "2.0", "id": 1, "method": "initialize"`),
+		rawBody(`["not", "a", "message"]`),
+		// the server keeps serving after the wrong messages
+		request(2, "shutdown", nil),
+		notification("exit", nil),
+	)
+	require.Len(t, msgs, 3)
+	for _, msg := range msgs[:2] {
+		assert.Contains(t, msg, "id")
+		assert.Nil(t, msg["id"])
+		assert.EqualValues(t, parseError, msg["error"].(map[string]interface{})["code"])
+	}
+	assert.EqualValues(t, 2, msgs[2]["id"])
+	assert.NotContains(t, msgs[2], "error")
+}
+
+func TestWrongContentLength(t *testing.T) {
+	// a message that is too long is skipped, and the server keeps serving
+	in := bytes.Buffer{}
+	in.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", maxContentLength+1))
+	in.Write(bytes.Repeat([]byte{' '}, maxContentLength+1))
+	body, err := json.Marshal(request(1, "shutdown", nil))
+	require.NoError(t, err)
+	in.WriteString(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body)))
+	in.Write(body)
+	out := bytes.Buffer{}
+	require.NoError(t, NewServer(&in, &out).Serve())
+	reader := bufio.NewReader(&out)
+	for _, id := range []interface{}{nil, 1.0} {
+		body, err := readBody(reader)
+		require.NoError(t, err)
+		msg := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(body, &msg))
+		assert.Equal(t, id, msg["id"])
+	}
+
+	// a negative length ends the session, since the next messages can't be found
+	in.Reset()
+	in.WriteString("Content-Length: -1\r\n\r\n{}")
+	err = NewServer(&in, &bytes.Buffer{}).Serve()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "wrong Content-Length header: -1")
+}
+
+func TestUTF16Positions(t *testing.T) {
+	// the wrong token takes 4 bytes, but 2 UTF-16 code units
+	text := "$riff := c d\n@ch1 <- \U0001F600 @ch2 <- $riff ; caf\u00e9\n"
+	msgs := session(t,
+		didOpen(text),
+		// the first character of $riff, which is the 21st byte
+		request(1, "textDocument/definition", at(1, 19)),
+		request(2, "textDocument/references", at(0, 2)),
+		// the wrong token is not a symbol
+		request(3, "textDocument/definition", at(1, 9)),
+	)
+	require.Len(t, msgs, 4)
+	diagnostics := msgs[0]["params"].(map[string]interface{})["diagnostics"].([]interface{})
+	require.Len(t, diagnostics, 1)
+	assert.Equal(t, rng(1, 8, 10), diagnostics[0].(map[string]interface{})["range"])
+	assert.Equal(t, map[string]interface{}{"uri": docURI, "range": rng(0, 0, 5)}, msgs[1]["result"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"uri": docURI, "range": rng(1, 19, 24)},
+	}, msgs[2]["result"])
+	assert.Nil(t, msgs[3]["result"])
+}
+
+func TestPositionConversion(t *testing.T) {
+	doc := &document{lines: []string{"a\u00e9\U0001F600b"}}
+	// bytes:  a=0 \u00e9=1 \U0001F600=3 b=7 end=8
+	// UTF-16: a=0 \u00e9=1 \U0001F600=2 b=4 end=5
+	for bytePos, utf16Pos := range map[int]int{0: 0, 1: 1, 3: 2, 7: 4, 8: 5, 10: 7} {
+		assert.Equalf(t, position{Character: utf16Pos}, doc.lspPosition(position{Character: bytePos}),
+			"byte %d", bytePos)
+		assert.Equalf(t, position{Character: bytePos}, doc.bytePosition(position{Character: utf16Pos}),
+			"UTF-16 %d", utf16Pos)
+	}
+	// lines out of the document are not converted
+	assert.Equal(t, position{Line: 3, Character: 4}, doc.lspPosition(position{Line: 3, Character: 4}))
+}
@@ -0,0 +1,294 @@
+// Package midi exports the songs as Standard MIDI Files (type 1), to be played and edited in
+// a DAW
+package midi
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mariomac/msxmml/pkg/reader"
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const (
+	titleKey = "title"
+	// ticks per beat (quarter note). It's divisible by the usual tuplets and by the shortest
+	// notes, so most durations don't need to be rounded
+	ticksPerBeat = 960
+	// the General MIDI percussion channel is not assigned by default
+	percussionChannel = 10
+	maxChannels       = 16
+	maxVolume         = 15
+	maxValue          = 127
+	// velocity of the notes when the volume is sent as a control change
+	defaultVelocity = 100
+	// MIDI notes start one octave lower than the song pitches: A4 (440 Hz) is 69
+	pitchOffset = 12
+	loopMarker  = "loop"
+)
+
+// DefaultProgram plays the channels that are not configured. It's the square lead of General
+// MIDI, which sounds closer to the PSG than the piano
+const DefaultProgram = 81
+
+// event status and meta event types
+const (
+	noteOff       = 0x80
+	noteOn        = 0x90
+	controlChange = 0xB0
+	programChange = 0xC0
+	meta          = 0xFF
+	metaTrackName = 0x03
+	metaMarker    = 0x06
+	metaEndTrack  = 0x2F
+	metaTempo     = 0x51
+	metaTimeSig   = 0x58
+	ccVolume      = 7
+)
+
+// Option configures how a song is exported
+type Option func(cfg *config)
+
+// channel and program of a song channel, from 1
+type assignment struct {
+	channel int
+	program int
+}
+
+type config struct {
+	assignments map[string]assignment
+	volumeCC    bool
+}
+
+// WithChannel plays the given song channel (without the @) in a MIDI channel, from 1 to 16,
+// with the given General MIDI program, from 1 to 128. The channels that are not configured
+// are assigned to the free MIDI channels, in order of appearance, with the DefaultProgram
+func WithChannel(name string, channel, program int) Option {
+	return func(cfg *config) {
+		cfg.assignments[name] = assignment{channel: channel, program: program}
+	}
+}
+
+// WithVolumeCC sends the volume of the channels as a Volume (CC7) control change, instead of
+// as the velocity of the notes
+func WithVolumeCC() Option {
+	return func(cfg *config) {
+		cfg.volumeCC = true
+	}
+}
+
+// Export the song as a type 1 Standard MIDI File. The first track contains the tempo, the time
+// signature and a marker where the loop starts. It's followed by a track for each channel
+// of the song. The noises of the PSG are not exported
+func Export(s *song.Song, opts ...Option) ([]byte, error) {
+	cfg := config{assignments: map[string]assignment{}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	tl, err := reader.NewTimeline(s)
+	if err != nil {
+		return nil, err
+	}
+	conductor, err := conductorTrack(s, tl)
+	if err != nil {
+		return nil, err
+	}
+	channels, err := assign(tl, cfg.assignments)
+	if err != nil {
+		return nil, err
+	}
+	tracks := []*track{conductor}
+	for _, ch := range channels {
+		tr, err := channelTrack(tl, ch.name, ch.assignment, cfg.volumeCC)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, tr)
+	}
+
+	const (
+		smfType    = 1
+		headerSize = 6
+	)
+	smf := []byte("MThd")
+	smf = appendUint32(smf, headerSize)
+	smf = appendUint16(smf, smfType)
+	smf = appendUint16(smf, uint16(len(tracks)))
+	smf = appendUint16(smf, ticksPerBeat)
+	for _, tr := range tracks {
+		tr.meta(ticks(tl.Length), metaEndTrack)
+		smf = append(smf, "MTrk"...)
+		smf = appendUint32(smf, uint32(len(tr.data)))
+		smf = append(smf, tr.data...)
+	}
+	return smf, nil
+}
+
+func conductorTrack(s *song.Song, tl *reader.Timeline) (*track, error) {
+	tr := &track{}
+	if title, ok := s.Properties[titleKey]; ok {
+		tr.meta(0, metaTrackName, []byte(title)...)
+	}
+	if tsStr, ok := s.Properties[song.TimeSignatureKey]; ok {
+		ts, err := song.ParseTimeSignature(tsStr)
+		if err != nil {
+			return nil, err
+		}
+		unitPow := 0
+		for unit := ts.Unit; unit > 1; unit >>= 1 {
+			unitPow++
+		}
+		const (
+			clocksPerClick = 24
+			// thirty-second notes per quarter note
+			notes32PerBeat = 8
+		)
+		tr.meta(0, metaTimeSig, byte(ts.Beats), byte(unitPow), clocksPerClick, notes32PerBeat)
+	}
+	loop := tl.LoopStart
+	for _, tc := range tl.Tempos {
+		// the events of the track must be sorted by time
+		if loop != nil && loop.Less(tc.Beat) {
+			tr.meta(ticks(*loop), metaMarker, []byte(loopMarker)...)
+			loop = nil
+		}
+		microsPerBeat := 60_000_000 / tc.BPM
+		tr.meta(ticks(tc.Beat), metaTempo,
+			byte(microsPerBeat>>16), byte(microsPerBeat>>8), byte(microsPerBeat))
+	}
+	if loop != nil {
+		tr.meta(ticks(*loop), metaMarker, []byte(loopMarker)...)
+	}
+	return tr, nil
+}
+
+type channelAssignment struct {
+	name string
+	assignment
+}
+
+// assign returns the MIDI channel and program of each song channel, in order of appearance
+func assign(tl *reader.Timeline, configured map[string]assignment) ([]channelAssignment, error) {
+	used := map[int]bool{percussionChannel: true}
+	for name, a := range configured {
+		if a.channel < 1 || a.channel > maxChannels {
+			return nil, fmt.Errorf("channel %q: MIDI channel must be from 1 to %d. Got %d",
+				name, maxChannels, a.channel)
+		}
+		if a.program < 1 || a.program > maxValue+1 {
+			return nil, fmt.Errorf("channel %q: MIDI program must be from 1 to %d. Got %d",
+				name, maxValue+1, a.program)
+		}
+		used[a.channel] = true
+	}
+	var channels []channelAssignment
+	seen := map[string]bool{}
+	next := 1
+	for _, ev := range tl.Events {
+		if seen[ev.Channel] {
+			continue
+		}
+		seen[ev.Channel] = true
+		a, ok := configured[ev.Channel]
+		if !ok {
+			for ; used[next]; next++ {
+			}
+			if next > maxChannels {
+				return nil, fmt.Errorf("can't assign a MIDI channel to channel %q. All the channels are used",
+					ev.Channel)
+			}
+			a = assignment{channel: next, program: DefaultProgram}
+			next++
+		}
+		channels = append(channels, channelAssignment{name: ev.Channel, assignment: a})
+	}
+	return channels, nil
+}
+
+func channelTrack(tl *reader.Timeline, name string, a assignment, volumeCC bool) (*track, error) {
+	tr := &track{}
+	status := func(s int) byte {
+		return byte(s | (a.channel - 1))
+	}
+	tr.meta(0, metaTrackName, []byte(name)...)
+	tr.event(0, status(programChange), byte(a.program-1))
+	// the volume that was sent as a control change. Negative if no volume was sent
+	volume := -1
+	for _, ev := range tl.Events {
+		if ev.Channel != name || ev.Note == nil || ev.Volume == 0 {
+			continue
+		}
+		pitch := ev.Pitch() + pitchOffset
+		if pitch < 0 || pitch > maxValue {
+			return nil, fmt.Errorf("channel %q: the note at beat %s (octave %d) is out of the MIDI range",
+				name, ev.Start, ev.Octave)
+		}
+		start := ticks(ev.Start)
+		velocity := defaultVelocity
+		if volumeCC {
+			if ev.Volume != volume {
+				volume = ev.Volume
+				tr.event(start, status(controlChange), ccVolume, scale(volume))
+			}
+		} else {
+			velocity = int(scale(ev.Volume))
+		}
+		tr.event(start, status(noteOn), byte(pitch), byte(velocity))
+		tr.event(ticks(ev.End()), status(noteOff), byte(pitch), 0)
+	}
+	return tr, nil
+}
+
+// scale converts a PSG volume, from 0 to 15, into a MIDI value, from 0 to 127
+func scale(volume int) byte {
+	return byte((volume*maxValue + maxVolume/2) / maxVolume)
+}
+
+// ticks returns the nearest tick of the given beat. Since all the times are converted from
+// their exact beat, the rounding errors don't accumulate
+func ticks(beat song.Duration) int64 {
+	return beat.Mul(ticksPerBeat, 1).Add(song.NewDuration(1, 2)).Floor()
+}
+
+// track accumulates the events of a track chunk
+type track struct {
+	data     []byte
+	lastTick int64
+}
+
+// event appends an event at the given tick, which can't be before the previous event
+func (tr *track) event(tick int64, data ...byte) {
+	tr.data = appendVarLen(tr.data, uint32(tick-tr.lastTick))
+	tr.data = append(tr.data, data...)
+	tr.lastTick = tick
+}
+
+func (tr *track) meta(tick int64, metaType byte, data ...byte) {
+	event := appendVarLen([]byte{meta, metaType}, uint32(len(data)))
+	tr.event(tick, append(event, data...)...)
+}
+
+// appendVarLen appends a variable-length quantity: 7 bits per byte, from the most significant
+// ones, with the highest bit set in all the bytes but the last one
+func appendVarLen(data []byte, value uint32) []byte {
+	var buf [5]byte
+	i := len(buf) - 1
+	buf[i] = byte(value & 0x7F)
+	for value >>= 7; value > 0; value >>= 7 {
+		i--
+		buf[i] = byte(value&0x7F) | 0x80
+	}
+	return append(data, buf[i:]...)
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], value)
+	return append(data, buf[:]...)
+}
+
+func appendUint16(data []byte, value uint16) []byte {
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], value)
+	return append(data, buf[:]...)
+}
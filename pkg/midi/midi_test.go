@@ -0,0 +1,218 @@
+package midi
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+// event of a track, with its absolute tick
+type event struct {
+	tick int
+	data []byte
+}
+
+type smf struct {
+	format, division int
+	tracks           [][]event
+}
+
+func export(t *testing.T, src string, opts ...Option) smf {
+	t.Helper()
+	s, err := lang.Parse(strings.NewReader(src))
+	require.NoError(t, err)
+	data, err := Export(s, opts...)
+	require.NoError(t, err)
+	return parse(t, data)
+}
+
+func readVarLen(data []byte) (int, int) {
+	value, i := 0, 0
+	for ; data[i]&0x80 != 0; i++ {
+		value = value<<7 | int(data[i]&0x7F)
+	}
+	return value<<7 | int(data[i]), i + 1
+}
+
+func parse(t *testing.T, data []byte) smf {
+	t.Helper()
+	be := binary.BigEndian
+	require.Equal(t, "MThd", string(data[0:4]))
+	require.Equal(t, uint32(6), be.Uint32(data[4:]))
+	song := smf{format: int(be.Uint16(data[8:])), division: int(be.Uint16(data[12:]))}
+	tracks := int(be.Uint16(data[10:]))
+	data = data[14:]
+	for tr := 0; tr < tracks; tr++ {
+		require.Equal(t, "MTrk", string(data[0:4]))
+		size := int(be.Uint32(data[4:]))
+		chunk := data[8 : 8+size]
+		data = data[8+size:]
+		var events []event
+		tick := 0
+		for len(chunk) > 0 {
+			delta, n := readVarLen(chunk)
+			tick += delta
+			chunk = chunk[n:]
+			// all the events of the exporter have their status byte
+			size := 3
+			switch chunk[0] & 0xF0 {
+			case programChange:
+				size = 2
+			case 0xF0:
+				length, n := readVarLen(chunk[2:])
+				size = 2 + n + length
+			}
+			events = append(events, event{tick: tick, data: chunk[:size]})
+			chunk = chunk[size:]
+		}
+		require.NotEmpty(t, events)
+		assert.Equal(t, []byte{meta, metaEndTrack, 0}, events[len(events)-1].data, "end of track")
+		song.tracks = append(song.tracks, events[:len(events)-1])
+	}
+	assert.Empty(t, data)
+	return song
+}
+
+func metaEvent(tick int, metaType byte, data ...byte) event {
+	return event{tick: tick, data: append([]byte{meta, metaType, byte(len(data))}, data...)}
+}
+
+func TestExport(t *testing.T) {
+	song := export(t, `title "Dance of the knights"
+tempo 100
+timesig 3/4
+@a <- o5 c8. d16 (e f g)3 a4&a16
+@b <- r4 < b#8^8 v7 b
+loop:
+@a <- t60 c2
+`)
+	assert.Equal(t, 1, song.format)
+	assert.Equal(t, 960, song.division)
+	require.Len(t, song.tracks, 3)
+	assert.Equal(t, []event{
+		metaEvent(0, metaTrackName, []byte("Dance of the knights")...),
+		metaEvent(0, metaTimeSig, 3, 2, 24, 8),
+		// 600000 microseconds per beat
+		metaEvent(0, metaTempo, 0x09, 0x27, 0xC0),
+		// the loop starts when both channels finish
+		// 1000000 microseconds per beat
+		metaEvent(4080, metaTempo, 0x0F, 0x42, 0x40),
+		metaEvent(4080, metaMarker, []byte("loop")...),
+	}, song.tracks[0])
+	assert.Equal(t, []event{
+		metaEvent(0, metaTrackName, 'a'),
+		{tick: 0, data: []byte{0xC0, 80}},
+		// dotted eighth and sixteenth
+		{tick: 0, data: []byte{0x90, 72, 127}},
+		{tick: 720, data: []byte{0x80, 72, 0}},
+		{tick: 720, data: []byte{0x90, 74, 127}},
+		{tick: 960, data: []byte{0x80, 74, 0}},
+		// triplet of quarters
+		{tick: 960, data: []byte{0x90, 76, 127}},
+		{tick: 1600, data: []byte{0x80, 76, 0}},
+		{tick: 1600, data: []byte{0x90, 77, 127}},
+		{tick: 2240, data: []byte{0x80, 77, 0}},
+		{tick: 2240, data: []byte{0x90, 79, 127}},
+		{tick: 2880, data: []byte{0x80, 79, 0}},
+		// tied notes are not re-triggered
+		{tick: 2880, data: []byte{0x90, 81, 127}},
+		{tick: 4080, data: []byte{0x80, 81, 0}},
+		// the octave is kept in the loop
+		{tick: 4080, data: []byte{0x90, 72, 127}},
+		{tick: 6000, data: []byte{0x80, 72, 0}},
+	}, song.tracks[1])
+	assert.Equal(t, []event{
+		metaEvent(0, metaTrackName, 'b'),
+		{tick: 0, data: []byte{0xC1, 80}},
+		// B# of the octave 3 is the C of the octave 4
+		{tick: 960, data: []byte{0x91, 60, 127}},
+		{tick: 1920, data: []byte{0x81, 60, 0}},
+		{tick: 1920, data: []byte{0x91, 59, 59}},
+		{tick: 2880, data: []byte{0x81, 59, 0}},
+	}, song.tracks[2])
+}
+
+func TestExport_VolumeCC(t *testing.T) {
+	song := export(t, "@a <- a v15 b v8 c d v0 e\n", WithVolumeCC())
+	require.Len(t, song.tracks, 2)
+	assert.Equal(t, []event{
+		metaEvent(0, metaTrackName, 'a'),
+		{tick: 0, data: []byte{0xC0, 80}},
+		{tick: 0, data: []byte{0xB0, 7, 127}},
+		{tick: 0, data: []byte{0x90, 69, 100}},
+		{tick: 960, data: []byte{0x80, 69, 0}},
+		{tick: 960, data: []byte{0x90, 71, 100}},
+		{tick: 1920, data: []byte{0x80, 71, 0}},
+		{tick: 1920, data: []byte{0xB0, 7, 68}},
+		{tick: 1920, data: []byte{0x90, 60, 100}},
+		{tick: 2880, data: []byte{0x80, 60, 0}},
+		{tick: 2880, data: []byte{0x90, 62, 100}},
+		{tick: 3840, data: []byte{0x80, 62, 0}},
+		// the notes with no volume are not played
+	}, song.tracks[1])
+}
+
+func TestExport_Channels(t *testing.T) {
+	src := `
+@a <- a
+@b <- a
+@c <- a
+@d <- a
+@e <- a
+@f <- a
+@g <- a
+@h <- a
+@i <- a
+@j <- a
+`
+	song := export(t, src, WithChannel("b", 10, 1), WithChannel("c", 1, 30))
+	require.Len(t, song.tracks, 11)
+	var statuses, programs []byte
+	for _, tr := range song.tracks[1:] {
+		statuses = append(statuses, tr[1].data[0])
+		programs = append(programs, tr[1].data[1])
+	}
+	// the configured channels are not assigned to other channels, and the percussion channel
+	// (10) is only used if it's configured
+	assert.Equal(t, []byte{0xC1, 0xC9, 0xC0, 0xC2, 0xC3, 0xC4, 0xC5, 0xC6, 0xC7, 0xC8}, statuses)
+	assert.Equal(t, []byte{80, 0, 29, 80, 80, 80, 80, 80, 80, 80}, programs)
+
+	s, err := lang.Parse(strings.NewReader(src + "@k <- a\n@l <- a\n@m <- a\n@n <- a\n@o <- a\n@p <- a\n"))
+	require.NoError(t, err)
+	// 16 channels but the percussion one
+	_, err = Export(s)
+	assert.Error(t, err)
+	_, err = Export(s, WithChannel("p", 10, 1))
+	assert.NoError(t, err)
+	_, err = Export(s, WithChannel("a", 17, 1))
+	assert.Error(t, err)
+	_, err = Export(s, WithChannel("a", 1, 129))
+	assert.Error(t, err)
+}
+
+func TestExport_OutOfRange(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader("@a <- o9 b >>> c\n"))
+	require.NoError(t, err)
+	_, err = Export(s)
+	assert.Error(t, err)
+}
+
+func TestAppendVarLen(t *testing.T) {
+	for value, expected := range map[uint32][]byte{
+		0:          {0x00},
+		0x40:       {0x40},
+		0x7F:       {0x7F},
+		0x80:       {0x81, 0x00},
+		0x2000:     {0xC0, 0x00},
+		0x3FFF:     {0xFF, 0x7F},
+		0x4000:     {0x81, 0x80, 0x00},
+		0x0FFFFFFF: {0xFF, 0xFF, 0xFF, 0x7F},
+	} {
+		assert.Equalf(t, expected, appendVarLen(nil, value), "value: %#x", value)
+	}
+}
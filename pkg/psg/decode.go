@@ -0,0 +1,115 @@
+package psg
+
+import (
+	"fmt"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const headerSize = 2
+
+// Program is a decoded PSG binary
+type Program struct {
+	// LoopOffset is the position of the instruction where the loop starts, counted from the
+	// beginning of the binary (so it includes the 2 bytes of the header). Zero if the song
+	// doesn't loop
+	LoopOffset int
+	// Instructions of the song, ending with the End instruction
+	Instructions []Instruction
+}
+
+// noteNames of each tone value, spelled as natural or sharp notes. e.g. o4 a#
+var noteNames = map[uint16]string{}
+
+func init() {
+	for key, tone := range frequencies {
+		if key.half == song.Flat {
+			continue
+		}
+		noteNames[tone] = fmt.Sprintf("o%d %c%v", key.octave, key.pitch, key.half)
+	}
+}
+
+// Decode the binary that is generated by Export, back into a list of instructions
+func Decode(data []byte) (Program, error) {
+	if len(data) < headerSize {
+		return Program{}, fmt.Errorf("missing loop header: expected %d bytes, got %d", headerSize, len(data))
+	}
+	prog := Program{LoopOffset: int(data[0]) | int(data[1])<<8}
+	loopFound := prog.LoopOffset == 0
+	offset := headerSize
+	for {
+		if offset >= len(data) {
+			return prog, fmt.Errorf("missing %v instruction at the end of the song", End)
+		}
+		if offset == prog.LoopOffset {
+			loopFound = true
+		}
+		ins, err := decodeInstruction(data[offset:])
+		if err != nil {
+			return prog, fmt.Errorf("offset %d: %w", offset, err)
+		}
+		prog.Instructions = append(prog.Instructions, ins)
+		offset += ins.Size()
+		if ins.Type == End {
+			break
+		}
+	}
+	if offset < len(data) {
+		return prog, fmt.Errorf("offset %d: unexpected data after the %v instruction", offset, End)
+	}
+	if !loopFound {
+		return prog, fmt.Errorf("loop offset %d does not point to any instruction", prog.LoopOffset)
+	}
+	return prog, nil
+}
+
+// decodeInstruction decodes the instruction at the beginning of the data
+func decodeInstruction(data []byte) (Instruction, error) {
+	op := data[0]
+	var ins Instruction
+	switch {
+	case op == 0:
+		ins = Instruction{Type: EnvelopeCycle}
+	case op < 0b00100000:
+		return Instruction{Type: Wait, Data: uint16(op)}, nil
+	case op>>4 == 0b0010:
+		ins = Instruction{Type: ToneA}
+	case op>>4 == 0b0011:
+		ins = Instruction{Type: ToneB}
+	case op>>4 == 0b0111:
+		ins = Instruction{Type: ToneC}
+	case op>>4 == 0b0110:
+		return Instruction{Type: EnvelopeShape, Data: uint16(op & 0b1111)}, nil
+	case op>>5 == 0b010:
+		return Instruction{Type: NoiseRate, Data: uint16(op & 0b11111)}, nil
+	case op>>6 == 0b10:
+		return Instruction{Type: Channels, Data: uint16(op & 0b111111)}, nil
+	case op>>4 == 0b1100:
+		return Instruction{Type: VolumeA, Data: uint16(op & 0b1111)}, nil
+	case op>>4 == 0b1101:
+		return Instruction{Type: VolumeB, Data: uint16(op & 0b1111)}, nil
+	case op>>4 == 0b1110:
+		return Instruction{Type: VolumeC, Data: uint16(op & 0b1111)}, nil
+	case op == 0b11110000:
+		return Instruction{Type: EnvelopeA}, nil
+	case op == 0b11110001:
+		return Instruction{Type: EnvelopeB}, nil
+	case op == 0b11110010:
+		return Instruction{Type: EnvelopeC}, nil
+	case op>>3 == 0b11111:
+		return Instruction{Type: End}, nil
+	default:
+		return Instruction{}, fmt.Errorf("unknown instruction %08b", op)
+	}
+	// remaining multi-byte instructions
+	if len(data) < ins.Size() {
+		return Instruction{}, fmt.Errorf("truncated %v instruction", ins.Type)
+	}
+	if ins.Type == EnvelopeCycle {
+		ins.Data = uint16(data[1])<<8 | uint16(data[2])
+	} else {
+		ins.Data = uint16(op&0b1111)<<8 | uint16(data[1])
+	}
+	return ins, nil
+}
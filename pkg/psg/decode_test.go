@@ -0,0 +1,79 @@
+package psg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+func TestDecode(t *testing.T) {
+	instrs := []Instruction{
+		{Type: EnvelopeCycle, Data: 0xABCD},
+		{Type: Wait, Data: 0b10101},
+		{Type: ToneA, Data: 0xDCA},
+		{Type: ToneB, Data: 0xADC},
+		{Type: ToneC, Data: 0x123},
+		{Type: EnvelopeShape, Data: 0b1010},
+		{Type: NoiseRate, Data: 0b11000},
+		{Type: Channels, Data: 0b010101},
+		{Type: VolumeA, Data: 0b1111},
+		{Type: VolumeB, Data: 0b1001},
+		{Type: VolumeC, Data: 0b1110},
+		{Type: EnvelopeA},
+		{Type: EnvelopeB},
+		{Type: EnvelopeC},
+		{Type: End},
+	}
+	// loop starting at the Wait instruction
+	prog, err := Decode(append([]byte{5, 0}, encodeInstructions(instrs)...))
+	require.NoError(t, err)
+	assert.Equal(t, Program{LoopOffset: 5, Instructions: instrs}, prog)
+}
+
+func TestDecode_Export(t *testing.T) {
+	// the decoded song must be encoded again as the same binary
+	for _, src := range []string{
+		"@ch1 <- a4&a16 | b8^8.^2\n",
+		"tempo 140\n@ch1 <- c8 c8 c8 c8\n@ch2 <- (d8 d8 d8)3 d4\n--\n@ch1 <- e\n@ch2 <- f\n",
+		"$drum := psg {\n pattern: 9\n cycle: 1000\n noise: 12\n}\n@ch1 <- $drum a v3 r\nloop:\n@ch2 <- n3 b\n",
+	} {
+		t.Run(src, func(t *testing.T) {
+			s, err := lang.Parse(strings.NewReader(src))
+			require.NoError(t, err)
+			songBytes, err := Export(s)
+			require.NoError(t, err)
+			prog, err := Decode(songBytes)
+			require.NoError(t, err)
+			assert.Equal(t, songBytes[:2], []byte{byte(prog.LoopOffset), byte(prog.LoopOffset >> 8)})
+			assert.Equal(t, songBytes[2:], encodeInstructions(prog.Instructions))
+		})
+	}
+}
+
+func TestDecode_Errors(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"no header":      {0},
+		"no end":         {0, 0, 0b10111110, 30},
+		"truncated tone": {0, 0, 0x21},
+		"unknown":        {0, 0, 0b11110100, 0b11111000},
+		"data after end": {0, 0, 0b11111000, 30},
+		"wrong loop":     {3, 0, 0x21, 0xAC, 0b11111000},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := Decode(data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestInstructionString(t *testing.T) {
+	assert.Equal(t, "TONEA 254 (o4 a)", Instruction{Type: ToneA, Data: 0xFE}.String())
+	assert.Equal(t, "TONEC 4095", Instruction{Type: ToneC, Data: 0xFFF}.String())
+	assert.Equal(t, "MIXER tone:AC noise:B", Instruction{Type: Channels, Data: 0b101_010}.String())
+	assert.Equal(t, "WAIT  30", Instruction{Type: Wait, Data: 30}.String())
+	assert.Equal(t, "END", Instruction{Type: End}.String())
+}
@@ -1,6 +1,7 @@
 package psg
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math"
@@ -17,16 +18,32 @@ const (
 	defaultHZ     = 60
 	maxChannels   = 3
 	defaultOctave = 4
+	maxVolume     = 15
 )
 
+// errFramesOverflow is returned when the exact frame of an item can't be represented (e.g. the
+// frames of many tuplets with different ratios)
+var errFramesOverflow = errors.New("the exact frame of the item overflows. There are too many different tuplets or tempos")
+
 type psgEncoder struct {
 	bpm             int
 	hz              int
 	channels        channelReg
-	framesCounter   int
-	chFramesCounter map[string]int
+	framesCounter   int                      // frames that have been already waited
+	chFramesCounter map[string]song.Duration // exact frame where each channel ends, with fractions
 	channelOrder    map[string]int
 	octaves         map[string]int
+	// last volume written for each channel. Absent if never written
+	volumes map[string]int
+	// channels whose volume is driven by the envelope generator. Absent if it is not known, since
+	// the start of the loop can be reached from the start or from the end of the song
+	envelopes map[string]bool
+	// true if the mixer register is not known, so the next mix of a channel must be written
+	mixerUnknown bool
+	// channels that mix noise into their notes
+	noises map[string]bool
+	// last noise rate written. Nil if never written
+	noiseRate *int
 }
 
 func Export(s *song.Song) ([]byte, error) {
@@ -41,34 +58,67 @@ func Export(s *song.Song) ([]byte, error) {
 		if blockNum == s.LoopIndex {
 			data[0] = byte(len(data))
 			data[1] = byte(len(data) >> 8)
+			enc.startLoop()
 		}
 		sbr := reader.NewSyncedBlock(s.Blocks[blockNum])
 		for ti, ch := sbr.Next(); ch != ""; ti, ch = sbr.Next() {
 			itemData, err := enc.encodeTablatureItem(ti, ch)
 			if err != nil {
-				return nil, err
+				return nil, sourceError(ti, err)
 			}
 			data = append(data, itemData...)
-			if waitData := enc.encodedWaitTime(enc.nearestFrame); len(waitData) > 0 {
-				data = append(data, waitData...)
+			waitData, err := enc.encodedWaitTime(enc.nearestFrame)
+			if err != nil {
+				return nil, sourceError(ti, err)
 			}
+			data = append(data, waitData...)
 		}
 		// At the end of a block, we need to wait for the farthest wait time
-		// and sync all the channels to the current frame counter
-		if waitData := enc.encodedWaitTime(enc.farthestFrame); len(waitData) > 0 {
-			data = append(data, waitData...)
+		// and sync all the channels to the end of the longest one
+		waitData, err := enc.encodedWaitTime(enc.farthestFrame)
+		if err != nil {
+			return nil, err
 		}
+		data = append(data, waitData...)
+		end := enc.blockEnd()
 		for k := range enc.chFramesCounter {
-			enc.chFramesCounter[k] = enc.framesCounter
+			enc.chFramesCounter[k] = end
 		}
 	}
-	data = append(data, (&instruction{Type: end}).encode()...)
+	data = append(data, (&Instruction{Type: End}).encode()...)
 	return data, nil
 }
 
+// sourceError prefixes the error with the location of the item that caused it in the source code
+func sourceError(ti song.TablatureItem, err error) error {
+	switch {
+	case ti.Source != nil:
+		return fmt.Errorf("%v - %w", ti.Source, err)
+	case ti.Instrument != nil:
+		return fmt.Errorf("%v - %w", ti.Instrument.Position, err)
+	}
+	return err
+}
+
+// FrameRate returns the refresh rate of the destination machine, in Hz, from the psg.hz
+// property of the song (60 if it is not set)
+func FrameRate(s *song.Song) (int, error) {
+	hzStr, ok := s.Properties[hzKey]
+	if !ok {
+		return defaultHZ, nil
+	}
+	hz, err := strconv.Atoi(hzStr)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing %q property: %w", hzKey, err)
+	}
+	if hz <= 0 {
+		return 0, fmt.Errorf("%q property must be a positive number. Got %d", hzKey, hz)
+	}
+	return hz, nil
+}
+
 func newPsgEncoder(s *song.Song) (*psgEncoder, error) {
 	bps := defaultBPS
-	hz := defaultHZ
 	if bpsStr, ok := s.Properties[tempoKey]; ok {
 		var err error
 		if bps, err = strconv.Atoi(bpsStr); err != nil {
@@ -77,20 +127,23 @@ func newPsgEncoder(s *song.Song) (*psgEncoder, error) {
 	} else {
 		log.Printf("assuming default %s: %v bpm", tempoKey, defaultBPS)
 	}
-	if hzStr, ok := s.Properties[hzKey]; ok {
-		var err error
-		if hz, err = strconv.Atoi(hzStr); err != nil {
-			return nil, fmt.Errorf("error parsing %q property: %w", hzKey, err)
-		}
-	} else {
-		log.Printf("assuming default %v: %v bpm", hzKey, defaultHZ)
+	hz, err := FrameRate(s)
+	if err != nil {
+		return nil, err
+	}
+	// logged here, since the frame rate is read by the callers of Export, too
+	if _, ok := s.Properties[hzKey]; !ok {
+		log.Printf("assuming default %s: %v hz", hzKey, defaultHZ)
 	}
 	// channel frames counter must be preloaded with all the channels
-	cfc := map[string]int{}
+	cfc := map[string]song.Duration{}
 	octaves := map[string]int{}
+	// the player starts with fixed volumes in all the channels
+	envelopes := map[string]bool{}
 	for name := range s.ChannelNames {
-		cfc[name] = 0
+		cfc[name] = song.Duration{}
 		octaves[name] = defaultOctave
+		envelopes[name] = false
 	}
 	return &psgEncoder{
 		bpm:             bps,
@@ -100,9 +153,23 @@ func newPsgEncoder(s *song.Song) (*psgEncoder, error) {
 		chFramesCounter: cfc,
 		channelOrder:    map[string]int{},
 		octaves:         octaves,
+		volumes:         map[string]int{},
+		envelopes:       envelopes,
+		noises:          map[string]bool{},
 	}, nil
 }
 
+// startLoop forgets the state of the PSG that the encoder assumes from the previous items. The
+// loop is reached from the start of the song, but also from its end, when the PSG state can be
+// different, so the items of the loop must write all the registers that they need
+func (c *psgEncoder) startLoop() {
+	for ch := range c.envelopes {
+		delete(c.envelopes, ch)
+	}
+	c.mixerUnknown = true
+	c.noiseRate = nil
+}
+
 func (pe *psgEncoder) encodeTablatureItem(ti song.TablatureItem, channel string) ([]byte, error) {
 	switch {
 	case ti.Note != nil:
@@ -121,129 +188,256 @@ func (pe *psgEncoder) encodeTablatureItem(ti song.TablatureItem, channel string)
 			return nil, err
 		}
 		return encodeInstructions(instrs), nil
+	case ti.Noise != nil:
+		instrs, err := pe.encodeNoise(ti.Noise, channel)
+		if err != nil {
+			return nil, err
+		}
+		return encodeInstructions(instrs), nil
+	case ti.Tempo != nil:
+		if err := pe.changeTempo(*ti.Tempo, channel); err != nil {
+			return nil, err
+		}
 	case ti.Volume != nil:
-		// TODO
+		instrs, err := pe.encodeVolume(*ti.Volume, channel)
+		if err != nil {
+			return nil, err
+		}
+		return encodeInstructions(instrs), nil
 	case ti.Instrument != nil:
-		// TODO
+		instrs, err := pe.encodeInstrument(ti.Instrument, channel)
+		if err != nil {
+			return nil, err
+		}
+		return encodeInstructions(instrs), nil
+	case ti.Bar:
+		// bar lines don't sound
 	default:
 		panic(fmt.Sprintf("BUG! wrong value %#v", ti))
 	}
 	return nil, nil
 }
 
-func (pe *psgEncoder) encodedWaitTime(waitFunc func() int) []byte {
+// encodedWaitTime returns the wait instructions until the frame returned by waitFunc. It refuses
+// to wait backwards, since a wait of 0 frames would be encoded as an EnvelopeCycle instruction
+func (pe *psgEncoder) encodedWaitTime(waitFunc func() int) ([]byte, error) {
 	ftw := waitFunc()
+	if ftw < 0 {
+		return nil, fmt.Errorf("BUG detected. Waiting %d frames", ftw)
+	}
 	if ftw == 0 {
-		return nil
+		return nil, nil
 	}
-	var waits []instruction
+	var waits []Instruction
 
 	pe.framesCounter += ftw
 	// wait instruction does not allow more than 5-byte wait times (32 frames). Concatenate waits if needed
 	for ftw > maxWaitValue {
-		waits = append(waits, instruction{Type: wait, Data: maxWaitValue})
+		waits = append(waits, Instruction{Type: Wait, Data: maxWaitValue})
 		ftw -= maxWaitValue
 	}
-	waits = append(waits, instruction{Type: wait, Data: uint16(ftw)})
-	return encodeInstructions(waits)
+	waits = append(waits, Instruction{Type: Wait, Data: uint16(ftw)})
+	return encodeInstructions(waits), nil
 }
 
-func pow2(n int) int {
-	pow := 1
-	for i := 0; i < n; i++ {
-		pow *= 2
+func (c *psgEncoder) encodeSilence(silence *song.Silence, channel string) ([]Instruction, error) {
+	// enable channel, if not yet enabled
+	channelOrder := c.orderFor(channel)
+	if channelOrder >= maxChannels {
+		return nil,
+			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channel)
 	}
-	return pow
+	// todo: make sure we enable/disable channels at the beginning of a loop, to avoid loosing status
+	instrs := c.mixChannel(channelOrder, false, false)
+
+	if err := c.addFramesCount(channel, c.framesFor(silence.Beats())); err != nil {
+		return nil, err
+	}
+	return instrs, nil
 }
 
-func (c *psgEncoder) encodeSilence(silence *song.Silence, channel string) ([]instruction, error) {
-	// enable channel, if not yet enabled
+func (c *psgEncoder) encodeVolume(volume int, channel string) ([]Instruction, error) {
 	channelOrder := c.orderFor(channel)
 	if channelOrder >= maxChannels {
 		return nil,
-			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channels)
+			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channel)
 	}
-	var instrs []instruction
-	// todo: make sure we enable/disable channels at the beginning of a loop, to avoid loosing status
-	if c.channels.toneEnabled(channelOrder) {
-		// todo: optimize: wrap multiple channel sets into one single instruction
-		c.channels.disableTone(channelOrder)
-		instrs = append(instrs, instruction{Type: channels, Data: uint16(c.channels)})
+	// avoid writing again the volume if it didn't change. Writing the volume
+	// also disables the envelope on the channel
+	if last, ok := c.volumes[channel]; ok && last == volume && c.fixedVolume(channel) {
+		return nil, nil
 	}
+	c.volumes[channel] = volume
+	c.envelopes[channel] = false
+	var volumeTypes = [maxChannels]InstructionType{VolumeA, VolumeB, VolumeC}
+	return []Instruction{{Type: volumeTypes[channelOrder], Data: uint16(volume)}}, nil
+}
 
-	frames := c.framesFor(silence.Length, 1, 1)
-	c.addFramesCount(channel, frames)
+func (c *psgEncoder) encodeInstrument(inst *song.Instrument, channel string) ([]Instruction, error) {
+	channelOrder := c.orderFor(channel)
+	if channelOrder >= maxChannels {
+		return nil,
+			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channel)
+	}
+	pi, err := parseInstrument(inst)
+	if err != nil {
+		return nil, err
+	}
+	var instrs []Instruction
+	if pi.cycle != nil {
+		instrs = append(instrs, Instruction{Type: EnvelopeCycle, Data: uint16(*pi.cycle)})
+	}
+	if pi.pattern != nil {
+		var envelopeTypes = [maxChannels]InstructionType{EnvelopeA, EnvelopeB, EnvelopeC}
+		instrs = append(instrs,
+			Instruction{Type: EnvelopeShape, Data: uint16(*pi.pattern)},
+			Instruction{Type: envelopeTypes[channelOrder]})
+		c.envelopes[channel] = true
+	} else if !c.fixedVolume(channel) {
+		// restore the fixed volume that was overridden by the previous instrument envelope, or
+		// that is not known at the start of the loop
+		volume, ok := c.volumes[channel]
+		if !ok {
+			volume = maxVolume
+		}
+		vi, err := c.encodeVolume(volume, channel)
+		if err != nil {
+			return nil, err
+		}
+		instrs = append(instrs, vi...)
+	}
+	if pi.noise != nil {
+		instrs = append(instrs, c.setNoiseRate(*pi.noise)...)
+	}
+	// the noise will be mixed in the channel from the next note
+	c.noises[channel] = pi.noise != nil
 	return instrs, nil
 }
 
-func (c *psgEncoder) encodeNote(note *song.Note, channel string) ([]instruction, error) {
+// fixedVolume returns true if the channel is known to play with the fixed volume of its
+// volume register instead of the envelope generator
+func (c *psgEncoder) fixedVolume(channel string) bool {
+	envelope, ok := c.envelopes[channel]
+	return ok && !envelope
+}
+
+// mixChannel enables or disables the tone and noise of a channel, returning the
+// channels instruction only if the mixer status changed
+func (c *psgEncoder) mixChannel(channelOrder int, tone, noise bool) []Instruction {
+	mix := c.channels
+	if tone {
+		mix.enableTone(channelOrder)
+	} else {
+		mix.disableTone(channelOrder)
+	}
+	if noise {
+		mix.enableNoise(channelOrder)
+	} else {
+		mix.disableNoise(channelOrder)
+	}
+	if mix == c.channels && !c.mixerUnknown {
+		return nil
+	}
+	// todo: optimize: wrap multiple channel sets into one single instruction
+	c.channels, c.mixerUnknown = mix, false
+	return []Instruction{{Type: Channels, Data: uint16(mix)}}
+}
+
+func (c *psgEncoder) encodeNote(note *song.Note, channel string) ([]Instruction, error) {
 	// enable channel, if not yet enabled
 	channelOrder := c.orderFor(channel)
 	if channelOrder >= maxChannels {
 		return nil,
-			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channels)
+			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channel)
 	}
-	var instrs []instruction
 	// todo: make sure we enable/disable channels at the beginning of a loop, to avoid loosing status
-	if !c.channels.toneEnabled(channelOrder) {
-		// todo: set tone/noise depending on the instrument type
-		c.channels.enableTone(channelOrder)
-		// todo: optimize: wrap multiple channel sets into one single instruction
-		instrs = append(instrs, instruction{Type: channels, Data: uint16(c.channels)})
-	}
+	instrs := c.mixChannel(channelOrder, true, c.noises[channel])
 
-	var noteTypes = [maxChannels]instructionType{toneA, toneB, toneC}
+	var noteTypes = [maxChannels]InstructionType{ToneA, ToneB, ToneC}
 	// calculate how many frames we should wait after this note and advance the channel beats
 	// counter
-	dnd, dor := 1, 1
-	for d := 1; d <= note.Dots; d++ {
-		up := 1
-		down := pow2(d)
-		dnd = dnd*down + up*dor
-		dor = dor * down
-	}
-	// todo: do also quatriplets, quintuplets, sextuplets, etc...
-	if note.Tuplet == 3 {
-		dnd *= 2
-		dor *= 3
+	if err := c.addFramesCount(channel, c.framesFor(note.Beats())); err != nil {
+		return nil, err
 	}
-	frames := c.framesFor(note.Length, dnd, dor)
-	c.addFramesCount(channel, frames)
 
 	// get tone part
 	freq, err := c.frequencyFor(note, c.octaves[channel])
 	if err != nil {
 		return nil, err
 	}
-	instrs = append(instrs, instruction{
+	instrs = append(instrs, Instruction{
 		Type: noteTypes[channelOrder],
 		Data: freq,
 	})
 	return instrs, nil
 }
 
-// todo: calculate accumulated error
-// number of frames to wait for a given length
-// dividend and divisor would be 1 unless you want to alter the length size (tuplets, dots...)
-func (c *psgEncoder) framesFor(length, dividend, divisor int) int {
-	// 4 beats       1min      60s    c.hz frames
-	// ------- * ----------- * ---- * ----------- * (dividend/divisor)
-	// length    c.bpm beats   1min       1s
-	return (4 * 60 * c.hz * dividend) / (length * c.bpm * divisor)
+func (c *psgEncoder) encodeNoise(noise *song.Noise, channel string) ([]Instruction, error) {
+	channelOrder := c.orderFor(channel)
+	if channelOrder >= maxChannels {
+		return nil,
+			fmt.Errorf("can't assign an order to channel %q. PSG can't handle more than 3 channels", channel)
+	}
+	// noise hits only sound through the noise generator
+	instrs := c.mixChannel(channelOrder, false, true)
+	instrs = append(instrs, c.setNoiseRate(noise.Period)...)
+
+	if err := c.addFramesCount(channel, c.framesFor(noise.Beats())); err != nil {
+		return nil, err
+	}
+	return instrs, nil
 }
 
-func (c *psgEncoder) addFramesCount(channel string, frames int) {
-	if chTime, ok := c.chFramesCounter[channel]; ok {
-		c.chFramesCounter[channel] = chTime + frames
-	} else {
-		c.chFramesCounter[channel] = frames
+// setNoiseRate returns the noiseRate instruction only if it differs from the last written rate.
+// Noise generator is shared by all the channels
+func (c *psgEncoder) setNoiseRate(rate int) []Instruction {
+	if c.noiseRate != nil && *c.noiseRate == rate {
+		return nil
+	}
+	c.noiseRate = &rate
+	return []Instruction{{Type: NoiseRate, Data: uint16(rate)}}
+}
+
+// changeTempo sets the tempo for the rest of the song, from the current position of the
+// channel. The notes from other channels that are still sounding at this point are
+// stretched or shrunk to keep all the channels synchronized in beats
+func (c *psgEncoder) changeTempo(bpm int, channel string) error {
+	now := c.chFramesCounter[channel]
+	for ch, end := range c.chFramesCounter {
+		if now.Less(end) {
+			c.chFramesCounter[ch] = now.Add(end.Sub(now).Mul(int64(c.bpm), int64(bpm)))
+			if c.chFramesCounter[ch].Overflow() {
+				return errFramesOverflow
+			}
+		}
 	}
+	c.bpm = bpm
+	return nil
 }
 
+// framesFor returns the exact number of frames of the given beats
+func (c *psgEncoder) framesFor(beats song.Duration) song.Duration {
+	//         1min      60s    c.hz frames
+	// beats * ----------- * ---- * -----------
+	//         c.bpm beats   1min       1s
+	return beats.Mul(int64(60*c.hz), int64(c.bpm))
+}
+
+func (c *psgEncoder) addFramesCount(channel string, frames song.Duration) error {
+	end := c.chFramesCounter[channel].Add(frames)
+	if end.Overflow() {
+		return errFramesOverflow
+	}
+	c.chFramesCounter[channel] = end
+	return nil
+}
+
+// nearestFrame returns the frames to wait until the next channel finishes its last item.
+// A channel finishes at the whole frame where its exact end falls
 func (c *psgEncoder) nearestFrame() int {
 	nearest := math.MaxInt64
 	for _, t := range c.chFramesCounter {
-		dist := t - c.framesCounter
+		dist := int(t.Floor()) - c.framesCounter
 		if dist >= 0 && dist < nearest {
 			nearest = dist
 		}
@@ -252,14 +446,18 @@ func (c *psgEncoder) nearestFrame() int {
 }
 
 func (c *psgEncoder) farthestFrame() int {
-	farthest := 0
+	return int(c.blockEnd().Floor()) - c.framesCounter
+}
+
+// blockEnd returns the exact frame where the last channel finishes
+func (c *psgEncoder) blockEnd() song.Duration {
+	end := song.NewDuration(int64(c.framesCounter), 1)
 	for _, t := range c.chFramesCounter {
-		dist := t - c.framesCounter
-		if dist > farthest {
-			farthest = dist
+		if end.Less(t) {
+			end = t
 		}
 	}
-	return farthest
+	return end
 }
 
 func (c *psgEncoder) orderFor(channel string) int {
@@ -427,11 +625,12 @@ var frequencies = map[noteKey]uint16{
 func (c *psgEncoder) frequencyFor(n *song.Note, octave int) (uint16, error) {
 	freq, ok := frequencies[noteKey{pitch: n.Pitch, half: n.Halftone, octave: octave}]
 	if !ok {
-		ht := byte(n.Halftone)
-		if ht == 0 {
-			ht = ' '
-		}
-		return 0, fmt.Errorf("unsupported note: %c%c for octave %d", n.Pitch, ht, octave)
+		// the table only has the natural, sharp and flat spellings of the black keys
+		nn, shift := n.Normalized()
+		freq, ok = frequencies[noteKey{pitch: nn.Pitch, half: nn.Halftone, octave: octave + shift}]
+	}
+	if !ok {
+		return 0, fmt.Errorf("unsupported note: %c%v for octave %d", n.Pitch, n.Halftone, octave)
 	}
 	return freq, nil
 }
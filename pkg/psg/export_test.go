@@ -18,28 +18,28 @@ func TestExportNotes(t *testing.T) {
 	require.NoError(t, err)
 	songBytes, err := Export(song)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0xfe},
-		{Type: channels, Data: 0b111_100},
-		{Type: toneB, Data: 0x17d},
-		{Type: channels, Data: 0b111_000},
-		{Type: toneC, Data: 0xfe},
-		{Type: wait, Data: 30},
-		{Type: toneC, Data: 0xe3},
-		{Type: wait, Data: 30},
-		{Type: toneB, Data: 0x153}, // e1
-		{Type: wait, Data: 31},
-		{Type: wait, Data: 29},
-		{Type: toneA, Data: 0xE3}, //b2
-		{Type: wait, Data: 30},
-		{Type: toneC, Data: 0x17d},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0x1ac},
-		{Type: toneB, Data: 0x140},
-		{Type: wait, Data: 30},
-		{Type: wait, Data: 15}, // at the end of the block, syncing to the added dot
-		{Type: end},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xfe},
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x17d},
+		{Type: Channels, Data: 0b111_000},
+		{Type: ToneC, Data: 0xfe},
+		{Type: Wait, Data: 30},
+		{Type: ToneC, Data: 0xe3},
+		{Type: Wait, Data: 30},
+		{Type: ToneB, Data: 0x153}, // e1
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 29},
+		{Type: ToneA, Data: 0xE3}, //b2
+		{Type: Wait, Data: 30},
+		{Type: ToneC, Data: 0x17d},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x1ac},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 30},
+		{Type: Wait, Data: 15}, // at the end of the block, syncing to the added dot
+		{Type: End},
 	})...)
 
 	assert.Equal(t, expected, songBytes)
@@ -55,18 +55,18 @@ psg.hz 50
 	require.NoError(t, err)
 	songBytes, err := Export(song)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0x7F}, // octave 5 a
-		{Type: channels, Data: 0b111_100},
-		{Type: toneB, Data: 0x1AC}, // octave 4 c
-		{Type: wait, Data: 31},
-		{Type: wait, Data: 19},
-		{Type: toneA, Data: 0x39},  // octave 6 b
-		{Type: toneB, Data: 0x2FA}, // octave 3 d
-		{Type: wait, Data: 31},
-		{Type: wait, Data: 19},
-		{Type: end},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x7F}, // octave 5 a
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x1AC}, // octave 4 c
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 19},
+		{Type: ToneA, Data: 0x39},  // octave 6 b
+		{Type: ToneB, Data: 0x2FA}, // octave 3 d
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 19},
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 }
@@ -78,34 +78,34 @@ func TestSilences(t *testing.T) {
 	require.NoError(t, err)
 	songBytes, err := Export(song)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: wait, Data: 31}, // 4 beats waiting
-		{Type: wait, Data: 31},
-		{Type: wait, Data: 31},
-		{Type: wait, Data: 27},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Wait, Data: 31}, // 4 beats waiting
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 27},
 
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0xfe},
-		{Type: wait, Data: 30}, // wait for the note
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xfe},
+		{Type: Wait, Data: 30}, // wait for the note
 
-		{Type: channels, Data: 0b111_111},
-		{Type: wait, Data: 31}, // 2 beats silence waiting
-		{Type: wait, Data: 29},
+		{Type: Channels, Data: 0b111_111},
+		{Type: Wait, Data: 31}, // 2 beats silence waiting
+		{Type: Wait, Data: 29},
 
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0xE3},
-		{Type: wait, Data: 30},
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
 
-		{Type: channels, Data: 0b111_111},
-		{Type: wait, Data: 30}, // 1 beat silence waiting
+		{Type: Channels, Data: 0b111_111},
+		{Type: Wait, Data: 30}, // 1 beat silence waiting
 
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0x1ac},
-		{Type: wait, Data: 30},
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1ac},
+		{Type: Wait, Data: 30},
 
-		{Type: channels, Data: 0b111_111},
-		{Type: wait, Data: 15}, // 1/2 beat silence waiting
-		{Type: end},
+		{Type: Channels, Data: 0b111_111},
+		{Type: Wait, Data: 15}, // 1/2 beat silence waiting
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 
@@ -118,17 +118,101 @@ func TestParseTupletWithOctaveChange(t *testing.T) {
 	require.NoError(t, err)
 	songBytes, err := Export(s)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},
-		{Type: toneA, Data: 0xfe}, // octave 4
-		{Type: wait, Data: 20},
-		{Type: toneA, Data: 0x7F}, // octave 5
-		{Type: wait, Data: 20},
-		{Type: toneA, Data: 0x7F}, // octave 5
-		{Type: wait, Data: 20},
-		{Type: toneA, Data: 0x7F}, // octave 5
-		{Type: wait, Data: 30},
-		{Type: end},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xfe}, // octave 4
+		{Type: Wait, Data: 20},
+		{Type: ToneA, Data: 0x7F}, // octave 5
+		{Type: Wait, Data: 20},
+		{Type: ToneA, Data: 0x7F}, // octave 5
+		{Type: Wait, Data: 20},
+		{Type: ToneA, Data: 0x7F}, // octave 5
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportTuplets(t *testing.T) {
+	// a quintuplet nested into a triplet, against another quintuplet
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- (c (d d d d d)5 c)3 e
+@ch2 <- (f f f f f)5 g
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1AC}, // c: 20 frames
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x140}, // f: 24 frames
+		{Type: Wait, Data: 20},
+		{Type: ToneA, Data: 0x17D}, // d: 16 frames
+		{Type: Wait, Data: 4},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 12},
+		{Type: ToneA, Data: 0x17D},
+		{Type: Wait, Data: 12},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 4},
+		{Type: ToneA, Data: 0x17D},
+		{Type: Wait, Data: 16},
+		{Type: ToneA, Data: 0x17D},
+		{Type: Wait, Data: 4},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 12},
+		{Type: ToneA, Data: 0x17D},
+		{Type: Wait, Data: 12},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 4},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Wait, Data: 20},
+		// both channels are synchronized after 4 beats
+		{Type: ToneA, Data: 0x153},
+		{Type: ToneB, Data: 0x11D},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportNoDrift(t *testing.T) {
+	// at 140 bpm, eighths and triplets don't last an integer number of frames
+	s, err := lang.Parse(strings.NewReader(`
+tempo 140
+@ch1 <- c8 c8 c8 c8
+@ch2 <- (d8 d8 d8)3 d4
+--
+@ch1 <- e
+@ch2 <- f
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1AC}, // c: 12.86 frames
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x17D}, // d: 8.57 frames
+		{Type: Wait, Data: 8},
+		{Type: ToneB, Data: 0x17D},
+		{Type: Wait, Data: 4},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Wait, Data: 5},
+		{Type: ToneB, Data: 0x17D},
+		{Type: Wait, Data: 8},
+		// both channels are synchronized after a beat (25.71 frames)
+		{Type: ToneA, Data: 0x1AC},
+		{Type: ToneB, Data: 0x17D},
+		{Type: Wait, Data: 13},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Wait, Data: 13},
+		// sync barrier after 2 beats (51.43 frames). The fraction is carried to the next block
+		{Type: ToneA, Data: 0x153},
+		{Type: ToneB, Data: 0x140},
+		{Type: Wait, Data: 26},
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 }
@@ -143,17 +227,20 @@ loop:
 	require.NoError(t, err)
 	songBytes, err := Export(s)
 	require.NoError(t, err)
-	expected := append([]byte{9, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},		// songBytes[2],
-		{Type: toneA, Data: 0xFE}, // o4 a		   songBytes[3]
-		{Type: wait, Data: 30},                 // songBytes[5],
-		{Type: toneA, Data: 0xE3}, // o4 b         songBytes[6]
-		{Type: wait, Data: 30},				    // songBytes[8],
-		{Type: toneA, Data: 0xD6}, // o5 c         songBytes[9] <-- loop here!
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xBE}, // o5 d
-		{Type: wait, Data: 30},
-		{Type: end},
+	expected := append([]byte{9, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},		// songBytes[2],
+		{Type: ToneA, Data: 0xFE}, // o4 a		   songBytes[3]
+		{Type: Wait, Data: 30},                 // songBytes[5],
+		{Type: ToneA, Data: 0xE3}, // o4 b         songBytes[6]
+		{Type: Wait, Data: 30},				    // songBytes[8],
+		// songBytes[9] <-- loop here! The loop writes again the mixer, since it can be reached
+		// from the end of the song
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xD6}, // o5 c
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xBE}, // o5 d
+		{Type: Wait, Data: 30},
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 
@@ -168,29 +255,437 @@ $a := ab>c
 	require.NoError(t, err)
 	songBytes, err := Export(s)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},		// songBytes[2],
-		{Type: toneA, Data: 0x17D},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xFE},  // first $a
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xE3},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xD6},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xFE},   // second $a
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xE3},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0xD6},
-		{Type: wait, Data: 30},
-		{Type: toneA, Data: 0x153},
-		{Type: wait, Data: 30},
-		{Type: end},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},		// songBytes[2],
+		{Type: ToneA, Data: 0x17D},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xFE},  // first $a
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xD6},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xFE},   // second $a
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xD6},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x153},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportVolumes(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- v15 a v15 b v8 c
+@ch2 <- r2 v3 d
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: VolumeA, Data: 15},
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 30},
+		// second v15 is not written again
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: VolumeA, Data: 8},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: VolumeB, Data: 3},
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x17D},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportLoop_RepeatedState(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- v8 a
+@ch2 <- n5,8 n5,8
+loop:
+@ch1 <- v8 b v15 c
+@ch2 <- n5,8 n7,8
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{10, 0}, encodeInstructions([]Instruction{
+		{Type: VolumeA, Data: 8},
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Channels, Data: 0b101_110},
+		{Type: NoiseRate, Data: 5},
+		{Type: Wait, Data: 15},
+		// second n5 is not written again
+		{Type: Wait, Data: 15},
+		// loop start: the song end leaves the volume at 15 and the noise rate at 7, so the
+		// volume, the mixer and the noise rate are written again
+		{Type: VolumeA, Data: 8},
+		{Type: Channels, Data: 0b101_110},
+		{Type: ToneA, Data: 0xE3},
+		{Type: NoiseRate, Data: 5},
+		{Type: Wait, Data: 15},
+		{Type: NoiseRate, Data: 7},
+		{Type: Wait, Data: 15},
+		{Type: VolumeA, Data: 15},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+
+	// the replayed loop plays b with volume 8 and noise rate 5 again
+	frames, err := Simulate(songBytes, 30+30+30+1+5)
+	require.NoError(t, err)
+	require.Len(t, frames, 96)
+	loop := frames[91]
+	assert.True(t, loop.Loop)
+	assert.Equal(t, uint16(0xE3), loop.Registers.Tone(0))
+	assert.Equal(t, uint8(8), loop.Registers[regVolumeA])
+	assert.Equal(t, uint8(5), loop.Registers[regNoise])
+}
+
+func TestExportInstruments(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+$drum := psg {
+	pattern: 9
+	cycle: 1000
+	noise: 12
+}
+$flat := psg { }
+@ch1 <- $drum a r $flat b
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: EnvelopeCycle, Data: 1000},
+		{Type: EnvelopeShape, Data: 9},
+		{Type: EnvelopeA},
+		{Type: NoiseRate, Data: 12},
+		{Type: Channels, Data: 0b110_110}, // tone + noise
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 30},
+		{Type: Channels, Data: 0b111_111},
+		{Type: Wait, Data: 30},
+		{Type: VolumeA, Data: 15}, // restoring volume after envelope
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportInstruments_Frequency(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+$i := psg { frequency: 7 }
+@ch1 <- $i
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: EnvelopeCycle, Data: 998},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportInstruments_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		inst string
+		msg  string
+	}{
+		{inst: `psg { wave: sine }`, msg: `unknown psg instrument property "wave"`},
+		{inst: `psg { pattern: 16 }`, msg: `property "pattern" must be in range 0 to 15. Got 16`},
+		{inst: `psg { noise: 32 }`, msg: `property "noise" must be in range 0 to 31. Got 32`},
+		{inst: `psg { cycle: lots }`, msg: `property "cycle" must be a number. Got "lots"`},
+		{inst: `psg { cycle: 3 frequency: 3 }`, msg: `can't set both "cycle" and "frequency"`},
+		{inst: `psg { wave: sine pattern: 16 }`, msg: `property "pattern" must be in range 0 to 15. Got 16`},
+		{inst: `psg { pattern: 16 noise: 32 }`, msg: `property "noise" must be in range 0 to 31. Got 32`},
+		{inst: `ym2413 { }`, msg: `unsupported instrument class "ym2413"`},
+	} {
+		t.Run(tc.inst, func(t *testing.T) {
+			s, err := lang.Parse(strings.NewReader(`
+@ch1 <- a
+$i := ` + tc.inst + `
+@ch1 <- $i
+`))
+			require.NoError(t, err)
+			_, err = Export(s)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "3:7 (from $i at 4:9) - ")
+			assert.Contains(t, err.Error(), tc.msg)
+		})
+	}
+}
+
+func TestExportErrors_Source(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		msg string
+	}{
+		{src: "@ch1 <- o8 a > b\n", msg: "1:16 - unsupported note: b for octave 9"},
+		{src: "$riff := c d e\n@ch1 <- a\n@ch2 <- o9 $riff\n",
+			msg: "1:10 (from $riff at 3:12) - unsupported note: c for octave 9"},
+		{src: "@a <- c\n@b <- c\n@c <- c\n@d <- c\n",
+			msg: `4:7 - can't assign an order to channel "d". PSG can't handle more than 3 channels`},
+		// the tempo changes stretch the rest of the note of @a by coprime ratios
+		{src: "@a <- c1 c1 c1 c1\n@b <- t997 c64 t991 c64 t983 c64 t977 c64 t971 c64 t967 c64 t953 c64 t947\n",
+			msg: "2:52 - the exact frame of the item overflows. There are too many different tuplets or tempos"},
+	} {
+		t.Run(tc.src, func(t *testing.T) {
+			s, err := lang.Parse(strings.NewReader(tc.src))
+			require.NoError(t, err)
+			_, err = Export(s)
+			require.Error(t, err)
+			assert.Equal(t, tc.msg, err.Error())
+		})
+	}
+}
+
+func TestEncodedWaitTime(t *testing.T) {
+	enc := psgEncoder{}
+	data, err := enc.encodedWaitTime(func() int { return 70 })
+	require.NoError(t, err)
+	assert.Equal(t, encodeInstructions([]Instruction{
+		{Type: Wait, Data: 31}, {Type: Wait, Data: 31}, {Type: Wait, Data: 8},
+	}), data)
+	assert.Equal(t, 70, enc.framesCounter)
+
+	// nothing is written for a zero wait, since it would be decoded as an EnvelopeCycle
+	data, err = enc.encodedWaitTime(func() int { return 0 })
+	require.NoError(t, err)
+	assert.Empty(t, data)
+	_, err = enc.encodedWaitTime(func() int { return -1 })
+	assert.Error(t, err)
+	assert.Equal(t, 70, enc.framesCounter)
+}
+
+func TestExportNoise(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+$snare := psg { noise: 4 }
+@a <- c c
+@b <- n10 n10,8 n6,8 $snare d
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Channels, Data: 0b101_110}, // only noise in B
+		{Type: NoiseRate, Data: 10},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x1AC},
+		// same noise rate is not written again
+		{Type: Wait, Data: 15},
+		{Type: NoiseRate, Data: 6},
+		{Type: Wait, Data: 15},
+		{Type: NoiseRate, Data: 4},
+		{Type: Channels, Data: 0b101_100}, // tone + noise in B
+		{Type: ToneB, Data: 0x17D},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportTempoChange(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+tempo 120
+@a <- c2 c2
+@b <- c4 t60 c4 c4
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Channels, Data: 0b111_100},
+		{Type: ToneB, Data: 0x1AC},
+		{Type: Wait, Data: 30}, // quarter at 120 bpm
+		// tempo changes in B while A is still sounding: the remaining beat of A
+		// is played at 60 bpm
+		{Type: ToneB, Data: 0x1AC},
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 29},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: ToneB, Data: 0x1AC},
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 29},
+		{Type: Wait, Data: 31}, // block end: waiting for the half note of A
+		{Type: Wait, Data: 29},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportDefaultLength(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- l8. a r b4
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 22}, // 22.5 frames
+		{Type: Channels, Data: 0b111_111},
+		{Type: Wait, Data: 23}, // the accumulated half frame is waited here
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportTies(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- a4&a16 | b8^8.^2
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 31}, // 30 + 7.5 frames
+		{Type: Wait, Data: 6},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 31}, // 15 + 22.5 + 60 frames, plus the previous half frame
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 31},
+		{Type: Wait, Data: 5},
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 }
 
+func TestExportRepeats(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+@ch1 <- [a |1 b |2 c]2
+@ch2 <- r1
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xE3},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xFE},
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x1AC},
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportTransposedConstants(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+$riff := c e- b
+@ch1 <- o4 $riff(-1) $riff(o5,+2) c
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x1C5}, // o3 b
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x17D}, // o4 d
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xF0}, // o4 b-
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xBE}, // o5 d
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xA0}, // o5 f
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x65}, // o6 c+
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xD6}, // o5 c
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestExportKeySignature(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`key d
+@ch1 <- o4 f c f= b# c-- e## kb- b e
+`))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},
+		{Type: ToneA, Data: 0x12E}, // o4 f+
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x194}, // o4 c+
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x140}, // o4 f
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xD6}, // o5 c
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x1E0}, // o3 b-
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x12E}, // o4 f+
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0xF0}, // o4 b-
+		{Type: Wait, Data: 30},
+		{Type: ToneA, Data: 0x168}, // o4 e-
+		{Type: Wait, Data: 30},
+		{Type: End},
+	})...)
+	assert.Equal(t, expected, songBytes)
+}
+
+func TestFrameRate(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		hz     int
+		err    string
+	}{
+		{header: "", hz: 60},
+		{header: "psg.hz 50\n", hz: 50},
+		{header: "psg.hz 0\n", err: `"psg.hz" property must be a positive number. Got 0`},
+		{header: "psg.hz -50\n", err: `"psg.hz" property must be a positive number. Got -50`},
+		{header: "psg.hz fast\n", err: `error parsing "psg.hz" property`},
+	} {
+		t.Run(tc.header, func(t *testing.T) {
+			s, err := lang.Parse(strings.NewReader(tc.header + "@ch1 <- a\n"))
+			require.NoError(t, err)
+			hz, err := FrameRate(s)
+			if tc.err != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				// the song can't be exported, either
+				_, err = Export(s)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.hz, hz)
+		})
+	}
+}
+
 func TestTemplate(t *testing.T) {
 	t.Skip()
 	s, err := lang.Parse(strings.NewReader(`
@@ -199,9 +694,9 @@ func TestTemplate(t *testing.T) {
 	require.NoError(t, err)
 	songBytes, err := Export(s)
 	require.NoError(t, err)
-	expected := append([]byte{0, 0}, encodeInstructions([]instruction{
-		{Type: channels, Data: 0b111_110},		// songBytes[2],
-		{Type: end},
+	expected := append([]byte{0, 0}, encodeInstructions([]Instruction{
+		{Type: Channels, Data: 0b111_110},		// songBytes[2],
+		{Type: End},
 	})...)
 	assert.Equal(t, expected, songBytes)
 }
\ No newline at end of file
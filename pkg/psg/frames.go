@@ -0,0 +1,53 @@
+package psg
+
+// RegisterWrite is a value that is written into a register of the PSG
+type RegisterWrite struct {
+	Register int
+	Value    uint8
+}
+
+// FrameWriter converts the frames of a Simulator into the register writes of a PSG chip, and
+// into the audio samples that each frame lasts. It is shared by the exporters that drive an
+// emulated PSG, so all of them write the same registers at the same samples
+type FrameWriter struct {
+	sampleRate, frameRate int
+	// registers written by the previous frames
+	written Registers
+	first   bool
+	// samples that were not returned by the previous frames, multiplied by the frame rate
+	remainder int
+}
+
+// NewFrameWriter returns a FrameWriter for audio of the given samples per second, which is
+// played by a machine with the given refresh rate, in Hz
+func NewFrameWriter(sampleRate, frameRate int) *FrameWriter {
+	return &FrameWriter{sampleRate: sampleRate, frameRate: frameRate, first: true}
+}
+
+// Writes returns the register writes that change the PSG from the previous frame to the given
+// one. All the registers are written in the first frame, or if writeAll is true. The envelope
+// shape is only written when the frame writes it, since writing it restarts the envelope
+func (fw *FrameWriter) Writes(frame Frame, writeAll bool) []RegisterWrite {
+	writeAll = writeAll || fw.first
+	var writes []RegisterWrite
+	for reg, value := range frame.Registers {
+		if reg == regEnvelopeShape {
+			if frame.EnvelopeRestart {
+				writes = append(writes, RegisterWrite{Register: reg, Value: value})
+			}
+		} else if writeAll || value != fw.written[reg] {
+			writes = append(writes, RegisterWrite{Register: reg, Value: value})
+		}
+	}
+	fw.written, fw.first = frame.Registers, false
+	return writes
+}
+
+// Samples returns the samples that the next frame lasts. The samples of each frame are rounded
+// down, carrying the remainder to the next frames
+func (fw *FrameWriter) Samples() int {
+	fw.remainder += fw.sampleRate
+	samples := fw.remainder / fw.frameRate
+	fw.remainder %= fw.frameRate
+	return samples
+}
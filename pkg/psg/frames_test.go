@@ -0,0 +1,48 @@
+package psg
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFrameWriter_Writes(t *testing.T) {
+	fw := NewFrameWriter(44100, 60)
+	frame := Frame{}
+	frame.Registers[regToneAL] = 0xFE
+	frame.Registers[regMixer] = initialMixer
+	frame.Registers[regEnvelopeShape] = 13
+	// the first frame writes all the registers but the envelope shape
+	writes := fw.Writes(frame, false)
+	assert.Len(t, writes, RegistersCount-1)
+	for _, w := range writes {
+		assert.NotEqual(t, regEnvelopeShape, w.Register)
+		assert.Equal(t, frame.Registers[w.Register], w.Value)
+	}
+
+	// the following frames only write the changes
+	assert.Empty(t, fw.Writes(frame, false))
+	frame.Registers[regToneAL] = 0xE3
+	assert.Equal(t, []RegisterWrite{{Register: regToneAL, Value: 0xE3}}, fw.Writes(frame, false))
+
+	// the envelope shape is written each time that the envelope restarts, even if it didn't change
+	frame.EnvelopeRestart = true
+	assert.Equal(t, []RegisterWrite{{Register: regEnvelopeShape, Value: 13}},
+		fw.Writes(frame, false))
+	frame.EnvelopeRestart = false
+
+	// all the registers can be written again
+	assert.Len(t, fw.Writes(frame, true), RegistersCount-1)
+}
+
+func TestFrameWriter_Samples(t *testing.T) {
+	// 44100 / 60 is exact
+	fw := NewFrameWriter(44100, 60)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 735, fw.Samples())
+	}
+	// 8000 / 60 = 133.33: the remainder is carried to the next frames
+	fw = NewFrameWriter(8000, 60)
+	assert.Equal(t, []int{133, 133, 134, 133, 133, 134},
+		[]int{fw.Samples(), fw.Samples(), fw.Samples(), fw.Samples(), fw.Samples(), fw.Samples()})
+}
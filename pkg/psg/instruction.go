@@ -2,72 +2,141 @@ package psg
 
 import "fmt"
 
-type instructionType int
+// InstructionType of the PSG bytecode. See docs/design.md
+type InstructionType int
 
 const (
 	maxWaitValue = 31 // 5 bytes
 )
 
 const (
-	envelopeCycle instructionType = iota
-	wait
-	toneA
-	toneB
-	toneC
-	envelopeShape
-	noiseRate
-	channels
-	volumeA
-	volumeB
-	volumeC
-	envelopeA
-	envelopeB
-	envelopeC
-	end
+	EnvelopeCycle InstructionType = iota
+	Wait
+	ToneA
+	ToneB
+	ToneC
+	EnvelopeShape
+	NoiseRate
+	Channels
+	VolumeA
+	VolumeB
+	VolumeC
+	EnvelopeA
+	EnvelopeB
+	EnvelopeC
+	End
 )
 
-type instruction struct {
-	Type instructionType
+var mnemonics = map[InstructionType]string{
+	EnvelopeCycle: "CYCLE",
+	Wait:          "WAIT",
+	ToneA:         "TONEA",
+	ToneB:         "TONEB",
+	ToneC:         "TONEC",
+	EnvelopeShape: "SHAPE",
+	NoiseRate:     "NOISE",
+	Channels:      "MIXER",
+	VolumeA:       "VOLA",
+	VolumeB:       "VOLB",
+	VolumeC:       "VOLC",
+	EnvelopeA:     "ENVA",
+	EnvelopeB:     "ENVB",
+	EnvelopeC:     "ENVC",
+	End:           "END",
+}
+
+// String returns the mnemonic of the instruction type
+func (t InstructionType) String() string {
+	if m, ok := mnemonics[t]; ok {
+		return m
+	}
+	return fmt.Sprintf("InstructionType(%d)", int(t))
+}
+
+// Instruction of the PSG bytecode. Data is ignored by the instructions without arguments
+type Instruction struct {
+	Type InstructionType
 	Data uint16
 }
 
-func (i *instruction) encode() []byte {
+// String returns the mnemonic and the argument of the instruction, in a human-readable form
+func (i Instruction) String() string {
+	switch i.Type {
+	case EnvelopeA, EnvelopeB, EnvelopeC, End:
+		return i.Type.String()
+	case ToneA, ToneB, ToneC:
+		if name, ok := noteNames[i.Data]; ok {
+			return fmt.Sprintf("%-5s %d (%s)", i.Type, i.Data, name)
+		}
+	case Channels:
+		return fmt.Sprintf("%-5s %s", i.Type, mixerString(channelReg(i.Data)))
+	}
+	return fmt.Sprintf("%-5s %d", i.Type, i.Data)
+}
+
+// mixerString returns the channels whose tone and noise are enabled. e.g. tone:AB noise:C
+func mixerString(reg channelReg) string {
+	tone, noise := "", ""
+	for ch := 0; ch < maxChannels; ch++ {
+		name := string(rune('A' + ch))
+		if reg.toneEnabled(ch) {
+			tone += name
+		}
+		if reg.noiseEnabled(ch) {
+			noise += name
+		}
+	}
+	if tone == "" {
+		tone = "-"
+	}
+	if noise == "" {
+		noise = "-"
+	}
+	return "tone:" + tone + " noise:" + noise
+}
+
+// Size returns the number of bytes of the encoded instruction
+func (i *Instruction) Size() int {
+	return len(i.encode())
+}
+
+func (i *Instruction) encode() []byte {
 	switch i.Type {
-	case envelopeCycle:
+	case EnvelopeCycle:
 		return []byte{0, byte(i.Data >> 8), byte(i.Data)}
-	case wait:
+	case Wait:
 		return []byte{byte(i.Data & 0b11111)}
-	case toneA:
+	case ToneA:
 		return []byte{0b00100000 | byte((i.Data>>8)&0b1111), byte(i.Data)}
-	case toneB:
+	case ToneB:
 		return []byte{0b00110000 | byte((i.Data>>8)&0b1111), byte(i.Data)}
-	case toneC:
+	case ToneC:
 		return []byte{0b01110000 | byte((i.Data>>8)&0b1111), byte(i.Data)}
-	case envelopeShape:
+	case EnvelopeShape:
 		return []byte{0b01100000 | byte(i.Data&0b1111)}
-	case noiseRate:
+	case NoiseRate:
 		return []byte{0b01000000 | byte(i.Data&0b11111)}
-	case channels:
+	case Channels:
 		return []byte{0b10000000 | byte(i.Data&0b111111)}
-	case volumeA:
+	case VolumeA:
 		return []byte{0b11000000 | byte(i.Data&0b1111)}
-	case volumeB:
+	case VolumeB:
 		return []byte{0b11010000 | byte(i.Data&0b1111)}
-	case volumeC:
+	case VolumeC:
 		return []byte{0b11100000 | byte(i.Data&0b1111)}
-	case envelopeA:
+	case EnvelopeA:
 		return []byte{0b11110000}
-	case envelopeB:
+	case EnvelopeB:
 		return []byte{0b11110001}
-	case envelopeC:
+	case EnvelopeC:
 		return []byte{0b11110010}
-	case end:
+	case End:
 		return []byte{0b11111000}
 	}
 	panic(fmt.Sprintf("Unknown instruction type: %d", i))
 }
 
-func encodeInstructions(ints []instruction) []byte {
+func encodeInstructions(ints []Instruction) []byte {
 	var encoded []byte
 	for _, i := range ints {
 		encoded = append(encoded, i.encode()...)
@@ -7,22 +7,22 @@ import (
 )
 
 func TestEncodeInstructions(t *testing.T) {
-	encoded := encodeInstructions([]instruction{
-		{Type: envelopeCycle, Data: 0xABCD},
-		{Type: wait, Data: 0b10101},
-		{Type: toneA, Data: 0xDCA},
-		{Type: toneB, Data: 0xADC},
-		{Type: toneC, Data: 0x123},
-		{Type: envelopeShape, Data: 0b1010},
-		{Type: noiseRate, Data: 0b11000},
-		{Type: channels, Data: 0b010101},
-		{Type: volumeA, Data: 0b1111},
-		{Type: volumeB, Data: 0b1001},
-		{Type: volumeC, Data: 0b1110},
-		{Type: envelopeA},
-		{Type: envelopeB},
-		{Type: envelopeC},
-		{Type: end},
+	encoded := encodeInstructions([]Instruction{
+		{Type: EnvelopeCycle, Data: 0xABCD},
+		{Type: Wait, Data: 0b10101},
+		{Type: ToneA, Data: 0xDCA},
+		{Type: ToneB, Data: 0xADC},
+		{Type: ToneC, Data: 0x123},
+		{Type: EnvelopeShape, Data: 0b1010},
+		{Type: NoiseRate, Data: 0b11000},
+		{Type: Channels, Data: 0b010101},
+		{Type: VolumeA, Data: 0b1111},
+		{Type: VolumeB, Data: 0b1001},
+		{Type: VolumeC, Data: 0b1110},
+		{Type: EnvelopeA},
+		{Type: EnvelopeB},
+		{Type: EnvelopeC},
+		{Type: End},
 	})
 	assert.Equal(t, []byte{
 		0, 0xAB, 0xCD,
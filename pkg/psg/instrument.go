@@ -0,0 +1,86 @@
+package psg
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mariomac/msxmml/pkg/ay"
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const (
+	instrumentClass = "psg"
+
+	patternKey   = "pattern"
+	cycleKey     = "cycle"
+	frequencyKey = "frequency"
+	noiseKey     = "noise"
+
+	maxPattern = 0b1111
+	maxCycle   = 0xFFFF
+	maxNoise   = 0b11111
+)
+
+// psgInstrument holds the already validated properties of a psg instrument.
+// Nil properties were not set in the instrument definition
+type psgInstrument struct {
+	pattern *int
+	cycle   *int
+	noise   *int
+}
+
+func parseInstrument(inst *song.Instrument) (psgInstrument, error) {
+	pi := psgInstrument{}
+	if inst.Class != instrumentClass {
+		return pi, fmt.Errorf("unsupported instrument class %q. Only %q is allowed",
+			inst.Class, instrumentClass)
+	}
+	// sorted keys, so the same instrument always reports the same error
+	keys := make([]string, 0, len(inst.Properties))
+	for k := range inst.Properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := inst.Properties[k]
+		var err error
+		switch k {
+		case patternKey:
+			pi.pattern, err = parseRange(k, v, 0, maxPattern)
+		case cycleKey:
+			if _, ok := inst.Properties[frequencyKey]; ok {
+				return pi, fmt.Errorf("can't set both %q and %q in an instrument",
+					cycleKey, frequencyKey)
+			}
+			pi.cycle, err = parseRange(k, v, 1, maxCycle)
+		case frequencyKey:
+			// envelope frequency in Hz, converted to an envelope cycle
+			var freq *int
+			if freq, err = parseRange(k, v, 1, ay.MSXClock/256); err == nil {
+				cycle := ay.MSXClock / (256 * *freq)
+				pi.cycle = &cycle
+			}
+		case noiseKey:
+			pi.noise, err = parseRange(k, v, 0, maxNoise)
+		default:
+			err = fmt.Errorf("unknown %s instrument property %q", instrumentClass, k)
+		}
+		if err != nil {
+			return pi, err
+		}
+	}
+	return pi, nil
+}
+
+func parseRange(key, val string, min, max int) (*int, error) {
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		return nil, fmt.Errorf("property %q must be a number. Got %q", key, val)
+	}
+	if n < min || n > max {
+		return nil, fmt.Errorf("property %q must be in range %d to %d. Got %d",
+			key, min, max, n)
+	}
+	return &n, nil
+}
@@ -0,0 +1,179 @@
+package psg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/mariomac/msxmml/pkg/ay"
+)
+
+const (
+	defaultSampleRate = 44100
+	// fraction of the maximum sample value that is used by the loudest output
+	renderAmplitude = 0.9
+	// pole of the high-pass filter that removes the DC offset of the PSG output
+	dcFilterPole = 0.995
+)
+
+// RenderOption configures how a PSG binary is rendered into audio
+type RenderOption func(*renderConfig)
+
+type renderConfig struct {
+	sampleRate int
+	frameRate  int
+	loops      int
+	fadeOut    time.Duration
+}
+
+// WithSampleRate sets the samples per second of the rendered audio (44100 by default)
+func WithSampleRate(rate int) RenderOption {
+	return func(cfg *renderConfig) {
+		cfg.sampleRate = rate
+	}
+}
+
+// WithFrameRate sets the refresh rate, in Hz, of the machine that plays the song (60 by
+// default). It should be the psg.hz property of the song: 50 for PAL and 60 for NTSC
+func WithFrameRate(hz int) RenderOption {
+	return func(cfg *renderConfig) {
+		cfg.frameRate = hz
+	}
+}
+
+// WithLoops sets how many times the loop of the song is played (1 by default). It's ignored
+// if the song doesn't loop
+func WithLoops(loops int) RenderOption {
+	return func(cfg *renderConfig) {
+		cfg.loops = loops
+	}
+}
+
+// WithFadeOut keeps playing the song for the given duration after the last loop, while the
+// volume fades out (no fade out by default). It's ignored if the song doesn't loop
+func WithFadeOut(d time.Duration) RenderOption {
+	return func(cfg *renderConfig) {
+		cfg.fadeOut = d
+	}
+}
+
+func (cfg *renderConfig) validate() error {
+	switch {
+	case cfg.sampleRate <= 0:
+		return fmt.Errorf("sample rate must be positive. Got %d", cfg.sampleRate)
+	case cfg.frameRate <= 0:
+		return fmt.Errorf("frame rate must be positive. Got %d", cfg.frameRate)
+	case cfg.loops < 1:
+		return fmt.Errorf("loops must be at least 1. Got %d", cfg.loops)
+	case cfg.fadeOut < 0:
+		return fmt.Errorf("fade out can't be negative. Got %v", cfg.fadeOut)
+	}
+	return nil
+}
+
+// Render runs the PSG binary through an AY-3-8910 emulation, and writes the resulting audio
+// as a 16-bit mono PCM WAV file
+func Render(w io.Writer, data []byte, opts ...RenderOption) error {
+	cfg := renderConfig{sampleRate: defaultSampleRate, frameRate: defaultHZ, loops: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+	sim, err := NewSimulator(data)
+	if err != nil {
+		return err
+	}
+	chip := ay.New(ay.MSXClock, cfg.sampleRate)
+	fadeSamples := int(cfg.fadeOut.Seconds() * float64(cfg.sampleRate))
+	// samples that have been faded out. Negative while the song is not fading out
+	faded := -1
+
+	var samples []int16
+	fw := NewFrameWriter(cfg.sampleRate, cfg.frameRate)
+	dc := dcFilter{}
+	loops := 0
+	for frame, ok := sim.Next(); ok && faded < fadeSamples; frame, ok = sim.Next() {
+		if frame.Loop {
+			loops++
+			if loops >= cfg.loops && faded < 0 {
+				if fadeSamples == 0 {
+					break
+				}
+				faded = 0
+			}
+		}
+		for _, w := range fw.Writes(frame, false) {
+			chip.Write(w.Register, w.Value)
+		}
+		for n := fw.Samples(); n > 0 && faded < fadeSamples; n-- {
+			sample := dc.filter(chip.Sample())
+			if faded >= 0 {
+				sample *= 1 - float64(faded)/float64(fadeSamples)
+				faded++
+			}
+			samples = append(samples, pcm(sample))
+		}
+	}
+	return writeWav(w, cfg.sampleRate, samples)
+}
+
+// dcFilter is a high-pass filter that centers the PSG output, which is always positive, around
+// zero
+type dcFilter struct {
+	lastIn, lastOut float64
+}
+
+func (f *dcFilter) filter(in float64) float64 {
+	out := in - f.lastIn + dcFilterPole*f.lastOut
+	f.lastIn, f.lastOut = in, out
+	return out
+}
+
+// pcm converts a sample from -1 to 1 into a 16-bit PCM value
+func pcm(sample float64) int16 {
+	value := math.Round(sample * renderAmplitude * math.MaxInt16)
+	if value > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if value < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(value)
+}
+
+// writeWav writes the samples as a 16-bit mono PCM WAV file
+func writeWav(w io.Writer, sampleRate int, samples []int16) error {
+	const (
+		channels      = 1
+		bitsPerSample = 16
+		fmtChunkSize  = 16
+		pcmFormat     = 1
+	)
+	dataSize := uint32(len(samples) * bitsPerSample / 8)
+	fields := []interface{}{
+		[4]byte{'R', 'I', 'F', 'F'},
+		uint32(4 + (8 + fmtChunkSize) + (8 + dataSize)),
+		[4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '},
+		uint32(fmtChunkSize),
+		uint16(pcmFormat),
+		uint16(channels),
+		uint32(sampleRate),
+		uint32(sampleRate * channels * bitsPerSample / 8), // byte rate
+		uint16(channels * bitsPerSample / 8),              // block align
+		uint16(bitsPerSample),
+		[4]byte{'d', 'a', 't', 'a'},
+		dataSize,
+		samples,
+	}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
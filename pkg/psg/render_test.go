@@ -0,0 +1,97 @@
+package psg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+func renderSamples(t *testing.T, src string, opts ...RenderOption) []int16 {
+	t.Helper()
+	s, err := lang.Parse(strings.NewReader(src))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	out := bytes.Buffer{}
+	require.NoError(t, Render(&out, songBytes, opts...))
+
+	wav := out.Bytes()
+	require.True(t, len(wav) >= 44)
+	assert.Equal(t, "RIFF", string(wav[0:4]))
+	assert.Equal(t, uint32(len(wav)-8), binary.LittleEndian.Uint32(wav[4:8]))
+	assert.Equal(t, "WAVEfmt ", string(wav[8:16]))
+	assert.Equal(t, "data", string(wav[36:40]))
+	samples := make([]int16, binary.LittleEndian.Uint32(wav[40:44])/2)
+	require.NoError(t, binary.Read(bytes.NewReader(wav[44:]), binary.LittleEndian, samples))
+	return samples
+}
+
+func TestRender(t *testing.T) {
+	samples := renderSamples(t, "@ch1 <- a r\n", WithSampleRate(8000))
+	// 60 frames plus the frame where the song ends
+	require.Len(t, samples, 61*8000/60)
+	loud := func(from, to int) bool {
+		for _, s := range samples[from:to] {
+			if s > 5000 || s < -5000 {
+				return true
+			}
+		}
+		return false
+	}
+	// the note sounds during the first 30 frames, and the silence during the rest
+	assert.True(t, loud(0, 4000))
+	assert.False(t, loud(4200, len(samples)))
+}
+
+func TestRender_Loops(t *testing.T) {
+	src := "@ch1 <- a\nloop:\n@ch1 <- b\n"
+	// 30 frames of a and 30 frames of b, until the song jumps to the loop. Each end of the song
+	// waits an extra frame, so each extra loop lasts 31 frames
+	assert.Equal(t, 61*100, len(renderSamples(t, src, WithSampleRate(6000))))
+	assert.Equal(t, (61+31+31)*100, len(renderSamples(t, src, WithSampleRate(6000), WithLoops(3))))
+	// PAL machines play the same frames in more time
+	assert.Equal(t, 61*120, len(renderSamples(t, src, WithSampleRate(6000), WithFrameRate(50))))
+
+	faded := renderSamples(t, src, WithSampleRate(6000), WithFadeOut(500*time.Millisecond))
+	require.Equal(t, 61*100+3000, len(faded))
+	// the fade out ends in silence
+	for _, s := range faded[len(faded)-30:] {
+		assert.InDelta(t, 0, s, 500)
+	}
+}
+
+func TestRender_InvalidOptions(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader("@ch1 <- a\n"))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name string
+		opt  RenderOption
+		err  string
+	}{
+		{name: "zero sample rate", opt: WithSampleRate(0), err: "sample rate must be positive. Got 0"},
+		{name: "negative sample rate", opt: WithSampleRate(-1), err: "sample rate must be positive. Got -1"},
+		{name: "zero frame rate", opt: WithFrameRate(0), err: "frame rate must be positive. Got 0"},
+		{name: "negative frame rate", opt: WithFrameRate(-1), err: "frame rate must be positive. Got -1"},
+		{name: "zero loops", opt: WithLoops(0), err: "loops must be at least 1. Got 0"},
+		{name: "negative loops", opt: WithLoops(-2), err: "loops must be at least 1. Got -2"},
+		{name: "negative fade out", opt: WithFadeOut(-time.Second), err: "fade out can't be negative. Got -1s"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			out := bytes.Buffer{}
+			err := Render(&out, songBytes, tc.opt)
+			require.Error(t, err)
+			assert.Equal(t, tc.err, err.Error())
+			// nothing is written
+			assert.Zero(t, out.Len())
+		})
+	}
+}
@@ -0,0 +1,219 @@
+package psg
+
+import "fmt"
+
+// indexes of the PSG registers, as named in etc/msxplayer/src/psg.asm
+const (
+	regToneAL = iota
+	regToneAH
+	regToneBL
+	regToneBH
+	regToneCL
+	regToneCH
+	regNoise
+	regMixer
+	regVolumeA
+	regVolumeB
+	regVolumeC
+	regEnvelopeCycleL
+	regEnvelopeCycleH
+	regEnvelopeShape
+	// RegistersCount is the number of registers of the AY-3-8910 PSG that are used by the player
+	RegistersCount
+)
+
+const (
+	// bit of the volume registers that makes the channel follow the envelope generator
+	envelopeVolume = 0b10000
+	// initial mixer of the player: tone enabled and noise disabled in all the channels
+	initialMixer = 0b111000
+	// mixer that the player writes when the song ends: all the channels are disabled
+	stoppedMixer = 0b10111111
+)
+
+// Registers of the PSG
+type Registers [RegistersCount]uint8
+
+// Tone returns the tone period of the channel (0: A, 1: B, 2: C)
+func (r *Registers) Tone(ch int) uint16 {
+	return uint16(r[regToneAH+2*ch]&0b1111)<<8 | uint16(r[regToneAL+2*ch])
+}
+
+// ToneEnabled returns whether the mixer enables the tone of the channel (0: A, 1: B, 2: C)
+func (r *Registers) ToneEnabled(ch int) bool {
+	mixer := channelReg(r[regMixer])
+	return mixer.toneEnabled(ch)
+}
+
+// NoiseEnabled returns whether the mixer enables the noise of the channel (0: A, 1: B, 2: C)
+func (r *Registers) NoiseEnabled(ch int) bool {
+	mixer := channelReg(r[regMixer])
+	return mixer.noiseEnabled(ch)
+}
+
+// Volume returns the fixed volume of the channel (0: A, 1: B, 2: C), from 0 to 15
+func (r *Registers) Volume(ch int) uint8 {
+	return r[regVolumeA+ch] & 0b1111
+}
+
+// Envelope returns whether the volume of the channel (0: A, 1: B, 2: C) is driven by the
+// envelope generator
+func (r *Registers) Envelope(ch int) bool {
+	return r[regVolumeA+ch]&envelopeVolume != 0
+}
+
+// NoisePeriod returns the divider rate of the noise generator
+func (r *Registers) NoisePeriod() uint8 {
+	return r[regNoise] & 0b11111
+}
+
+// EnvelopeCycle returns the period of the envelope generator
+func (r *Registers) EnvelopeCycle() uint16 {
+	return uint16(r[regEnvelopeCycleH])<<8 | uint16(r[regEnvelopeCycleL])
+}
+
+// EnvelopeShape returns the wave shape of the envelope generator
+func (r *Registers) EnvelopeShape() uint8 {
+	return r[regEnvelopeShape] & 0b1111
+}
+
+// Frame is the state of the PSG after running the instructions of an interrupt
+type Frame struct {
+	Registers Registers
+	// EnvelopeRestart is true if the envelope shape was written in this frame. Writing the shape
+	// restarts the envelope, even if it didn't change
+	EnvelopeRestart bool
+	// Loop is true if the song jumped back to its loop in this frame
+	Loop bool
+	// LoopStart is true if the first instruction of the loop runs in this frame, including the
+	// first time that the song reaches it
+	LoopStart bool
+}
+
+// Simulator runs a PSG binary frame by frame, writing the PSG registers as the MSX player does
+// (etc/msxplayer/src/main.asm). The instructions of each interrupt run until a wait or the end of
+// the song is found. Then, the end of the song waits one frame before jumping to the loop
+type Simulator struct {
+	prog Program
+	// index of the instruction where the loop starts. Negative if the song doesn't loop
+	loopIndex int
+	// index of the next instruction to run
+	ip int
+	// frames before running the next instructions
+	wait int
+	// true if the end of the song jumped back to the loop
+	looped  bool
+	stopped bool
+	regs    Registers
+}
+
+// NewSimulator decodes the PSG binary and returns a simulator that starts playing it
+func NewSimulator(data []byte) (*Simulator, error) {
+	prog, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	sim := &Simulator{prog: prog, loopIndex: -1, wait: 1}
+	if prog.LoopOffset != 0 {
+		offset := headerSize
+		for i := range prog.Instructions {
+			if offset == prog.LoopOffset {
+				sim.loopIndex = i
+				break
+			}
+			offset += prog.Instructions[i].Size()
+		}
+	}
+	// the player initializes the volumes and the mixer before starting
+	sim.regs[regVolumeA] = maxVolume
+	sim.regs[regVolumeB] = maxVolume
+	sim.regs[regVolumeC] = maxVolume
+	sim.regs[regMixer] = initialMixer
+	return sim, nil
+}
+
+// Next runs the instructions of the next interrupt and returns the resulting frame. It returns
+// false if the song already ended
+func (sim *Simulator) Next() (Frame, bool) {
+	if sim.stopped {
+		return Frame{}, false
+	}
+	frame := Frame{}
+	sim.wait--
+	if sim.wait > 0 {
+		frame.Registers = sim.regs
+		return frame, true
+	}
+	frame.Loop, sim.looped = sim.looped, false
+	for sim.wait == 0 {
+		if sim.ip == sim.loopIndex {
+			frame.LoopStart = true
+		}
+		ins := sim.prog.Instructions[sim.ip]
+		sim.ip++
+		switch ins.Type {
+		case Wait:
+			sim.wait = int(ins.Data)
+		case End:
+			if sim.loopIndex < 0 {
+				sim.stopped = true
+				sim.regs[regMixer] = stoppedMixer
+				sim.wait = 1
+			} else {
+				sim.ip = sim.loopIndex
+				sim.looped = true
+				sim.wait = 1
+			}
+		case EnvelopeShape:
+			sim.regs[regEnvelopeShape] = uint8(ins.Data)
+			frame.EnvelopeRestart = true
+		default:
+			sim.write(ins)
+		}
+	}
+	frame.Registers = sim.regs
+	return frame, true
+}
+
+// write stores in the registers the values of the instructions that don't alter the flow of the
+// song
+func (sim *Simulator) write(ins Instruction) {
+	switch ins.Type {
+	case EnvelopeCycle:
+		sim.regs[regEnvelopeCycleL] = uint8(ins.Data)
+		sim.regs[regEnvelopeCycleH] = uint8(ins.Data >> 8)
+	case ToneA, ToneB, ToneC:
+		ch := int(ins.Type - ToneA)
+		sim.regs[regToneAL+2*ch] = uint8(ins.Data)
+		sim.regs[regToneAH+2*ch] = uint8(ins.Data>>8) & 0b1111
+	case NoiseRate:
+		sim.regs[regNoise] = uint8(ins.Data)
+	case Channels:
+		// the player writes the whole instruction (10cbaCBA) into the mixer
+		sim.regs[regMixer] = ins.encode()[0]
+	case VolumeA, VolumeB, VolumeC:
+		sim.regs[regVolumeA+int(ins.Type-VolumeA)] = uint8(ins.Data)
+	case EnvelopeA, EnvelopeB, EnvelopeC:
+		sim.regs[regVolumeA+int(ins.Type-EnvelopeA)] = envelopeVolume
+	default:
+		panic(fmt.Sprintf("BUG! unexpected instruction %v", ins))
+	}
+}
+
+// Simulate runs the PSG binary and returns its frames, until the song ends or maxFrames are
+// returned. Songs with a loop never end
+func Simulate(data []byte, maxFrames int) ([]Frame, error) {
+	sim, err := NewSimulator(data)
+	if err != nil {
+		return nil, err
+	}
+	var frames []Frame
+	for len(frames) < maxFrames {
+		frame, ok := sim.Next()
+		if !ok {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	return frames, nil
+}
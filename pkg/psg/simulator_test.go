@@ -0,0 +1,144 @@
+package psg
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+// tone that a channel plays from a frame to another (both included)
+type played struct {
+	tone     uint16
+	from, to int
+}
+
+func playedTones(frames []Frame, ch int) []played {
+	var ps []played
+	for f := range frames {
+		regs := &frames[f].Registers
+		if !regs.ToneEnabled(ch) {
+			continue
+		}
+		last := len(ps) - 1
+		if last >= 0 && ps[last].to == f-1 && ps[last].tone == regs.Tone(ch) {
+			ps[last].to = f
+		} else {
+			ps = append(ps, played{tone: regs.Tone(ch), from: f, to: f})
+		}
+	}
+	return ps
+}
+
+func simulate(t *testing.T, src string, maxFrames int) []Frame {
+	t.Helper()
+	s, err := lang.Parse(strings.NewReader(src))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	frames, err := Simulate(songBytes, maxFrames)
+	require.NoError(t, err)
+	return frames
+}
+
+func TestSimulate(t *testing.T) {
+	frames := simulate(t, `
+@ch1 <- a b
+@ch2 <- r > c2
+`, 1000)
+	// the song stops one frame after the last wait
+	require.Len(t, frames, 91)
+	// the channels keep sounding until a silence or the end of the song
+	assert.Equal(t, []played{{tone: 0xFE, from: 0, to: 29}, {tone: 0xE3, from: 30, to: 89}}, playedTones(frames, 0))
+	assert.Equal(t, []played{{tone: 0xD6, from: 30, to: 89}}, playedTones(frames, 1))
+	assert.Empty(t, playedTones(frames, 2))
+	for ch := 0; ch < maxChannels; ch++ {
+		assert.Equal(t, uint8(maxVolume), frames[0].Registers.Volume(ch))
+		assert.False(t, frames[90].Registers.NoiseEnabled(ch))
+	}
+	// the player writes the whole mixer instruction (10cbaCBA) into the register
+	assert.Equal(t, uint8(0b10_111_100), frames[30].Registers[regMixer])
+}
+
+func TestSimulate_Loop(t *testing.T) {
+	frames := simulate(t, `
+@ch1 <- a
+loop:
+@ch1 <- b c
+`, 200)
+	require.Len(t, frames, 200)
+	// the end of the song waits one frame before jumping to the loop
+	assert.Equal(t, []played{
+		{tone: 0xFE, from: 0, to: 29},
+		{tone: 0xE3, from: 30, to: 59},
+		{tone: 0x1AC, from: 60, to: 90},
+		{tone: 0xE3, from: 91, to: 120},
+		{tone: 0x1AC, from: 121, to: 151},
+		{tone: 0xE3, from: 152, to: 181},
+		{tone: 0x1AC, from: 182, to: 199},
+	}, playedTones(frames, 0))
+	var loops, loopStarts []int
+	for f := range frames {
+		if frames[f].Loop {
+			loops = append(loops, f)
+		}
+		if frames[f].LoopStart {
+			loopStarts = append(loopStarts, f)
+		}
+	}
+	assert.Equal(t, []int{91, 152}, loops)
+	assert.Equal(t, []int{30, 91, 152}, loopStarts)
+}
+
+func TestSimulate_Instruments(t *testing.T) {
+	frames := simulate(t, `
+$drum := psg {
+	pattern: 9
+	cycle: 1000
+	noise: 12
+}
+@ch1 <- $drum a v8 b
+@ch2 <- r n3
+`, 1000)
+	require.Len(t, frames, 61)
+	first := frames[0]
+	assert.True(t, first.EnvelopeRestart)
+	assert.Equal(t, uint8(9), first.Registers.EnvelopeShape())
+	assert.Equal(t, uint16(1000), first.Registers.EnvelopeCycle())
+	assert.True(t, first.Registers.Envelope(0))
+	assert.True(t, first.Registers.NoiseEnabled(0))
+	assert.Equal(t, uint8(12), first.Registers.NoisePeriod())
+	assert.False(t, frames[1].EnvelopeRestart)
+
+	// the volume command disables the envelope
+	second := frames[30]
+	assert.False(t, second.Registers.Envelope(0))
+	assert.Equal(t, uint8(8), second.Registers.Volume(0))
+	// the noise hit of B changes the period of the noise generator, shared by all the channels
+	assert.False(t, second.Registers.ToneEnabled(1))
+	assert.True(t, second.Registers.NoiseEnabled(1))
+	assert.Equal(t, uint8(3), second.Registers.NoisePeriod())
+}
+
+func TestSimulator_End(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader("@ch1 <- a16\n"))
+	require.NoError(t, err)
+	songBytes, err := Export(s)
+	require.NoError(t, err)
+	sim, err := NewSimulator(songBytes)
+	require.NoError(t, err)
+	for f := 0; f < 7; f++ {
+		frame, ok := sim.Next()
+		require.True(t, ok)
+		assert.True(t, frame.Registers.ToneEnabled(0), "frame %d", f)
+	}
+	// the player disables all the channels when the song ends
+	frame, ok := sim.Next()
+	require.True(t, ok)
+	assert.Equal(t, uint8(stoppedMixer), frame.Registers[regMixer])
+	_, ok = sim.Next()
+	assert.False(t, ok)
+}
@@ -9,25 +9,28 @@ import (
 type SyncedBlock struct {
 	block    song.SyncedBlock
 	counters map[string]channelCounter
-	time     float64 // time in beats fractions
+	time     song.Duration // time in beats
 	// reading prioritizing by sorted channels allow a more predictable/debuggable/testable output
 	sortedChannels []string
 }
 
 type channelCounter struct {
-	time  float64 // time in beats fractions
+	time  song.Duration // time in beats
 	index int
 }
 
 func NewSyncedBlock(block song.SyncedBlock) SyncedBlock {
 	counters := map[string]channelCounter{}
 	channelNames := make([]string, 0, len(block.Channels))
-	for chn := range block.Channels {
+	// repeats are read as if they were written in the tablature as many times as they are repeated
+	unrolled := song.SyncedBlock{Channels: make(map[string]*song.Channel, len(block.Channels))}
+	for chn, ch := range block.Channels {
 		channelNames = append(channelNames, chn)
 		counters[chn] = channelCounter{}
+		unrolled.Channels[chn] = &song.Channel{Items: song.Tablature(ch.Items).Unroll()}
 	}
 	sort.Strings(channelNames)
-	return SyncedBlock{block: block, counters: counters, sortedChannels: channelNames}
+	return SyncedBlock{block: unrolled, counters: counters, sortedChannels: channelNames}
 }
 
 // Next extracts the next item to be played/enqueued. Returns it as well as the channel where it belongs to.
@@ -41,7 +44,7 @@ func (sbr *SyncedBlock) Next() (song.TablatureItem, string) {
 		if cnt.index >= len(channel.Items) {
 			continue
 		}
-		if soonerChannel == "" || cnt.time < sbr.counters[soonerChannel].time {
+		if soonerChannel == "" || cnt.time.Less(sbr.counters[soonerChannel].time) {
 			soonerChannel = name
 		}
 	}
@@ -52,7 +55,7 @@ func (sbr *SyncedBlock) Next() (song.TablatureItem, string) {
 		it := sbr.block.Channels[soonerChannel].Items[cnt.index]
 		sbr.counters[soonerChannel] = channelCounter{
 			index: cnt.index + 1,
-			time:  cnt.time + it.DurationBeats(),
+			time:  cnt.time.Add(it.DurationBeats()),
 		}
 		return it, soonerChannel
 	}
@@ -0,0 +1,187 @@
+package reader
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+const (
+	tempoKey      = "tempo"
+	defaultTempo  = 120
+	defaultOctave = 4
+	maxVolume     = 15
+)
+
+// Event is an item that lasts some time in a channel (a note, a silence or a noise), with the
+// state that the previous items of the channel set
+type Event struct {
+	Channel string
+	// Start of the event, in beats from the beginning of the song
+	Start song.Duration
+	// Length of the event in beats, including the ties of the notes
+	Length song.Duration
+	// only one of Note, Silence or Noise is set
+	Note    *song.Note
+	Silence *song.Silence
+	Noise   *song.Noise
+	// Octave of the channel when the event starts
+	Octave int
+	// Volume of the channel, from 0 to 15
+	Volume int
+	// Instrument of the channel. Nil if the channel didn't set any instrument
+	Instrument *song.Instrument
+	// Tempo in beats per minute when the event starts
+	Tempo int
+	// Loop is true for the events that start the loop of the song
+	Loop bool
+	// Source of the event in the source code. Nil if it was not parsed from a source code
+	Source *song.Source
+}
+
+// Pitch returns the absolute pitch of a note, in semitones from the C of the octave 0 (e.g. the
+// A of the octave 4 is 57). It returns 0 for silences and noises
+func (e *Event) Pitch() int {
+	if e.Note == nil {
+		return 0
+	}
+	return song.SemitonesPerOctave*e.Octave + e.Note.Semitones()
+}
+
+// End returns when the event finishes, in beats from the beginning of the song
+func (e *Event) End() song.Duration {
+	return e.Start.Add(e.Length)
+}
+
+// TempoChange sets the tempo of the whole song from the given beat
+type TempoChange struct {
+	Beat song.Duration
+	BPM  int
+}
+
+// Timeline of a whole song: the events of all its blocks and channels, sorted by their start
+// time. Events that start at the same time are sorted by channel name
+type Timeline struct {
+	Events []Event
+	// Tempos are sorted by beat. The first one is the initial tempo of the song
+	Tempos []TempoChange
+	// LoopStart is the beat where the loop of the song starts. Nil if the song doesn't loop
+	LoopStart *song.Duration
+	// Length of the song, in beats
+	Length song.Duration
+}
+
+// channelState is what the previous items of a channel set
+type channelState struct {
+	time       song.Duration // time in beats
+	octave     int
+	volume     int
+	instrument *song.Instrument
+}
+
+// NewTimeline reads all the blocks of a song and resolves the state of each of its events
+func NewTimeline(s *song.Song) (*Timeline, error) {
+	tempo := defaultTempo
+	if tempoStr, ok := s.Properties[tempoKey]; ok {
+		var err error
+		if tempo, err = strconv.Atoi(tempoStr); err != nil {
+			return nil, fmt.Errorf("error parsing %q property: %w", tempoKey, err)
+		}
+	}
+	tl := &Timeline{Tempos: []TempoChange{{BPM: tempo}}}
+	states := map[string]*channelState{}
+	for blockNum := range s.Blocks {
+		// a block starts when all the channels of the previous block have finished
+		blockStart := tl.Length
+		if blockNum == s.LoopIndex {
+			tl.LoopStart = &blockStart
+		}
+		for _, st := range states {
+			st.time = blockStart
+		}
+		sbr := NewSyncedBlock(s.Blocks[blockNum])
+		for ti, ch := sbr.Next(); ch != ""; ti, ch = sbr.Next() {
+			st, ok := states[ch]
+			if !ok {
+				st = &channelState{time: blockStart, octave: defaultOctave, volume: maxVolume}
+				states[ch] = st
+			}
+			switch {
+			case ti.SetOctave != nil:
+				st.octave = *ti.SetOctave
+			case ti.OctaveStep != nil:
+				st.octave += *ti.OctaveStep
+			case ti.Volume != nil:
+				st.volume = *ti.Volume
+			case ti.Instrument != nil:
+				st.instrument = ti.Instrument
+			case ti.Tempo != nil:
+				tl.setTempo(st.time, *ti.Tempo)
+			case ti.Note != nil, ti.Silence != nil, ti.Noise != nil:
+				ev := Event{
+					Channel:    ch,
+					Start:      st.time,
+					Length:     ti.DurationBeats(),
+					Note:       ti.Note,
+					Silence:    ti.Silence,
+					Noise:      ti.Noise,
+					Octave:     st.octave,
+					Volume:     st.volume,
+					Instrument: st.instrument,
+					Loop:       blockNum == s.LoopIndex && st.time.Cmp(blockStart) == 0,
+					Source:     ti.Source,
+				}
+				tl.Events = append(tl.Events, ev)
+				st.time = ev.End()
+				if tl.Length.Less(st.time) {
+					tl.Length = st.time
+				}
+			}
+		}
+	}
+	// a tempo change can be read after the events of other channels that start at the same beat
+	for i := range tl.Events {
+		tl.Events[i].Tempo = tl.TempoAt(tl.Events[i].Start)
+	}
+	return tl, nil
+}
+
+func (tl *Timeline) setTempo(beat song.Duration, bpm int) {
+	last := &tl.Tempos[len(tl.Tempos)-1]
+	if last.Beat.Cmp(beat) == 0 {
+		last.BPM = bpm
+		return
+	}
+	tl.Tempos = append(tl.Tempos, TempoChange{Beat: beat, BPM: bpm})
+}
+
+// TempoAt returns the tempo of the song at the given beat, in beats per minute
+func (tl *Timeline) TempoAt(beat song.Duration) int {
+	// index of the first tempo change after the beat
+	i := sort.Search(len(tl.Tempos), func(i int) bool {
+		return beat.Less(tl.Tempos[i].Beat)
+	})
+	if i == 0 {
+		return tl.Tempos[0].BPM
+	}
+	return tl.Tempos[i-1].BPM
+}
+
+// Seconds returns the exact time of the given beat, in seconds from the beginning of the song,
+// according to the tempo changes before it
+func (tl *Timeline) Seconds(beat song.Duration) song.Duration {
+	seconds := song.Duration{}
+	for i, tc := range tl.Tempos {
+		if !tc.Beat.Less(beat) {
+			break
+		}
+		end := beat
+		if i+1 < len(tl.Tempos) && tl.Tempos[i+1].Beat.Less(beat) {
+			end = tl.Tempos[i+1].Beat
+		}
+		seconds = seconds.Add(end.Sub(tc.Beat).Mul(60, int64(tc.BPM)))
+	}
+	return seconds
+}
@@ -0,0 +1,112 @@
+package reader
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/lang"
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+// resolved fields of an event, to be compared easily
+type resolved struct {
+	channel    string
+	start      song.Duration
+	length     song.Duration
+	pitch      int
+	volume     int
+	instrument string
+	tempo      int
+	loop       bool
+}
+
+func resolve(events []Event) []resolved {
+	var rs []resolved
+	for _, e := range events {
+		r := resolved{
+			channel: e.Channel,
+			start:   e.Start,
+			length:  e.Length,
+			pitch:   e.Pitch(),
+			volume:  e.Volume,
+			tempo:   e.Tempo,
+			loop:    e.Loop,
+		}
+		if e.Instrument != nil {
+			r.instrument = e.Instrument.Properties["noise"]
+		}
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestTimeline(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader(`
+tempo 100
+$drum := psg { noise: 12 }
+@a <- o5 c8 d8 v10 > e4
+@b <- r4 $drum < b#4
+loop:
+@a <- t50 f2
+@b <- n3,4
+`))
+	require.NoError(t, err)
+	tl, err := NewTimeline(s)
+	require.NoError(t, err)
+
+	d := song.NewDuration
+	assert.Equal(t, []resolved{
+		{channel: "a", start: d(0, 1), length: d(1, 2), pitch: 60, volume: 15, tempo: 100},
+		{channel: "b", start: d(0, 1), length: d(1, 1), volume: 15, tempo: 100},
+		{channel: "a", start: d(1, 2), length: d(1, 2), pitch: 62, volume: 15, tempo: 100},
+		{channel: "a", start: d(1, 1), length: d(1, 1), pitch: 76, volume: 10, tempo: 100},
+		// B# of the octave 3 is the C of the octave 4
+		{channel: "b", start: d(1, 1), length: d(1, 1), pitch: 48, volume: 15, instrument: "12", tempo: 100},
+		{channel: "a", start: d(2, 1), length: d(2, 1), pitch: 77, volume: 10, tempo: 50, loop: true},
+		{channel: "b", start: d(2, 1), length: d(1, 1), volume: 15, instrument: "12", tempo: 50, loop: true},
+	}, resolve(tl.Events))
+	assert.NotNil(t, tl.Events[1].Silence)
+	assert.Equal(t, 3, tl.Events[6].Noise.Period)
+
+	assert.Equal(t, []TempoChange{{BPM: 100}, {Beat: d(2, 1), BPM: 50}}, tl.Tempos)
+	require.NotNil(t, tl.LoopStart)
+	assert.Equal(t, d(2, 1), *tl.LoopStart)
+	assert.Equal(t, d(4, 1), tl.Length)
+	// 2 beats at 100 bpm and 2 beats at 50 bpm
+	assert.Equal(t, d(18, 5), tl.Seconds(tl.Length))
+}
+
+func TestTimeline_TempoChange(t *testing.T) {
+	// the tempo change in b is read after the note of a that starts at the same beat
+	s, err := lang.Parse(strings.NewReader(`
+@a <- c c (c c c)3
+@b <- c t60 c2
+`))
+	require.NoError(t, err)
+	tl, err := NewTimeline(s)
+	require.NoError(t, err)
+
+	d := song.NewDuration
+	assert.Nil(t, tl.LoopStart)
+	require.Len(t, tl.Events, 7)
+	assert.Equal(t, 120, tl.Events[0].Tempo)
+	assert.Equal(t, "a", tl.Events[2].Channel)
+	assert.Equal(t, d(1, 1), tl.Events[2].Start)
+	assert.Equal(t, 60, tl.Events[2].Tempo)
+	assert.Equal(t, 120, tl.TempoAt(d(1, 2)))
+	assert.Equal(t, 60, tl.TempoAt(d(1, 1)))
+	// the last triplet note starts at 2 + 4/3 beats
+	assert.Equal(t, d(10, 3), tl.Events[6].Start)
+	// 1 beat at 120 bpm and 7/3 beats at 60 bpm
+	assert.Equal(t, d(17, 6), tl.Seconds(tl.Events[6].Start))
+}
+
+func TestTimeline_Errors(t *testing.T) {
+	s, err := lang.Parse(strings.NewReader("tempo fast\n@a <- c\n"))
+	require.NoError(t, err)
+	_, err = NewTimeline(s)
+	assert.Error(t, err)
+}
@@ -0,0 +1,206 @@
+package song
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Duration is an exact amount of time, as a fraction. Unless otherwise specified, it is
+// measured in beats (quarter notes). The zero value is a zero duration.
+//
+// When the result of an operation doesn't fit in the fraction (e.g. after adding many durations
+// with different tuplets), it is an overflowed duration. The operations with an overflowed
+// duration also overflow, so it only needs to be checked at the end of a calculation
+type Duration struct {
+	// the fraction is always kept in its lowest terms, with a positive denominator. Zero is
+	// always represented by the zero value, and an overflowed duration by a negative denominator
+	num, den int64
+}
+
+var overflowed = Duration{den: -1}
+
+// NewDuration returns the num/den duration
+func NewDuration(num, den int64) Duration {
+	if den == 0 {
+		panic("BUG detected. Duration with zero denominator")
+	}
+	if num == 0 {
+		// unique representation of zero, so durations can be compared with ==
+		return Duration{}
+	}
+	if num == math.MinInt64 || den == math.MinInt64 {
+		// can't be negated
+		return overflowed
+	}
+	if den < 0 {
+		num, den = -num, -den
+	}
+	g := gcd(abs(num), den)
+	return Duration{num: num / g, den: den / g}
+}
+
+// Num returns the numerator of the duration
+func (d Duration) Num() int64 {
+	return d.num
+}
+
+// Den returns the denominator of the duration
+func (d Duration) Den() int64 {
+	if d.den <= 0 {
+		return 1
+	}
+	return d.den
+}
+
+// Overflow returns true if the duration is the result of an operation that doesn't fit in the
+// fraction
+func (d Duration) Overflow() bool {
+	return d.den < 0
+}
+
+func (d Duration) Add(o Duration) Duration {
+	if d.Overflow() || o.Overflow() {
+		return overflowed
+	}
+	// the common denominator is the least common multiple, to delay the overflows
+	g := gcd(d.Den(), o.Den())
+	l, okl := mul64(d.num, o.Den()/g)
+	r, okr := mul64(o.num, d.Den()/g)
+	num, oknum := add64(l, r)
+	den, okden := mul64(d.Den()/g, o.Den())
+	if !okl || !okr || !oknum || !okden {
+		return overflowed
+	}
+	return NewDuration(num, den)
+}
+
+func (d Duration) Sub(o Duration) Duration {
+	// the numerator is never math.MinInt64, so it can be negated
+	return d.Add(Duration{num: -o.num, den: o.den})
+}
+
+// Mul returns the duration multiplied by the num/den fraction
+func (d Duration) Mul(num, den int64) Duration {
+	if den == 0 {
+		panic("BUG detected. Duration multiplied by a zero denominator")
+	}
+	if d.Overflow() || num == math.MinInt64 || den == math.MinInt64 {
+		return overflowed
+	}
+	// reducing the factors before multiplying, to delay the overflows
+	g := gcd(abs(num), abs(den))
+	num, den = num/g, den/g
+	gn, gd := gcd(abs(num), d.Den()), gcd(abs(d.num), abs(den))
+	n, okn := mul64(d.num/gd, num/gn)
+	dd, okd := mul64(d.Den()/gn, den/gd)
+	if !okn || !okd {
+		return overflowed
+	}
+	return NewDuration(n, dd)
+}
+
+// Cmp returns -1, 0 or 1 if the duration is respectively shorter, equal or longer than the
+// other. Overflowed durations can't be compared
+func (d Duration) Cmp(o Duration) int {
+	if d.Overflow() || o.Overflow() {
+		panic("BUG detected. Comparing an overflowed duration")
+	}
+	l, okl := mul64(d.num, o.Den())
+	r, okr := mul64(o.num, d.Den())
+	if !okl || !okr {
+		return big.NewRat(d.num, d.Den()).Cmp(big.NewRat(o.num, o.Den()))
+	}
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+func (d Duration) Less(o Duration) bool {
+	return d.Cmp(o) < 0
+}
+
+func (d Duration) IsZero() bool {
+	return d.num == 0 && d.den >= 0
+}
+
+// Floor returns the greatest integer that is not longer than the duration
+func (d Duration) Floor() int64 {
+	f := d.num / d.Den()
+	if d.num < 0 && d.num%d.Den() != 0 {
+		f--
+	}
+	return f
+}
+
+func (d Duration) Float64() float64 {
+	f, _ := big.NewRat(d.num, d.Den()).Float64()
+	return f
+}
+
+func (d Duration) String() string {
+	if d.Overflow() {
+		return "overflow"
+	}
+	if d.Den() == 1 {
+		return fmt.Sprint(d.num)
+	}
+	return fmt.Sprintf("%d/%d", d.num, d.den)
+}
+
+// lengthBeats returns the beats of a length divisor with the given dots and tuplet. Each dot adds
+// half of the previous duration.
+func lengthBeats(length, dots int, tuplet Tuplet) Duration {
+	// 4/length * (2 - 1/2^dots)
+	if dots > 61 {
+		return overflowed
+	}
+	pow := int64(1) << dots
+	beats := NewDuration(4, int64(length)).Mul(2*pow-1, pow)
+	if tuplet.Notes > 0 {
+		beats = beats.Mul(int64(tuplet.Span), int64(tuplet.Notes))
+	}
+	return beats
+}
+
+func gcd(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	if a == 0 {
+		return 1
+	}
+	return a
+}
+
+// mul64 returns a*b, and false if it doesn't fit in an int64 whose sign can be changed
+func mul64(a, b int64) (int64, bool) {
+	if a == 0 || b == 0 {
+		return 0, true
+	}
+	c := a * b
+	if c/b != a || c == math.MinInt64 {
+		return 0, false
+	}
+	return c, true
+}
+
+// add64 returns a+b, and false if it doesn't fit in an int64 whose sign can be changed
+func add64(a, b int64) (int64, bool) {
+	c := a + b
+	if (b > 0 && c < a) || (b < 0 && c > a) || c == math.MinInt64 {
+		return 0, false
+	}
+	return c, true
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,162 @@
+package song
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDuration(t *testing.T) {
+	// fractions are kept in their lowest terms, with a positive denominator
+	assert.Equal(t, Duration{num: 1, den: 2}, NewDuration(2, 4))
+	assert.Equal(t, Duration{num: -3, den: 4}, NewDuration(3, -4))
+	assert.Equal(t, Duration{num: 3, den: 4}, NewDuration(-6, -8))
+	// zero is always the zero value
+	assert.Equal(t, Duration{}, NewDuration(0, 7))
+	assert.Equal(t, Duration{}, NewDuration(0, -3))
+	assert.True(t, NewDuration(0, 5) == Duration{})
+	assert.Panics(t, func() { NewDuration(1, 0) })
+}
+
+func TestDuration_ZeroValue(t *testing.T) {
+	d := Duration{}
+	assert.True(t, d.IsZero())
+	assert.Equal(t, int64(0), d.Num())
+	assert.Equal(t, int64(1), d.Den())
+	assert.Equal(t, int64(0), d.Floor())
+	assert.Equal(t, "0", d.String())
+	assert.Equal(t, NewDuration(1, 3), d.Add(NewDuration(1, 3)))
+	assert.Equal(t, NewDuration(-1, 3), d.Sub(NewDuration(1, 3)))
+	assert.Equal(t, Duration{}, d.Mul(3, 2))
+}
+
+func TestDuration_Arithmetic(t *testing.T) {
+	half, third := NewDuration(1, 2), NewDuration(1, 3)
+	assert.Equal(t, NewDuration(5, 6), half.Add(third))
+	assert.Equal(t, NewDuration(1, 6), half.Sub(third))
+	assert.Equal(t, NewDuration(-1, 6), third.Sub(half))
+	assert.Equal(t, NewDuration(-5, 6), NewDuration(-1, 2).Sub(third))
+	assert.Equal(t, NewDuration(1, 6), NewDuration(-1, 3).Add(half))
+	// results that cancel are canonicalised to zero, so they can be compared with ==
+	assert.True(t, half.Sub(NewDuration(2, 4)) == Duration{})
+	assert.True(t, NewDuration(-1, 2).Add(half) == Duration{})
+
+	assert.Equal(t, NewDuration(1, 3), half.Mul(2, 3))
+	assert.Equal(t, NewDuration(-1, 3), half.Mul(-2, 3))
+	assert.Equal(t, NewDuration(1, 3), NewDuration(-1, 2).Mul(2, -3))
+	assert.Equal(t, Duration{}, half.Mul(0, 3))
+}
+
+func TestDuration_Overflow(t *testing.T) {
+	big := NewDuration(math.MaxInt64, 1)
+	assert.True(t, big.Add(NewDuration(1, 1)).Overflow())
+	assert.True(t, NewDuration(-math.MaxInt64, 1).Sub(NewDuration(1, 1)).Overflow())
+	assert.True(t, big.Mul(2, 1).Overflow())
+	assert.True(t, NewDuration(1, math.MaxInt64).Mul(1, 2).Overflow())
+	assert.True(t, NewDuration(1, math.MaxInt64).Add(NewDuration(1, 2)).Overflow())
+	assert.True(t, NewDuration(math.MinInt64, 1).Overflow())
+	// the overflow propagates through the following operations
+	assert.True(t, big.Mul(2, 1).Mul(0, 1).Add(NewDuration(1, 2)).Overflow())
+	assert.Equal(t, "overflow", big.Mul(2, 1).String())
+
+	// the factors are reduced before multiplying, so the results that fit don't overflow
+	assert.Equal(t, NewDuration(math.MaxInt64, 3), big.Mul(2, 6))
+	assert.Equal(t, NewDuration(1, 3), NewDuration(2, math.MaxInt64).Mul(math.MaxInt64, 6))
+	assert.Equal(t, NewDuration(1, 1), NewDuration(1, math.MaxInt64).Add(NewDuration(math.MaxInt64-1, math.MaxInt64)))
+	assert.False(t, big.Overflow())
+	assert.False(t, Duration{}.Overflow())
+	// the comparison doesn't overflow either
+	assert.Equal(t, 1, NewDuration(math.MaxInt64-1, math.MaxInt64).Cmp(
+		NewDuration(math.MaxInt64-2, math.MaxInt64-1)))
+}
+
+func TestDuration_Cmp(t *testing.T) {
+	tests := []struct {
+		a, b Duration
+		cmp  int
+	}{
+		{a: NewDuration(1, 3), b: NewDuration(1, 2), cmp: -1},
+		{a: NewDuration(1, 2), b: NewDuration(1, 3), cmp: 1},
+		{a: NewDuration(2, 4), b: NewDuration(1, 2), cmp: 0},
+		{a: NewDuration(-1, 2), b: NewDuration(-1, 3), cmp: -1},
+		{a: NewDuration(-1, 3), b: NewDuration(-1, 2), cmp: 1},
+		{a: NewDuration(-1, 2), b: Duration{}, cmp: -1},
+		{a: Duration{}, b: NewDuration(-1, 2), cmp: 1},
+		{a: Duration{}, b: NewDuration(0, 3), cmp: 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.a.String()+" vs "+tc.b.String(), func(t *testing.T) {
+			assert.Equal(t, tc.cmp, tc.a.Cmp(tc.b))
+			assert.Equal(t, tc.cmp < 0, tc.a.Less(tc.b))
+		})
+	}
+}
+
+func TestDuration_Floor(t *testing.T) {
+	assert.Equal(t, int64(2), NewDuration(5, 2).Floor())
+	assert.Equal(t, int64(3), NewDuration(3, 1).Floor())
+	assert.Equal(t, int64(0), NewDuration(1, 3).Floor())
+	// floor rounds towards negative infinity, not towards zero
+	assert.Equal(t, int64(-3), NewDuration(-5, 2).Floor())
+	assert.Equal(t, int64(-1), NewDuration(-1, 3).Floor())
+	assert.Equal(t, int64(-3), NewDuration(-3, 1).Floor())
+}
+
+func TestDuration_String(t *testing.T) {
+	assert.Equal(t, "3", NewDuration(6, 2).String())
+	assert.Equal(t, "3/4", NewDuration(6, 8).String())
+	assert.Equal(t, "-3/4", NewDuration(3, -4).String())
+	assert.Equal(t, "-2", NewDuration(-2, 1).String())
+	assert.Equal(t, "0", NewDuration(0, 4).String())
+}
+
+func TestDuration_Float64(t *testing.T) {
+	assert.Equal(t, 0.75, NewDuration(3, 4).Float64())
+	assert.Equal(t, -0.5, NewDuration(-1, 2).Float64())
+	assert.Equal(t, 0.0, Duration{}.Float64())
+}
+
+func TestLengthBeats(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		dots   int
+		tuplet Tuplet
+		beats  Duration
+	}{
+		{name: "whole", length: 1, beats: NewDuration(4, 1)},
+		{name: "quarter", length: 4, beats: NewDuration(1, 1)},
+		{name: "sixteenth", length: 16, beats: NewDuration(1, 4)},
+		{name: "dotted quarter", length: 4, dots: 1, beats: NewDuration(3, 2)},
+		{name: "double dotted quarter", length: 4, dots: 2, beats: NewDuration(7, 4)},
+		{name: "triple dotted half", length: 2, dots: 3, beats: NewDuration(15, 4)},
+		{name: "triplet eighth", length: 8, tuplet: Tuplet{Notes: 3, Span: 2},
+			beats: NewDuration(1, 3)},
+		{name: "quintuplet sixteenth", length: 16, tuplet: Tuplet{Notes: 5, Span: 4},
+			beats: NewDuration(1, 5)},
+		{name: "dotted triplet quarter", length: 4, dots: 1, tuplet: Tuplet{Notes: 3, Span: 2},
+			beats: NewDuration(1, 1)},
+		{name: "nested triplets", length: 4, tuplet: Tuplet{Notes: 9, Span: 4},
+			beats: NewDuration(4, 9)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.beats, lengthBeats(tc.length, tc.dots, tc.tuplet))
+		})
+	}
+}
+
+func TestBeats(t *testing.T) {
+	n := Note{Pitch: C, Length: 4, Dots: 1, Ties: []Tie{{Length: 16}, {Length: 8, Dots: 1}}}
+	// 3/2 + 1/4 + 3/4
+	assert.Equal(t, NewDuration(5, 2), n.Beats())
+	// ties are not affected by the tuplet of the note
+	n.Tuplet = Tuplet{Notes: 3, Span: 2}
+	assert.Equal(t, NewDuration(2, 1), n.Beats())
+
+	s := Silence{Length: 8, Tuplet: Tuplet{Notes: 3, Span: 2}}
+	assert.Equal(t, NewDuration(1, 3), s.Beats())
+	nz := Noise{Period: 3, Length: 2, Dots: 1}
+	assert.Equal(t, NewDuration(3, 1), nz.Beats())
+}
@@ -0,0 +1,70 @@
+package song
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// KeySignatureKey is the header property that sets the key of the song. e.g. key d, key f#m
+const KeySignatureKey = "key"
+
+var keySignatureFormat = regexp.MustCompile(`^([a-gA-G])([#+\-]?)([mM]?)$`)
+
+// position of each natural pitch in the circle of fifths, from C
+var pitchFifths = map[Pitch]int{F: -1, C: 0, G: 1, D: 2, A: 3, E: 4, B: 5}
+
+// order in which the sharps are added to the key signatures. The flats are added in reverse order
+var sharpsOrder = []Pitch{F, C, G, D, A, E, B}
+
+// KeySignature of a song: the accidentals that are applied to the notes that don't
+// specify any accidental
+type KeySignature struct {
+	// Accidentals is the number of sharps (if positive) or flats (if negative) of the key,
+	// from -7 to 7
+	Accidentals int
+	// Minor is true for minor keys
+	Minor bool
+}
+
+// ParseKeySignature parses a key with the format tonic, accidental (+, # or -) and 'm' for the
+// minor keys. e.g. d (D major), f#m (F sharp minor), b- (B flat major)
+func ParseKeySignature(key string) (KeySignature, error) {
+	sm := keySignatureFormat.FindStringSubmatch(key)
+	if sm == nil {
+		return KeySignature{}, fmt.Errorf("wrong key %q. Expected tonic, accidental and 'm' for minor keys (e.g. f#m)", key)
+	}
+	ks := KeySignature{
+		Accidentals: pitchFifths[Pitch(strings.ToLower(sm[1])[0])],
+		Minor:       sm[3] != "",
+	}
+	switch sm[2] {
+	case "+", "#":
+		ks.Accidentals += len(sharpsOrder)
+	case "-":
+		ks.Accidentals -= len(sharpsOrder)
+	}
+	if ks.Minor {
+		// the relative major key is three semitones above
+		ks.Accidentals -= 3
+	}
+	if ks.Accidentals < -len(sharpsOrder) || ks.Accidentals > len(sharpsOrder) {
+		return KeySignature{}, fmt.Errorf("key %q has too many accidentals. Use its enharmonic key", key)
+	}
+	return ks, nil
+}
+
+// Halftone returns the accidental that the key applies to the given pitch
+func (ks KeySignature) Halftone(p Pitch) Halftone {
+	for i := 0; i < ks.Accidentals; i++ {
+		if sharpsOrder[i] == p {
+			return Sharp
+		}
+	}
+	for i := 0; i < -ks.Accidentals; i++ {
+		if sharpsOrder[len(sharpsOrder)-1-i] == p {
+			return Flat
+		}
+	}
+	return NoHalftone
+}
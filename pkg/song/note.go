@@ -15,20 +15,161 @@ const (
 type Halftone uint8
 
 const (
-	NoHalftone Halftone = 0
-	Sharp      Halftone = '#' //increases pitch by one semitone
-	Flat       Halftone = '-' // lowers pitch by one semitone
-	// Todo: consider others http://neilhawes.com/sstheory/theory17.htm
+	NoHalftone  Halftone = 0
+	Sharp       Halftone = '#' //increases pitch by one semitone
+	Flat        Halftone = '-' // lowers pitch by one semitone
+	DoubleSharp Halftone = 'x' // increases pitch by two semitones
+	DoubleFlat  Halftone = 'b' // lowers pitch by two semitones
 )
 
+// Semitones that the halftone increases (positive) or lowers (negative) the pitch
+func (h Halftone) Semitones() int {
+	switch h {
+	case Sharp:
+		return 1
+	case Flat:
+		return -1
+	case DoubleSharp:
+		return 2
+	case DoubleFlat:
+		return -2
+	}
+	return 0
+}
+
+func (h Halftone) String() string {
+	switch h {
+	case NoHalftone:
+		return ""
+	case DoubleSharp:
+		return "##"
+	case DoubleFlat:
+		return "--"
+	}
+	return string(rune(h))
+}
+
+// SemitonesPerOctave is the number of semitones between a note and the same note in the next
+// octave
+const SemitonesPerOctave = 12
+
+// semitones of each natural pitch, from C
+var pitchSemitones = map[Pitch]int{C: 0, D: 2, E: 4, F: 5, G: 7, A: 9, B: 11}
+
+// spelling of each semitone, from C, as natural or sharp notes, and as natural or flat notes
+var sharpSpelling = [SemitonesPerOctave]Note{
+	{Pitch: C}, {Pitch: C, Halftone: Sharp}, {Pitch: D}, {Pitch: D, Halftone: Sharp}, {Pitch: E},
+	{Pitch: F}, {Pitch: F, Halftone: Sharp}, {Pitch: G}, {Pitch: G, Halftone: Sharp}, {Pitch: A},
+	{Pitch: A, Halftone: Sharp}, {Pitch: B},
+}
+var flatSpelling = [SemitonesPerOctave]Note{
+	{Pitch: C}, {Pitch: D, Halftone: Flat}, {Pitch: D}, {Pitch: E, Halftone: Flat}, {Pitch: E},
+	{Pitch: F}, {Pitch: G, Halftone: Flat}, {Pitch: G}, {Pitch: A, Halftone: Flat}, {Pitch: A},
+	{Pitch: B, Halftone: Flat}, {Pitch: B},
+}
+
 type Note struct {
 	Pitch    Pitch
-	Length   int // as a divisor 1: whole note
-	Tuplet   int // e.g. 3 means this note is part of a triplet
-	Halftone Halftone
-	Dots     int // number of dots
+	Length   int      // as a divisor 1: whole note
+	Tuplet   Tuplet   // e.g. 3:2 means this note is part of a triplet
+	Halftone Halftone // effective accidental, after applying the key signature
+	Dots     int      // number of dots
+	// Ties extend the duration of the note without re-triggering it
+	Ties []Tie
+}
+
+// Beats returns the duration of the note, including its ties
+func (n *Note) Beats() Duration {
+	beats := lengthBeats(n.Length, n.Dots, n.Tuplet)
+	for _, tie := range n.Ties {
+		beats = beats.Add(tie.Beats())
+	}
+	return beats
+}
+
+// Semitones returns the distance of the note from the C of its octave, after applying its
+// accidental. It can be negative (e.g. C-) or greater than 11 (e.g. B#)
+func (n Note) Semitones() int {
+	return pitchSemitones[n.Pitch] + n.Halftone.Semitones()
+}
+
+// Normalized returns the same note, spelled as a natural or sharp note (e.g. E# as F, or D- as
+// C#), as well as the number of octaves that the respelled note is shifted (e.g. B# is the C of
+// the next octave, and C- is the B of the previous octave)
+func (n Note) Normalized() (Note, int) {
+	return n.Transposed(0)
+}
+
+// Transposed returns the note transposed by the given semitones, as well as the number of octaves
+// that the note is shifted. The transposed note is spelled as a natural or sharp note when the
+// transposition goes up, and as a natural or flat note when it goes down
+func (n Note) Transposed(semitones int) (Note, int) {
+	st := n.Semitones() + semitones
+	octaves := st / SemitonesPerOctave
+	st %= SemitonesPerOctave
+	if st < 0 {
+		st += SemitonesPerOctave
+		octaves--
+	}
+	spelling := sharpSpelling
+	if semitones < 0 {
+		spelling = flatSpelling
+	}
+	n.Pitch, n.Halftone = spelling[st].Pitch, spelling[st].Halftone
+	return n, octaves
+}
+
+// Tie is a duration that is added to a note
+type Tie struct {
+	Length int
+	Dots   int
+	// Bar is true if the tied notes are separated by a bar separator (e.g. c2&|c8). Then the tie
+	// and the following ones belong to the next measure
+	Bar bool
+}
+
+// Beats returns the duration of the tie. Ties are not affected by tuplets
+func (t Tie) Beats() Duration {
+	return lengthBeats(t.Length, t.Dots, Tuplet{})
 }
 
 type Silence struct {
 	Length int // as Note's Length field
+	Tuplet Tuplet
+	Dots   int
+}
+
+func (s *Silence) Beats() Duration {
+	return lengthBeats(s.Length, s.Dots, s.Tuplet)
+}
+
+// Noise hit that sounds through the noise generator instead of the tone generator
+type Noise struct {
+	Period int // noise divider rate
+	Length int // as Note's Length field
+	Tuplet Tuplet
+	Dots   int
+}
+
+func (n *Noise) Beats() Duration {
+	return lengthBeats(n.Length, n.Dots, n.Tuplet)
+}
+
+// Tuplet plays a number of Notes in the time of Span notes of the same length (e.g. 3:2 for
+// triplets). The zero value means that the item is not part of any tuplet
+type Tuplet struct {
+	Notes int
+	Span  int
+}
+
+// Within returns the resulting tuplet of an item that belongs to this tuplet, which is nested
+// into the outer tuplet. e.g. a triplet inside a triplet is a 9:4 tuplet
+func (t Tuplet) Within(outer Tuplet) Tuplet {
+	if t == (Tuplet{}) {
+		return outer
+	}
+	if outer == (Tuplet{}) {
+		return t
+	}
+	return Tuplet{Notes: t.Notes * outer.Notes, Span: t.Span * outer.Span}
 }
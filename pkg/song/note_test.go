@@ -0,0 +1,80 @@
+package song
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTuplet_Within(t *testing.T) {
+	triplet := Tuplet{Notes: 3, Span: 2}
+	quintuplet := Tuplet{Notes: 5, Span: 4}
+	// the zero tuplet means "not in a tuplet"
+	assert.Equal(t, Tuplet{}, Tuplet{}.Within(Tuplet{}))
+	assert.Equal(t, triplet, triplet.Within(Tuplet{}))
+	assert.Equal(t, triplet, Tuplet{}.Within(triplet))
+	// nested tuplets multiply their ratios
+	assert.Equal(t, Tuplet{Notes: 9, Span: 4}, triplet.Within(triplet))
+	assert.Equal(t, Tuplet{Notes: 15, Span: 8}, quintuplet.Within(triplet))
+	assert.Equal(t, Tuplet{Notes: 15, Span: 8}, triplet.Within(quintuplet))
+}
+
+func TestNote_Normalized(t *testing.T) {
+	tests := []struct {
+		note     Note
+		expected Note
+		octaves  int
+	}{
+		{note: Note{Pitch: C}, expected: Note{Pitch: C}},
+		{note: Note{Pitch: F, Halftone: Sharp}, expected: Note{Pitch: F, Halftone: Sharp}},
+		{note: Note{Pitch: D, Halftone: Flat}, expected: Note{Pitch: C, Halftone: Sharp}},
+		{note: Note{Pitch: E, Halftone: Sharp}, expected: Note{Pitch: F}},
+		{note: Note{Pitch: F, Halftone: Flat}, expected: Note{Pitch: E}},
+		{note: Note{Pitch: G, Halftone: DoubleSharp}, expected: Note{Pitch: A}},
+		{note: Note{Pitch: A, Halftone: DoubleFlat}, expected: Note{Pitch: G}},
+		// respelled notes in the neighbour octaves
+		{note: Note{Pitch: B, Halftone: Sharp}, expected: Note{Pitch: C}, octaves: 1},
+		{note: Note{Pitch: B, Halftone: DoubleSharp}, expected: Note{Pitch: C, Halftone: Sharp},
+			octaves: 1},
+		{note: Note{Pitch: C, Halftone: Flat}, expected: Note{Pitch: B}, octaves: -1},
+		{note: Note{Pitch: C, Halftone: DoubleFlat}, expected: Note{Pitch: A, Halftone: Sharp},
+			octaves: -1},
+	}
+	for _, tc := range tests {
+		t.Run(string(tc.note.Pitch)+tc.note.Halftone.String(), func(t *testing.T) {
+			n, octaves := tc.note.Normalized()
+			assert.Equal(t, tc.expected, n)
+			assert.Equal(t, tc.octaves, octaves)
+		})
+	}
+	// other properties of the note are kept
+	n, _ := Note{Pitch: E, Halftone: Sharp, Length: 8, Dots: 1, Tuplet: Tuplet{Notes: 3, Span: 2},
+		Ties: []Tie{{Length: 4}}}.Normalized()
+	assert.Equal(t, Note{Pitch: F, Length: 8, Dots: 1, Tuplet: Tuplet{Notes: 3, Span: 2},
+		Ties: []Tie{{Length: 4}}}, n)
+}
+
+func TestTransposed(t *testing.T) {
+	tests := []struct {
+		note      Note
+		semitones int
+		expected  Note
+		octaves   int
+	}{
+		{note: Note{Pitch: C}, semitones: 1, expected: Note{Pitch: C, Halftone: Sharp}},
+		{note: Note{Pitch: D}, semitones: -1, expected: Note{Pitch: D, Halftone: Flat}},
+		{note: Note{Pitch: B}, semitones: 2, expected: Note{Pitch: C, Halftone: Sharp}, octaves: 1},
+		{note: Note{Pitch: C}, semitones: -2, expected: Note{Pitch: B, Halftone: Flat}, octaves: -1},
+		{note: Note{Pitch: E, Halftone: Flat}, semitones: 24, expected: Note{Pitch: D, Halftone: Sharp},
+			octaves: 2},
+		{note: Note{Pitch: G}, semitones: -31, expected: Note{Pitch: C}, octaves: -2},
+	}
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%c%v%+d", tc.note.Pitch, tc.note.Halftone, tc.semitones), func(t *testing.T) {
+			n, octaves := tc.note.Transposed(tc.semitones)
+			assert.Equal(t, tc.expected, n)
+			assert.Equal(t, tc.octaves, octaves)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package song
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Position of an element in the source code
+type Position struct {
+	// File is empty if the source code was not read from a file
+	File string
+	Row  int
+	Col  int
+}
+
+func (p Position) String() string {
+	if p.File != "" {
+		return fmt.Sprintf("%s:%d:%d", p.File, p.Row, p.Col)
+	}
+	return fmt.Sprintf("%d:%d", p.Row, p.Col)
+}
+
+// Source locates a song element in the source code
+type Source struct {
+	// Position where the element is written
+	Position
+	// References to the constants that placed the element in its current location, from the
+	// innermost to the outermost. Empty if the element is not expanded from a constant
+	References []Reference
+}
+
+// Reference to a constant from the source code
+type Reference struct {
+	Constant string
+	Position Position
+}
+
+// Expanded returns a copy of the source, as it is placed by the reference to a constant
+// in the given position
+func (s *Source) Expanded(constant string, at Position) *Source {
+	refs := make([]Reference, 0, len(s.References)+1)
+	refs = append(refs, s.References...)
+	return &Source{
+		Position:   s.Position,
+		References: append(refs, Reference{Constant: constant, Position: at}),
+	}
+}
+
+// UseSite returns the position where the element is actually placed: the outermost
+// constant reference if the element is expanded from a constant, or its own position otherwise
+func (s *Source) UseSite() Position {
+	if len(s.References) == 0 {
+		return s.Position
+	}
+	return s.References[len(s.References)-1].Position
+}
+
+func (s Source) String() string {
+	if len(s.References) == 0 {
+		return s.Position.String()
+	}
+	sb := strings.Builder{}
+	sb.WriteString(s.Position.String())
+	sb.WriteString(" (")
+	for i, r := range s.References {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		fmt.Fprintf(&sb, "from $%s at %v", r.Constant, r.Position)
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
@@ -43,28 +43,112 @@ func (s *Song) AddItems(channelName string, items ...TablatureItem) {
 	ch.Items = append(ch.Items, items...)
 }
 
+// AddStatement adds the items of a channel statement (e.g. @ch1 <- abc) that is written in the
+// given position of the source code
+func (s *Song) AddStatement(channelName string, pos Position, items ...TablatureItem) {
+	s.AddItems(channelName, items...)
+	ch := s.endBlock().Channels[channelName]
+	ch.Statements = append(ch.Statements, pos)
+}
+
 // TablatureItem pseudo-union type: whatever you can find in a tablature
 type TablatureItem struct {
 	Instrument *Instrument
 	Note       *Note
 	Silence    *Silence
+	Noise      *Noise
 	SetOctave  *int
 	OctaveStep *int // negative: decrements
 	Volume     *int // 0 to 15
+	Tempo      *int // beats per minute, from this point of the song
+	Repeat     *Repeat
+	// Bar is true for the bar separators (|). They don't sound, but mark the measures of the song
+	Bar bool
+	// Source of the item. Nil if the item was not parsed from a source code
+	Source *Source
+}
+
+// Repeat is a tablature fragment that is played multiple times
+type Repeat struct {
+	Times int
+	Items Tablature
+	// Endings are alternatively played after the items: the Nth ending is played after
+	// the Nth repetition. The last ending is played in the rest of the repetitions.
+	Endings []Tablature
+}
+
+// Ending returns the alternative ending that is played after the given repetition (from 0)
+func (r *Repeat) Ending(repetition int) Tablature {
+	if len(r.Endings) == 0 {
+		return nil
+	}
+	if repetition >= len(r.Endings) {
+		return r.Endings[len(r.Endings)-1]
+	}
+	return r.Endings[repetition]
 }
 
-func (ti *TablatureItem) DurationBeats() float64 {
-	if ti.Note != nil {
-		return 4 / float64(ti.Note.Length)
+// Beats returns how long all the repetitions sound, including their endings, without unrolling
+// the repeat
+func (r *Repeat) Beats() Duration {
+	beats := r.Items.Beats().Mul(int64(r.Times), 1)
+	for i, ending := range r.Endings {
+		// the last ending is played in the rest of repetitions
+		times := 1
+		if i == len(r.Endings)-1 {
+			times = r.Times - i
+		}
+		beats = beats.Add(ending.Beats().Mul(int64(times), 1))
 	}
-	if ti.Silence != nil {
-		return 4 / float64(ti.Silence.Length)
+	return beats
+}
+
+// Unroll returns a copy of the tablature where all the repeats, and the repeats inside them,
+// are expanded
+func (t Tablature) Unroll() Tablature {
+	unrolled := make(Tablature, 0, len(t))
+	for _, ti := range t {
+		if ti.Repeat == nil {
+			unrolled = append(unrolled, ti)
+			continue
+		}
+		items := ti.Repeat.Items.Unroll()
+		for r := 0; r < ti.Repeat.Times; r++ {
+			unrolled = append(unrolled, items...)
+			unrolled = append(unrolled, ti.Repeat.Ending(r).Unroll()...)
+		}
+	}
+	return unrolled
+}
+
+// DurationBeats returns how long the item sounds, in beats (quarter notes)
+func (ti *TablatureItem) DurationBeats() Duration {
+	switch {
+	case ti.Note != nil:
+		return ti.Note.Beats()
+	case ti.Silence != nil:
+		return ti.Silence.Beats()
+	case ti.Noise != nil:
+		return ti.Noise.Beats()
+	case ti.Repeat != nil:
+		return ti.Repeat.Beats()
+	}
+	return Duration{}
+}
+
+// Beats returns how long the tablature sounds, in beats (quarter notes)
+func (t Tablature) Beats() Duration {
+	beats := Duration{}
+	for i := range t {
+		beats = beats.Add(t[i].DurationBeats())
 	}
-	return 0
+	return beats
 }
 
 type Channel struct {
 	Items []TablatureItem
+	// Statements are the positions of the channel statements that sent the items to the channel
+	Statements []Position
 }
 
 // SyncedBlock contains channels that sound at the same time. The SyncedBlock hasn't finished
@@ -76,6 +160,8 @@ type SyncedBlock struct {
 type Instrument struct {
 	Class      string
 	Properties map[string]string
+	// Position where the instrument is defined
+	Position Position
 }
 
 type TimePoint struct {
@@ -0,0 +1,39 @@
+package song
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepeat_Beats(t *testing.T) {
+	quarter := TablatureItem{Note: &Note{Pitch: C, Length: 4}}
+	half := TablatureItem{Silence: &Silence{Length: 2}}
+	eighth := TablatureItem{Noise: &Noise{Length: 8}}
+	for _, tc := range []struct {
+		name   string
+		repeat Repeat
+		beats  Duration
+	}{
+		{name: "no endings", repeat: Repeat{Times: 3, Items: Tablature{quarter, half}},
+			beats: NewDuration(9, 1)},
+		{name: "one ending for all the repetitions",
+			repeat: Repeat{Times: 3, Items: Tablature{quarter}, Endings: []Tablature{{half}}},
+			beats:  NewDuration(9, 1)},
+		{name: "last ending for the rest of repetitions",
+			repeat: Repeat{Times: 4, Items: Tablature{quarter},
+				Endings: []Tablature{{half}, {eighth}}},
+			// 4 quarters, 1 half and 3 eighths
+			beats: NewDuration(15, 2)},
+		{name: "nested", repeat: Repeat{Times: 2, Items: Tablature{
+			quarter, {Repeat: &Repeat{Times: 3, Items: Tablature{eighth}}}}},
+			beats: NewDuration(5, 1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ti := TablatureItem{Repeat: &tc.repeat}
+			assert.Equal(t, tc.beats, ti.DurationBeats())
+			// same as the duration of the unrolled repeat
+			assert.Equal(t, tc.beats, Tablature{ti}.Unroll().Beats())
+		})
+	}
+}
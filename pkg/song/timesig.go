@@ -0,0 +1,47 @@
+package song
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// TimeSignatureKey is the header property that sets the time signature of the song. e.g. timesig 3/4
+const TimeSignatureKey = "timesig"
+
+var timeSignatureFormat = regexp.MustCompile(`^(\d+)/(\d+)$`)
+
+// TimeSignature of the song: each measure has Beats notes of the Unit length
+// (e.g. 6/8 means six eighth notes per measure)
+type TimeSignature struct {
+	Beats int
+	Unit  int
+}
+
+// ParseTimeSignature parses a time signature with the format beats/unit (e.g. 3/4). The unit
+// must be a power of two, from 1 to 64
+func ParseTimeSignature(ts string) (TimeSignature, error) {
+	sm := timeSignatureFormat.FindStringSubmatch(ts)
+	if sm == nil {
+		return TimeSignature{}, fmt.Errorf("wrong time signature %q. Expected beats/unit (e.g. 3/4)", ts)
+	}
+	// the regular expression guarantees that the numbers are valid
+	beats, _ := strconv.Atoi(sm[1])
+	unit, _ := strconv.Atoi(sm[2])
+	if beats < 1 {
+		return TimeSignature{}, fmt.Errorf("wrong time signature %q. A measure needs at least one beat", ts)
+	}
+	if unit < 1 || unit > 64 || unit&(unit-1) != 0 {
+		return TimeSignature{}, fmt.Errorf("wrong time signature %q. The unit must be 1, 2, 4, 8, 16, 32 or 64", ts)
+	}
+	return TimeSignature{Beats: beats, Unit: unit}, nil
+}
+
+// MeasureBeats returns the duration of a measure, in beats (quarter notes)
+func (ts TimeSignature) MeasureBeats() Duration {
+	return NewDuration(int64(ts.Beats)*4, int64(ts.Unit))
+}
+
+func (ts TimeSignature) String() string {
+	return fmt.Sprintf("%d/%d", ts.Beats, ts.Unit)
+}
@@ -0,0 +1,174 @@
+// Package vgm exports the songs to the Video Game Music format (https://vgmrips.net/wiki/VGM_Specification),
+// as a log of the writes to the registers of an AY-3-8910
+package vgm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+
+	"github.com/mariomac/msxmml/pkg/ay"
+	"github.com/mariomac/msxmml/pkg/psg"
+	"github.com/mariomac/msxmml/pkg/song"
+)
+
+// header properties of the song that fill the GD3 tag
+const (
+	TitleKey  = "title"
+	AuthorKey = "author"
+	GameKey   = "game"
+	DateKey   = "date"
+)
+
+const (
+	version    = 0x171
+	headerSize = 0x80
+	gd3Version = 0x100
+	// samples per second of the wait commands
+	sampleRate = 44100
+	// samples of the wait commands for one NTSC and PAL frame
+	ntscFrameSamples = 735
+	palFrameSamples  = 882
+	systemName       = "MSX"
+	creator          = "m4l"
+)
+
+// commands of the VGM data
+const (
+	cmdAY8910Write = 0xA0
+	cmdWait        = 0x61
+	cmdWaitNTSC    = 0x62
+	cmdWaitPAL     = 0x63
+	cmdEnd         = 0x66
+	// 0x7n waits n+1 samples
+	cmdWaitShort = 0x70
+)
+
+// offsets of the header fields
+const (
+	offEOF         = 0x04
+	offVersion     = 0x08
+	offGD3         = 0x14
+	offSamples     = 0x18
+	offLoop        = 0x1C
+	offLoopSamples = 0x20
+	offRate        = 0x24
+	offData        = 0x34
+	offAY8910Clock = 0x74
+	offAY8910Type  = 0x78
+	offAY8910Flags = 0x79
+)
+
+const (
+	ay8910Type = 0x00
+	// legacy output
+	ay8910Flags = 0x01
+)
+
+// Export the song as the register writes of the PSG, frame by frame, as psg.Simulator runs the
+// binary of psg.Export
+func Export(s *song.Song) ([]byte, error) {
+	psgBytes, err := psg.Export(s)
+	if err != nil {
+		return nil, err
+	}
+	hz, err := psg.FrameRate(s)
+	if err != nil {
+		return nil, err
+	}
+	sim, err := psg.NewSimulator(psgBytes)
+	if err != nil {
+		return nil, err
+	}
+	vgm := make([]byte, headerSize, 16*1024)
+	le := binary.LittleEndian
+	copy(vgm, "Vgm ")
+	le.PutUint32(vgm[offVersion:], version)
+	le.PutUint32(vgm[offRate:], uint32(hz))
+	le.PutUint32(vgm[offData:], headerSize-offData)
+	le.PutUint32(vgm[offAY8910Clock:], ay.MSXClock)
+	vgm[offAY8910Type] = ay8910Type
+	vgm[offAY8910Flags] = ay8910Flags
+
+	data := bytes.Buffer{}
+	fw := psg.NewFrameWriter(sampleRate, hz)
+	// position in the data and samples where the loop starts. Negative if the song doesn't loop
+	loopPos, loopSample := -1, 0
+	samples := 0
+	// the song is recorded until it jumps back to its loop
+	for frame, ok := sim.Next(); ok && !frame.Loop; frame, ok = sim.Next() {
+		// the loop writes all the registers, so it doesn't depend on the state of the song end
+		writeAll := false
+		if frame.LoopStart && loopPos < 0 {
+			loopPos, loopSample = data.Len(), samples
+			writeAll = true
+		}
+		for _, w := range fw.Writes(frame, writeAll) {
+			data.Write([]byte{cmdAY8910Write, byte(w.Register), w.Value})
+		}
+		wait := fw.Samples()
+		writeWait(&data, wait)
+		samples += wait
+	}
+	data.WriteByte(cmdEnd)
+
+	le.PutUint32(vgm[offSamples:], uint32(samples))
+	if loopPos >= 0 {
+		le.PutUint32(vgm[offLoop:], uint32(headerSize+loopPos-offLoop))
+		le.PutUint32(vgm[offLoopSamples:], uint32(samples-loopSample))
+	}
+	vgm = append(vgm, data.Bytes()...)
+	le.PutUint32(vgm[offGD3:], uint32(len(vgm)-offGD3))
+	vgm = append(vgm, gd3(s.Properties)...)
+	le.PutUint32(vgm[offEOF:], uint32(len(vgm)-offEOF))
+	return vgm, nil
+}
+
+// writeWait appends the shortest commands that wait the given samples
+func writeWait(data *bytes.Buffer, samples int) {
+	for samples > 0 {
+		switch {
+		case samples == ntscFrameSamples:
+			data.WriteByte(cmdWaitNTSC)
+			return
+		case samples == palFrameSamples:
+			data.WriteByte(cmdWaitPAL)
+			return
+		case samples <= 16:
+			data.WriteByte(cmdWaitShort | byte(samples-1))
+			return
+		}
+		wait := samples
+		if wait > 0xFFFF {
+			wait = 0xFFFF
+		}
+		data.Write([]byte{cmdWait, byte(wait), byte(wait >> 8)})
+		samples -= wait
+	}
+}
+
+// gd3 returns the tag with the information of the song, from its header properties
+func gd3(props map[string]string) []byte {
+	// English and Japanese track name, game name, system name and author, release date,
+	// converter and notes
+	fields := []string{
+		props[TitleKey], "",
+		props[GameKey], "",
+		systemName, "",
+		props[AuthorKey], "",
+		props[DateKey],
+		creator,
+		"",
+	}
+	var text []byte
+	for _, field := range fields {
+		for _, c := range utf16.Encode([]rune(field + "\x00")) {
+			text = append(text, byte(c), byte(c>>8))
+		}
+	}
+	tag := []byte("Gd3 ")
+	tag = append(tag, make([]byte, 8)...)
+	binary.LittleEndian.PutUint32(tag[4:], gd3Version)
+	binary.LittleEndian.PutUint32(tag[8:], uint32(len(text)))
+	return append(tag, text...)
+}
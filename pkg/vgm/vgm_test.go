@@ -0,0 +1,199 @@
+package vgm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/mariomac/msxmml/pkg/ay"
+	"github.com/mariomac/msxmml/pkg/lang"
+)
+
+// register of the AY-3-8910 whose writes restart the envelope
+const envelopeShapeRegister = 13
+
+type write struct {
+	reg, value byte
+}
+
+// command of the VGM data. Waits have no register writes
+type command struct {
+	writes []write
+	wait   int
+	// offset from the start of the file
+	offset int
+}
+
+func export(t *testing.T, src string) []byte {
+	t.Helper()
+	s, err := lang.Parse(strings.NewReader(src))
+	require.NoError(t, err)
+	vgm, err := Export(s)
+	require.NoError(t, err)
+	return vgm
+}
+
+// frames groups the commands of the VGM data into the register writes that are followed
+// by a wait
+func frames(t *testing.T, vgm []byte) []command {
+	t.Helper()
+	le := binary.LittleEndian
+	var cmds []command
+	current := command{}
+	for i := offData + int(le.Uint32(vgm[offData:])); ; {
+		require.Less(t, i, len(vgm))
+		switch op := vgm[i]; {
+		case op == cmdAY8910Write:
+			if len(current.writes) == 0 {
+				current.offset = i
+			}
+			current.writes = append(current.writes, write{reg: vgm[i+1], value: vgm[i+2]})
+			i += 3
+			continue
+		case op == cmdWait:
+			current.wait = int(le.Uint16(vgm[i+1:]))
+			i += 3
+		case op == cmdWaitNTSC:
+			current.wait = ntscFrameSamples
+			i++
+		case op == cmdWaitPAL:
+			current.wait = palFrameSamples
+			i++
+		case op&0xF0 == cmdWaitShort:
+			current.wait = int(op&0x0F) + 1
+			i++
+		case op == cmdEnd:
+			require.Empty(t, current.writes)
+			return cmds
+		default:
+			require.Failf(t, "unexpected command", "%#x at %d", op, i)
+		}
+		if len(current.writes) == 0 {
+			current.offset = -1
+		}
+		cmds = append(cmds, current)
+		current = command{}
+	}
+}
+
+func TestExport_Header(t *testing.T) {
+	vgm := export(t, "@ch1 <- a\nloop:\n@ch1 <- b\n")
+	le := binary.LittleEndian
+	assert.Equal(t, "Vgm ", string(vgm[0:4]))
+	assert.Equal(t, uint32(len(vgm)-4), le.Uint32(vgm[offEOF:]))
+	assert.Equal(t, uint32(0x171), le.Uint32(vgm[offVersion:]))
+	assert.Equal(t, uint32(60), le.Uint32(vgm[offRate:]))
+	assert.Equal(t, uint32(ay.MSXClock), le.Uint32(vgm[offAY8910Clock:]))
+	assert.Equal(t, uint32(0x80-0x34), le.Uint32(vgm[offData:]))
+	// 60 frames of notes plus the frame where the song ends
+	assert.Equal(t, uint32(61*735), le.Uint32(vgm[offSamples:]))
+	// the loop starts after the 30 frames of a
+	assert.Equal(t, uint32(31*735), le.Uint32(vgm[offLoopSamples:]))
+
+	cmds := frames(t, vgm)
+	require.Len(t, cmds, 61)
+	for _, cmd := range cmds {
+		assert.Equal(t, 735, cmd.wait)
+	}
+	// the first frame writes all the registers but the envelope shape, which would restart
+	// the envelope
+	require.Len(t, cmds[0].writes, 13)
+	assert.Equal(t, write{reg: 0, value: 254}, cmds[0].writes[0])
+	assert.Equal(t, write{reg: 8, value: 15}, cmds[0].writes[8])
+	// the loop writes all the registers too, so it can be played after the end of the song
+	loop := cmds[30]
+	assert.Equal(t, loop.offset, offLoop+int(le.Uint32(vgm[offLoop:])))
+	require.Len(t, loop.writes, 13)
+	assert.Equal(t, write{reg: 0, value: 227}, loop.writes[0])
+	// the frames that don't change any register only wait
+	assert.Empty(t, cmds[1].writes)
+	assert.Empty(t, cmds[31].writes)
+}
+
+func TestExport_NoLoop(t *testing.T) {
+	vgm := export(t, "psg.hz 50\n@ch1 <- a\n")
+	le := binary.LittleEndian
+	assert.Equal(t, uint32(50), le.Uint32(vgm[offRate:]))
+	assert.Zero(t, le.Uint32(vgm[offLoop:]))
+	assert.Zero(t, le.Uint32(vgm[offLoopSamples:]))
+	cmds := frames(t, vgm)
+	// the note lasts 25 frames, and the end of the song stops all the channels
+	require.Len(t, cmds, 26)
+	for _, cmd := range cmds {
+		assert.Equal(t, 882, cmd.wait)
+	}
+	assert.Equal(t, uint32(26*882), le.Uint32(vgm[offSamples:]))
+	assert.Equal(t, []write{{reg: 7, value: 0b10111111}}, cmds[25].writes)
+}
+
+func TestExport_Envelope(t *testing.T) {
+	vgm := export(t, `
+$bell := psg {
+	pattern: 13
+	cycle: 1000
+}
+@ch1 <- $bell a a $bell a
+`)
+	var restarts int
+	for _, cmd := range frames(t, vgm) {
+		for _, w := range cmd.writes {
+			if w.reg == envelopeShapeRegister {
+				assert.Equal(t, byte(13), w.value)
+				restarts++
+			}
+		}
+	}
+	// the envelope restarts each time that the instrument is set, and not with each note
+	assert.Equal(t, 2, restarts)
+}
+
+func TestWriteWait(t *testing.T) {
+	for samples, expected := range map[int][]byte{
+		1:       {0x70},
+		16:      {0x7F},
+		17:      {0x61, 17, 0},
+		735:     {0x62},
+		882:     {0x63},
+		736:     {0x61, 0xE0, 0x02},
+		0x10001: {0x61, 0xFF, 0xFF, 0x71},
+	} {
+		data := bytes.Buffer{}
+		writeWait(&data, samples)
+		assert.Equalf(t, expected, data.Bytes(), "samples: %d", samples)
+	}
+}
+
+func TestExport_GD3(t *testing.T) {
+	vgm := export(t, `title "Dance of the knights" ; Prokofiev
+author "Sergei Prokofiev"
+date 1935
+@ch1 <- a
+`)
+	le := binary.LittleEndian
+	tag := vgm[offGD3+int(le.Uint32(vgm[offGD3:])):]
+	assert.Equal(t, "Gd3 ", string(tag[0:4]))
+	assert.Equal(t, uint32(0x100), le.Uint32(tag[4:]))
+	text := tag[12:]
+	require.Equal(t, int(le.Uint32(tag[8:])), len(text))
+	chars := make([]uint16, len(text)/2)
+	for i := range chars {
+		chars[i] = le.Uint16(text[2*i:])
+	}
+	fields := strings.Split(string(utf16.Decode(chars)), "\x00")
+	assert.Equal(t, []string{
+		"Dance of the knights", "",
+		"", "",
+		"MSX", "",
+		"Sergei Prokofiev", "",
+		"1935",
+		"m4l",
+		"",
+		// after the last null terminator
+		"",
+	}, fields)
+}